@@ -11,9 +11,14 @@ import (
 	"github.com/rs/zerolog/log"
 
 	"github.com/jessevdk/go-flags"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/alerts"
 	wsAPI "gl.dev.boquar.com/backend/device-status-aggregator/pkg/api/ws"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/bridge"
 	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/config"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/history"
 	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/router"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/stats"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/webhook"
 )
 
 const (
@@ -33,9 +38,58 @@ func main() {
 	errs := make(chan error, 5)
 	go waitInterruptSignal(errs)
 
-	router := router.NewRouterHandler(&log.Logger, env)
+	router, err := router.NewRouterHandler(&log.Logger, env)
+	if err != nil {
+		log.Panic().Err(err).Msg("unable to create router")
+	}
+
+	var webhooks *webhook.Dispatcher
+	if env.WebhookRulesFile != "" {
+		webhooks, err = webhook.NewDispatcher(env, &log.Logger, router)
+		if err != nil {
+			log.Panic().Err(err).Msg("unable to create webhook dispatcher")
+		}
+		router.AddTransitionObserver(webhooks)
+		webhooks.Run(context.Background())
+	}
+
+	var alertEngine *alerts.Engine
+	if env.AlertRulesFile != "" {
+		alertEngine, err = alerts.NewEngine(env, &log.Logger, router)
+		if err != nil {
+			log.Panic().Err(err).Msg("unable to create alert engine")
+		}
+		if webhooks != nil {
+			alertEngine.AddSink(webhooks)
+		}
+		router.AddMessageObserver(alertEngine)
+		alertEngine.Run(context.Background())
+	}
+
+	var historyStore *history.Store
+	if env.HistoryFile != "" {
+		historyStore, err = history.Open(env, &log.Logger, router)
+		if err != nil {
+			log.Panic().Err(err).Msg("unable to open history")
+		}
+		router.AddMessageObserver(historyStore)
+		historyStore.Run(context.Background())
+	}
+
+	statsTracker := stats.NewTracker(historyStore)
+	router.AddTransitionObserver(statsTracker)
+
+	var publisher *bridge.MQTTPublisher
+	if env.MQTTPublish || len(env.MQTTPublishDevices) > 0 {
+		publisher, err = bridge.NewMQTTPublisher(env, &log.Logger, router)
+		if err != nil {
+			log.Panic().Err(err).Msg("unable to create mqtt publisher")
+		}
+		router.AddMessageObserver(publisher)
+		publisher.Run(context.Background())
+	}
 
-	serverWS, err := wsAPI.NewServer(router, env)
+	serverWS, err := wsAPI.NewServer(router, historyStore, statsTracker, env)
 	if err != nil {
 		log.Panic().Err(err).Msg("unable to create websocket server")
 	}
@@ -44,7 +98,7 @@ func main() {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		errs <- serverWS.ListenAndServe()
+		errs <- wsAPI.ListenAndServe(serverWS)
 	}()
 
 	err = <-errs
@@ -60,7 +114,19 @@ func main() {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
+		if publisher != nil {
+			publisher.Stop()
+		}
 		router.Stop()
+		if alertEngine != nil {
+			alertEngine.Stop()
+		}
+		if webhooks != nil {
+			webhooks.Stop()
+		}
+		if historyStore != nil {
+			historyStore.Stop()
+		}
 	}()
 	wg.Wait()
 
@@ -3,6 +3,7 @@ module gl.dev.boquar.com/backend/device-status-aggregator
 go 1.14
 
 require (
+	github.com/eclipse/paho.mqtt.golang v1.3.5
 	github.com/gobwas/ws v1.1.0
 	github.com/gofrs/uuid v4.2.0+incompatible
 	github.com/gorilla/mux v1.8.0
@@ -10,4 +11,6 @@ require (
 	github.com/prometheus/client_golang v1.11.0
 	github.com/rs/zerolog v1.26.0
 	github.com/stretchr/testify v1.7.0
+	github.com/xeipuuv/gojsonschema v1.2.0
+	go.etcd.io/bbolt v1.3.6
 )
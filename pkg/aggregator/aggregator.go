@@ -3,6 +3,7 @@ package aggregator
 import (
 	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	uuid "github.com/gofrs/uuid"
@@ -19,22 +20,33 @@ const (
 )
 
 type AggregatorStatusHandler struct {
+	sync.Mutex
 	RespMessageAggregate chan *model.ResponseMessage
 	env                  config.Environment
 	logger               *zerolog.Logger
 	router               *router.RouterHandler
-	token                string
+	creds                model.Credentials
 	CancelF              context.CancelFunc
+	//Stops refresh of members of subscribed groups
+	groupsCancelF context.CancelFunc
+	//Guards seqs and summary, which are updated by forwarding of messages. It is not lock of handler,
+	//so messages are forwarded while subscription is changed under lock of handler
+	forwardMu sync.Mutex
+	//Last sequence number forwarded per device, to resubscribe without duplicates when members of groups change
+	seqs map[uuid.UUID]uint64
+	//Not nil if client gets summaries instead of statuses of devices
+	summary *summary
 }
 
-func NewAggregatorStatusHandler(ctx context.Context, env config.Environment, logger *zerolog.Logger, router *router.RouterHandler, token string) *AggregatorStatusHandler {
+func NewAggregatorStatusHandler(ctx context.Context, env config.Environment, logger *zerolog.Logger, router *router.RouterHandler, creds model.Credentials) *AggregatorStatusHandler {
 
 	aggregatorStatusHandler := AggregatorStatusHandler{
 		RespMessageAggregate: make(chan *model.ResponseMessage, 20),
 		env:                  env,
 		logger:               logger,
 		router:               router,
-		token:                token,
+		creds:                creds,
+		seqs:                 make(map[uuid.UUID]uint64),
 	}
 
 	return &aggregatorStatusHandler
@@ -42,34 +54,274 @@ func NewAggregatorStatusHandler(ctx context.Context, env config.Environment, log
 
 //Will subcribe to new list (ids) devices and unsub from all old
 func (hnd *AggregatorStatusHandler) SubscribeDevices(ctx context.Context, ids []uuid.UUID) {
+	hnd.ResumeDevices(ctx, ids, nil)
+}
 
-	hnd.Stop()
+//Like SubscribeDevices, but messages missed after last seen sequence numbers (seqs) are sent instead of last message
+func (hnd *AggregatorStatusHandler) ResumeDevices(ctx context.Context, ids []uuid.UUID, seqs map[uuid.UUID]uint64) {
+	hnd.Lock()
+	defer hnd.Unlock()
 
-	ch := make(chan *model.ResponseMessage, 20)
+	hnd.stopGroups()
+	hnd.setSummary(nil)
+	hnd.subscribe(ctx, ids, seqs)
+}
 
-	ctx, hnd.CancelF = context.WithCancel(ctx)
+//Like SubscribeDevices, plus members of groups. Members are resolved again every GroupsRefreshPeriod
+//and subscription follows added and removed members
+func (hnd *AggregatorStatusHandler) SubscribeGroups(ctx context.Context, ids []uuid.UUID, groups []string) {
+	hnd.subscribeGroups(ctx, ids, groups, false)
+}
 
-	hnd.router.AddIds(ids, &ch, hnd.token, ctx)
+//Like SubscribeGroups, but statuses of devices are replaced with count of devices by presence
+//for whole subscription and for each group, sent when they are changed
+func (hnd *AggregatorStatusHandler) SubscribeSummary(ctx context.Context, ids []uuid.UUID, groups []string) {
+	hnd.subscribeGroups(ctx, ids, groups, true)
+}
 
-	hnd.logger.Debug().Msg("Subscribe to new devices: " + fmt.Sprint(ids))
+func (hnd *AggregatorStatusHandler) subscribeGroups(ctx context.Context, ids []uuid.UUID, groups []string, summary bool) {
+	hnd.Lock()
+	defer hnd.Unlock()
+
+	hnd.stopGroups()
+
+	members := make(map[string][]uuid.UUID, len(groups))
+	for _, name := range groups {
+		if m, err := hnd.resolveGroup(name, true); err == nil {
+			members[name] = m
+		}
+	}
+	if summary {
+		hnd.setSummary(newSummary(ids, members))
+	} else {
+		hnd.setSummary(nil)
+	}
+	hnd.subscribe(ctx, unionIds(ids, members), nil)
+
+	if len(groups) == 0 {
+		return
+	}
+	var groupsCtx context.Context
+	groupsCtx, hnd.groupsCancelF = context.WithCancel(ctx)
+	go hnd.refreshGroups(ctx, groupsCtx, ids, members)
+}
+
+//Resolve groups periodically and resubscribe if members are changed. Members of group are kept if it fails to resolve
+func (hnd *AggregatorStatusHandler) refreshGroups(ctx context.Context, groupsCtx context.Context, ids []uuid.UUID, members map[string][]uuid.UUID) {
+
+	period := time.Duration(hnd.env.GroupsRefreshPeriod) * time.Second
+	if period <= 0 {
+		return
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-groupsCtx.Done():
+			return
+		}
+
+		changed := false
+		for name, old := range members {
+			m, err := hnd.resolveGroup(name, false)
+			if err != nil || sameIds(old, m) {
+				continue
+			}
+			hnd.logger.Debug().Msgf("Members of group %s changed: %v", name, m)
+			members[name] = m
+			changed = true
+		}
+		if !changed {
+			continue
+		}
+
+		hnd.Lock()
+		//Client could change subscription while groups were resolved
+		if groupsCtx.Err() == nil {
+			//Old subscription is stopped first, so nothing is forwarded after its sequence numbers are copied
+			hnd.CancelF()
+			hnd.forwardMu.Lock()
+			if hnd.summary != nil {
+				hnd.summary.setMembers(ids, members)
+			}
+			hnd.forwardMu.Unlock()
+			hnd.subscribe(ctx, unionIds(ids, members), hnd.lastSeqs())
+		}
+		hnd.Unlock()
+	}
+}
+
+//Return members of group. Errors are sent to client only if report is true, outdated token closes connection anyway
+func (hnd *AggregatorStatusHandler) resolveGroup(name string, report bool) ([]uuid.UUID, error) {
+
+	members, err := hnd.router.ResolveGroup(name, hnd.creds)
+	if err == nil {
+		return members, nil
+	}
+
+	hnd.logger.Err(err).Msgf("Failed to resolve group: %s ", name)
+	e := model.AsError(err)
+	switch {
+	case e.Code == model.ErrorCodeTokenOutdated:
+		hnd.RespMessageAggregate <- model.NewCloseResponseMessage(e)
+	case report:
+		hnd.RespMessageAggregate <- model.NewGroupErrorResponseMessage(e, name)
+	}
+	return nil, err
+}
+
+//Needed to Lock before. Unsubscribe from old devices and subscribe to ids
+func (hnd *AggregatorStatusHandler) subscribe(ctx context.Context, ids []uuid.UUID, seqs map[uuid.UUID]uint64) {
+
+	if hnd.CancelF != nil {
+		hnd.CancelF()
+	}
 
+	ch := make(chan *model.ResponseMessage, 20)
+
+	ctx, hnd.CancelF = context.WithCancel(ctx)
+
+	//Messages are read before devices are added, routes must not wait for subscription of all devices
 	go func() {
 
+		hnd.sendSummary(ctx, ch)
 	cicle:
 		for {
 			select {
 			case msg := <-ch:
-				hnd.RespMessageAggregate <- msg
+				hnd.forwardMu.Lock()
+				counted := hnd.summary != nil && hnd.summary.update(msg)
+				hnd.forwardMu.Unlock()
+				if !counted {
+					select {
+					case hnd.RespMessageAggregate <- msg:
+					case <-ctx.Done():
+						break cicle
+					}
+				}
+				if msg.Seq > 0 {
+					hnd.forwardMu.Lock()
+					//Message of cancelled subscription must not record seq of device which is not subscribed anymore
+					if ctx.Err() == nil {
+						hnd.seqs[uuid.FromStringOrNil(msg.Id)] = msg.Seq
+					}
+					hnd.forwardMu.Unlock()
+				}
+				hnd.sendSummary(ctx, ch)
 			case <-ctx.Done():
 				break cicle
 			}
 		}
 	}()
+
+	//Devices removed from subscription are forgotten, so re-added device does not resume from stale seq
+	subscribed := make(map[uuid.UUID]bool, len(ids))
+	for _, id := range ids {
+		subscribed[id] = true
+	}
+	hnd.forwardMu.Lock()
+	for id := range hnd.seqs {
+		if !subscribed[id] {
+			delete(hnd.seqs, id)
+		}
+	}
+	hnd.forwardMu.Unlock()
+
+	hnd.router.ResumeIds(ids, seqs, &ch, hnd.creds, ctx)
+
+	hnd.logger.Debug().Msg("Subscribe to new devices: " + fmt.Sprint(ids))
+}
+
+func (hnd *AggregatorStatusHandler) setSummary(s *summary) {
+	hnd.forwardMu.Lock()
+	defer hnd.forwardMu.Unlock()
+	hnd.summary = s
+}
+
+//Return copy of last sequence numbers forwarded per device
+func (hnd *AggregatorStatusHandler) lastSeqs() map[uuid.UUID]uint64 {
+	hnd.forwardMu.Lock()
+	defer hnd.forwardMu.Unlock()
+
+	seqs := make(map[uuid.UUID]uint64, len(hnd.seqs))
+	for id, seq := range hnd.seqs {
+		seqs[id] = seq
+	}
+	return seqs
+}
+
+//Send changed summaries when all received messages are counted, so burst of statuses gives one summary
+func (hnd *AggregatorStatusHandler) sendSummary(ctx context.Context, ch chan *model.ResponseMessage) {
+	if len(ch) > 0 {
+		return
+	}
+	hnd.forwardMu.Lock()
+	var msgs []*model.ResponseMessage
+	if hnd.summary != nil {
+		msgs = hnd.summary.changed()
+	}
+	hnd.forwardMu.Unlock()
+	for _, msg := range msgs {
+		select {
+		case hnd.RespMessageAggregate <- msg:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+//Needed to Lock before
+func (hnd *AggregatorStatusHandler) stopGroups() {
+	if hnd.groupsCancelF != nil {
+		hnd.groupsCancelF()
+		hnd.groupsCancelF = nil
+	}
 }
 
 //Make unsub from all devices. (stop goroutine)
 func (hnd *AggregatorStatusHandler) Stop() {
+	hnd.Lock()
+	defer hnd.Unlock()
+
+	hnd.stopGroups()
 	if hnd.CancelF != nil {
 		hnd.CancelF()
 	}
 }
+
+//Return ids and members of all groups without duplicates
+func unionIds(ids []uuid.UUID, members map[string][]uuid.UUID) []uuid.UUID {
+	seen := make(map[uuid.UUID]bool)
+	var r []uuid.UUID
+	add := func(list []uuid.UUID) {
+		for _, id := range list {
+			if !seen[id] {
+				seen[id] = true
+				r = append(r, id)
+			}
+		}
+	}
+	add(ids)
+	for _, m := range members {
+		add(m)
+	}
+	return r
+}
+
+func sameIds(a, b []uuid.UUID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := make(map[uuid.UUID]bool, len(a))
+	for _, id := range a {
+		set[id] = true
+	}
+	for _, id := range b {
+		if !set[id] {
+			return false
+		}
+	}
+	return true
+}
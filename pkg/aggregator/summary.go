@@ -0,0 +1,101 @@
+package aggregator
+
+import (
+	uuid "github.com/gofrs/uuid"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/model"
+)
+
+//Presence of subscribed devices, counted for whole subscription and for each group.
+//Device denied by right verifier is not counted
+type summary struct {
+	presence map[uuid.UUID]model.Presence
+	groups   map[string][]uuid.UUID
+	//Last sent summary per group, "" is whole subscription
+	last map[string]model.PresenceSummary
+}
+
+func newSummary(ids []uuid.UUID, members map[string][]uuid.UUID) *summary {
+	s := &summary{
+		presence: make(map[uuid.UUID]model.Presence),
+		last:     make(map[string]model.PresenceSummary),
+	}
+	s.setMembers(ids, members)
+	return s
+}
+
+//Keep presence of devices which are still subscribed, new devices are unknown
+func (s *summary) setMembers(ids []uuid.UUID, members map[string][]uuid.UUID) {
+	presence := make(map[uuid.UUID]model.Presence)
+	for _, id := range unionIds(ids, members) {
+		if p, ok := s.presence[id]; ok {
+			presence[id] = p
+		} else {
+			presence[id] = model.PresenceUnknown
+		}
+	}
+	s.presence = presence
+
+	s.groups = make(map[string][]uuid.UUID, len(members))
+	for name, m := range members {
+		s.groups[name] = append([]uuid.UUID{}, m...)
+	}
+}
+
+//Update presence of device. Return false if msg must be still sent to client
+func (s *summary) update(msg *model.ResponseMessage) bool {
+	id := uuid.FromStringOrNil(msg.Id)
+	if _, ok := s.presence[id]; !ok {
+		return false
+	}
+	if p, ok := msg.Presence(); ok {
+		s.presence[id] = p
+		return true
+	}
+	if msg.TypeRes == "sub-nack" {
+		if msg.Seq == 0 {
+			//Access denied, device is not subscribed
+			delete(s.presence, id)
+		} else {
+			s.presence[id] = model.PresenceUnknown
+		}
+	}
+	return false
+}
+
+//Return summaries changed since last call
+func (s *summary) changed() []*model.ResponseMessage {
+	var r []*model.ResponseMessage
+	emit := func(group string, ids []uuid.UUID) {
+		var sum model.PresenceSummary
+		for _, id := range ids {
+			p, ok := s.presence[id]
+			if !ok {
+				continue
+			}
+			sum.Total++
+			switch p {
+			case model.PresenceOnline:
+				sum.Online++
+			case model.PresenceOffline:
+				sum.Offline++
+			default:
+				sum.Unknown++
+			}
+		}
+		if last, ok := s.last[group]; ok && last == sum {
+			return
+		}
+		s.last[group] = sum
+		r = append(r, model.NewSummaryResponseMessage(group, sum))
+	}
+
+	all := make([]uuid.UUID, 0, len(s.presence))
+	for id := range s.presence {
+		all = append(all, id)
+	}
+	emit("", all)
+	for name, m := range s.groups {
+		emit(name, m)
+	}
+	return r
+}
@@ -0,0 +1,354 @@
+package alerts
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	uuid "github.com/gofrs/uuid"
+	"github.com/rs/zerolog"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/config"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/model"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/router"
+)
+
+//Notifier delivers alert to subscribers of device
+type Notifier interface {
+	Notify(id uuid.UUID, msg *model.ResponseMessage)
+}
+
+//Sink gets all alerts, it must not block
+type Sink interface {
+	OnAlert(id uuid.UUID, alert model.Alert)
+}
+
+//Engine evaluates rules on every status routed to subscribers. Alert fires when condition of rule
+//is true for hold time and resolves when condition is false. Rules file is reloaded when it is changed.
+//Devices listed by rules are watched, so they are evaluated without subscribed clients
+type Engine struct {
+	sync.Mutex
+	file         string
+	modTime      time.Time
+	reloadPeriod time.Duration
+	rules        []*rule
+	devices      map[uuid.UUID]*device
+	notifier     Notifier
+	watcher      *router.Watcher
+	sinks        []Sink
+	logger       zerolog.Logger
+	cancelF      context.CancelFunc
+}
+
+type device struct {
+	//Last known extendedStatus, kept while status is stale
+	extended interface{}
+	alerts   map[string]*alert
+}
+
+type alert struct {
+	rule  *rule
+	since time.Time
+	//Not nil while condition holds shorter than hold time of rule
+	timer  *time.Timer
+	firing bool
+}
+
+//Alerts are sent to subscribers via r, devices of rules are watched via r with service identity
+func NewEngine(env config.Environment, logger *zerolog.Logger, r *router.RouterHandler) (*Engine, error) {
+
+	l := logger.With().Str("COMPONENT", "alerts").Logger()
+	e := &Engine{
+		file:         env.AlertRulesFile,
+		reloadPeriod: time.Duration(env.AlertRulesReloadPeriod) * time.Second,
+		devices:      make(map[uuid.UUID]*device),
+		notifier:     r,
+		watcher:      router.NewWatcher(r, model.Credentials{Identity: env.ServiceIdentity}, &l),
+		logger:       l,
+	}
+	st, err := os.Stat(e.file)
+	if err != nil {
+		return nil, err
+	}
+	if e.rules, err = loadRules(e.file); err != nil {
+		return nil, err
+	}
+	e.modTime = st.ModTime()
+	return e, nil
+}
+
+//Must be called before Run
+func (e *Engine) AddSink(s Sink) {
+	e.sinks = append(e.sinks, s)
+}
+
+//Check rules file for changes until ctx is done
+func (e *Engine) Run(ctx context.Context) {
+	ctx, e.cancelF = context.WithCancel(ctx)
+	e.Lock()
+	e.watch()
+	e.Unlock()
+	if e.reloadPeriod <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(e.reloadPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				e.reload()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (e *Engine) Stop() {
+	if e.cancelF != nil {
+		e.cancelF()
+	}
+	e.watcher.Stop()
+	e.Lock()
+	defer e.Unlock()
+	for _, d := range e.devices {
+		for _, a := range d.alerts {
+			if a.timer != nil {
+				a.timer.Stop()
+			}
+		}
+	}
+}
+
+//Load rules if file is changed. Alerts of removed and changed rules are resolved,
+//broken file is logged and previous rules are kept
+func (e *Engine) reload() {
+	st, err := os.Stat(e.file)
+	if err != nil {
+		e.logger.Err(err).Msg("failed to check alert rules")
+		return
+	}
+	if st.ModTime().Equal(e.modTime) {
+		return
+	}
+	rules, err := loadRules(e.file)
+	if err != nil {
+		e.logger.Err(err).Msg("failed to reload alert rules, previous rules are kept")
+		return
+	}
+
+	e.Lock()
+	e.modTime = st.ModTime()
+	e.rules = rules
+	e.watch()
+	kept := make(map[string]*rule, len(rules))
+	for _, r := range rules {
+		kept[r.Name] = r
+	}
+
+	var resolved []*model.ResponseMessage
+	now := time.Now()
+	for id, d := range e.devices {
+		for name, a := range d.alerts {
+			if r, ok := kept[name]; ok && r.same(a.rule) {
+				a.rule = r
+				continue
+			}
+			if msg := e.clear(id, d, a, now); msg != nil {
+				resolved = append(resolved, msg)
+			}
+		}
+	}
+	e.Unlock()
+
+	e.logger.Info().Msgf("Alert rules reloaded, %d rules", len(rules))
+	e.emit(resolved)
+}
+
+//Evaluate rules on status of device
+func (e *Engine) OnMessage(id uuid.UUID, msg *model.ResponseMessage) {
+	if _, ok := msg.Presence(); !ok {
+		return
+	}
+
+	e.Lock()
+	d := e.devices[id]
+	if d == nil {
+		d = &device{alerts: make(map[string]*alert)}
+		e.devices[id] = d
+	}
+	if msg.ExtendedStatus != nil {
+		var extended interface{}
+		if err := json.Unmarshal(*msg.ExtendedStatus, &extended); err != nil {
+			e.logger.Err(err).Msgf("failed to decode extendedStatus for id: %s", id.String())
+		} else {
+			d.extended = extended
+		}
+	}
+	v := &statusVars{msg: msg, extended: d.extended}
+
+	var out []*model.ResponseMessage
+	now := time.Now()
+	for _, r := range e.rules {
+		if !r.match(id) {
+			continue
+		}
+		a := d.alerts[r.Name]
+		if !r.expr.match(v) {
+			if a != nil {
+				if msg := e.clear(id, d, a, now); msg != nil {
+					out = append(out, msg)
+				}
+			}
+			continue
+		}
+		if a != nil {
+			continue
+		}
+		a = &alert{rule: r, since: now}
+		d.alerts[r.Name] = a
+		if r.expr.hold <= 0 {
+			out = append(out, e.fire(id, a, now))
+			continue
+		}
+		a.timer = time.AfterFunc(r.expr.hold, func() { e.expire(id, a) })
+	}
+	e.Unlock()
+
+	e.emit(out)
+}
+
+//Device is not observed anymore, its firing alerts are resolved before device is forgotten
+func (e *Engine) OnRouteStopped(id uuid.UUID) {
+	e.Lock()
+	d := e.devices[id]
+	if d == nil {
+		e.Unlock()
+		return
+	}
+	var resolved []*model.ResponseMessage
+	now := time.Now()
+	for _, a := range d.alerts {
+		if msg := e.clear(id, d, a, now); msg != nil {
+			resolved = append(resolved, msg)
+		}
+	}
+	delete(e.devices, id)
+	e.Unlock()
+
+	e.emit(resolved)
+}
+
+//Needed to Lock before. Watch devices listed by rules, rules of all devices are evaluated only for subscribed devices
+func (e *Engine) watch() {
+	var ids []uuid.UUID
+	for _, r := range e.rules {
+		for id := range r.ids {
+			ids = append(ids, id)
+		}
+	}
+	e.watcher.Set(ids)
+}
+
+//Condition held for hold time of rule
+func (e *Engine) expire(id uuid.UUID, a *alert) {
+	e.Lock()
+	d := e.devices[id]
+	if d == nil || d.alerts[a.rule.Name] != a || a.firing {
+		e.Unlock()
+		return
+	}
+	a.timer = nil
+	msg := e.fire(id, a, time.Now())
+	e.Unlock()
+
+	e.emit([]*model.ResponseMessage{msg})
+}
+
+//Needed to Lock before
+func (e *Engine) fire(id uuid.UUID, a *alert, now time.Time) *model.ResponseMessage {
+	a.firing = true
+	return model.NewAlertResponseMessage(id, newAlert(a, model.AlertFiring, now))
+}
+
+//Needed to Lock before. Forget alert, return resolved alert if it was firing
+func (e *Engine) clear(id uuid.UUID, d *device, a *alert, now time.Time) *model.ResponseMessage {
+	delete(d.alerts, a.rule.Name)
+	if a.timer != nil {
+		a.timer.Stop()
+	}
+	if !a.firing {
+		return nil
+	}
+	return model.NewAlertResponseMessage(id, newAlert(a, model.AlertResolved, now))
+}
+
+func newAlert(a *alert, state model.AlertState, now time.Time) model.Alert {
+	return model.Alert{
+		Rule:     a.rule.Name,
+		State:    state,
+		Severity: a.rule.Severity,
+		Expr:     a.rule.Expr,
+		Since:    a.since.UTC(),
+		At:       now.UTC(),
+	}
+}
+
+//Send alerts to log, subscribers of device and sinks
+func (e *Engine) emit(msgs []*model.ResponseMessage) {
+	for _, msg := range msgs {
+		id := uuid.FromStringOrNil(msg.Id)
+		e.logger.Warn().Msgf("Alert %s is %s for id: %s", msg.Alert.Rule, msg.Alert.State, msg.Id)
+		alertsTotal.WithLabelValues(msg.Alert.Rule, string(msg.Alert.State)).Inc()
+		e.notifier.Notify(id, msg)
+		for _, s := range e.sinks {
+			s.OnAlert(id, *msg.Alert)
+		}
+	}
+}
+
+//Variables of status: online, stale, presence, id and fields of extendedStatus,
+//optionally prefixed with extendedStatus
+type statusVars struct {
+	msg      *model.ResponseMessage
+	extended interface{}
+}
+
+func (v *statusVars) lookup(path []string) interface{} {
+	switch path[0] {
+	case "online":
+		if len(path) == 1 {
+			if v.msg.Online == nil {
+				return nil
+			}
+			return *v.msg.Online
+		}
+	case "stale":
+		if len(path) == 1 {
+			return v.msg.IsStale()
+		}
+	case "presence":
+		if len(path) == 1 {
+			p, _ := v.msg.Presence()
+			return string(p)
+		}
+	case "id":
+		if len(path) == 1 {
+			return v.msg.Id
+		}
+	case "extendedStatus":
+		path = path[1:]
+	}
+
+	cur := v.extended
+	for _, key := range path {
+		obj, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		cur = obj[key]
+	}
+	return cur
+}
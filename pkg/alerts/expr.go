@@ -0,0 +1,372 @@
+package alerts
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+//Expression of rule, e.g. `battery.level < 15 && online`, `online == false for 5m`.
+//Operands are paths of variables, numbers, strings in quotes, true, false and null.
+//Missing variable is null, ordering comparisons with null are false
+type expr struct {
+	cond node
+	//Condition must be true during this time to fire
+	hold time.Duration
+}
+
+//Variables of evaluated status, path is split by dots
+type vars interface {
+	lookup(path []string) interface{}
+}
+
+type node interface {
+	eval(v vars) interface{}
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenNumber
+	tokenDuration
+	tokenString
+	tokenOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+func parseExpr(s string) (*expr, error) {
+	tokens, err := tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	cond, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	e := &expr{cond: cond}
+	if t := p.peek(); t.kind == tokenIdent && t.text == "for" {
+		p.next()
+		t = p.next()
+		if t.kind != tokenDuration && t.kind != tokenNumber {
+			return nil, fmt.Errorf("expected duration after for, got %q", t.text)
+		}
+		if e.hold, err = time.ParseDuration(t.text); err != nil {
+			return nil, err
+		}
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %q", t.text)
+	}
+	return e, nil
+}
+
+//Return true only if condition is evaluated to true
+func (e *expr) match(v vars) bool {
+	b, ok := e.cond.eval(v).(bool)
+	return ok && b
+}
+
+func tokenize(s string) ([]token, error) {
+	var tokens []token
+	r := []rune(s)
+	for i := 0; i < len(r); {
+		c := r[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(r) && (unicode.IsLetter(r[j]) || unicode.IsDigit(r[j]) || r[j] == '_' || r[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, token{tokenIdent, string(r[i:j])})
+			i = j
+		case unicode.IsDigit(c) || (c == '-' && i+1 < len(r) && unicode.IsDigit(r[i+1])):
+			//Number, or duration like 1h30m
+			j := i + 1
+			for j < len(r) && (unicode.IsLetter(r[j]) || unicode.IsDigit(r[j]) || r[j] == '.') {
+				j++
+			}
+			text := string(r[i:j])
+			kind := tokenNumber
+			if _, err := strconv.ParseFloat(text, 64); err != nil {
+				kind = tokenDuration
+			}
+			tokens = append(tokens, token{kind, text})
+			i = j
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(r) && r[j] != c {
+				j++
+			}
+			if j == len(r) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			tokens = append(tokens, token{tokenString, string(r[i+1 : j])})
+			i = j + 1
+		default:
+			op := ""
+			for _, o := range []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")"} {
+				if strings.HasPrefix(string(r[i:]), o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q at %d", c, i)
+			}
+			tokens = append(tokens, token{tokenOp, op})
+			i += len(op)
+		}
+	}
+	return tokens, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return token{kind: tokenEOF}
+}
+
+func (p *parser) next() token {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *parser) isOp(ops ...string) (string, bool) {
+	t := p.peek()
+	if t.kind != tokenOp {
+		return "", false
+	}
+	for _, o := range ops {
+		if t.text == o {
+			return o, true
+		}
+	}
+	return "", false
+}
+
+func (p *parser) or() (node, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.isOp("||"); !ok {
+			return left, nil
+		}
+		p.next()
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = &logical{or: true, left: left, right: right}
+	}
+}
+
+func (p *parser) and() (node, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.isOp("&&"); !ok {
+			return left, nil
+		}
+		p.next()
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = &logical{left: left, right: right}
+	}
+}
+
+func (p *parser) unary() (node, error) {
+	if _, ok := p.isOp("!"); ok {
+		p.next()
+		n, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &not{n}, nil
+	}
+	if _, ok := p.isOp("("); ok {
+		p.next()
+		n, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := p.isOp(")"); !ok {
+			return nil, fmt.Errorf("expected )")
+		}
+		p.next()
+		return n, nil
+	}
+	return p.comparison()
+}
+
+func (p *parser) comparison() (node, error) {
+	left, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := p.isOp("==", "!=", "<=", ">=", "<", ">")
+	if !ok {
+		return left, nil
+	}
+	p.next()
+	right, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	return &compare{op: op, left: left, right: right}, nil
+}
+
+func (p *parser) operand() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenNumber:
+		f, _ := strconv.ParseFloat(t.text, 64)
+		return literal{f}, nil
+	case tokenString:
+		return literal{t.text}, nil
+	case tokenIdent:
+		switch t.text {
+		case "true":
+			return literal{true}, nil
+		case "false":
+			return literal{false}, nil
+		case "null":
+			return literal{nil}, nil
+		case "for":
+			return nil, fmt.Errorf("expected operand, got for")
+		}
+		return variable(strings.Split(t.text, ".")), nil
+	case tokenEOF:
+		return nil, fmt.Errorf("unexpected end of expression")
+	default:
+		return nil, fmt.Errorf("expected operand, got %q", t.text)
+	}
+}
+
+type literal struct {
+	v interface{}
+}
+
+func (l literal) eval(v vars) interface{} {
+	return l.v
+}
+
+type variable []string
+
+func (n variable) eval(v vars) interface{} {
+	return v.lookup(n)
+}
+
+type not struct {
+	n node
+}
+
+func (n *not) eval(v vars) interface{} {
+	b, ok := n.n.eval(v).(bool)
+	return ok && !b
+}
+
+type logical struct {
+	or          bool
+	left, right node
+}
+
+func (n *logical) eval(v vars) interface{} {
+	l, _ := n.left.eval(v).(bool)
+	if n.or && l {
+		return true
+	}
+	if !n.or && !l {
+		return false
+	}
+	r, _ := n.right.eval(v).(bool)
+	return r
+}
+
+type compare struct {
+	op          string
+	left, right node
+}
+
+func (n *compare) eval(v vars) interface{} {
+	l, r := n.left.eval(v), n.right.eval(v)
+
+	switch n.op {
+	case "==":
+		return equal(l, r)
+	case "!=":
+		return !equal(l, r)
+	}
+
+	switch lv := l.(type) {
+	case float64:
+		rv, ok := r.(float64)
+		if !ok {
+			return false
+		}
+		switch n.op {
+		case "<":
+			return lv < rv
+		case "<=":
+			return lv <= rv
+		case ">":
+			return lv > rv
+		default:
+			return lv >= rv
+		}
+	case string:
+		rv, ok := r.(string)
+		if !ok {
+			return false
+		}
+		switch n.op {
+		case "<":
+			return lv < rv
+		case "<=":
+			return lv <= rv
+		case ">":
+			return lv > rv
+		default:
+			return lv >= rv
+		}
+	}
+	return false
+}
+
+//Objects and arrays are not equal to anything
+func equal(l, r interface{}) bool {
+	switch l.(type) {
+	case nil, bool, float64, string:
+	default:
+		return false
+	}
+	switch r.(type) {
+	case nil, bool, float64, string:
+		return l == r
+	default:
+		return false
+	}
+}
@@ -0,0 +1,18 @@
+package alerts
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	metricsNamespace = "device_status_aggregator"
+	metricsSubsystem = "alerts"
+)
+
+var alertsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Subsystem: metricsSubsystem,
+	Name:      "total",
+	Help:      "Alerts by rule and state: firing or resolved",
+}, []string{"rule", "state"})
@@ -0,0 +1,83 @@
+package alerts
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	uuid "github.com/gofrs/uuid"
+)
+
+//Rules is content of alert rules file
+type Rules struct {
+	Rules []Rule `json:"rules"`
+}
+
+//Rule fires alert when expression is true for status of device
+type Rule struct {
+	Name string `json:"name"`
+	//Expression like `battery.level < 15` or `online == false for 5m`.
+	//Variables are online, stale, presence and fields of extendedStatus
+	Expr     string `json:"expr"`
+	Severity string `json:"severity"`
+	//Devices of rule, all devices if empty
+	Ids []uuid.UUID `json:"ids"`
+}
+
+type rule struct {
+	Rule
+	expr *expr
+	ids  map[uuid.UUID]bool
+}
+
+func loadRules(file string) ([]*rule, error) {
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read alert rules: %w", err)
+	}
+	var rules Rules
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse alert rules: %w", err)
+	}
+
+	names := make(map[string]bool, len(rules.Rules))
+	r := make([]*rule, 0, len(rules.Rules))
+	for i, a := range rules.Rules {
+		if a.Name == "" {
+			a.Name = fmt.Sprintf("alert-%d", i)
+		}
+		if names[a.Name] {
+			return nil, fmt.Errorf("alert %s is defined twice", a.Name)
+		}
+		names[a.Name] = true
+
+		e, err := parseExpr(a.Expr)
+		if err != nil {
+			return nil, fmt.Errorf("alert %s: wrong expression %q: %w", a.Name, a.Expr, err)
+		}
+		parsed := &rule{Rule: a, expr: e, ids: make(map[uuid.UUID]bool, len(a.Ids))}
+		for _, id := range a.Ids {
+			parsed.ids[id] = true
+		}
+		r = append(r, parsed)
+	}
+	return r, nil
+}
+
+func (r *rule) match(id uuid.UUID) bool {
+	return len(r.ids) == 0 || r.ids[id]
+}
+
+//Rule is changed if it can fire on other statuses
+func (r *rule) same(o *rule) bool {
+	if r.Expr != o.Expr || r.Severity != o.Severity || len(r.ids) != len(o.ids) {
+		return false
+	}
+	for id := range r.ids {
+		if !o.ids[id] {
+			return false
+		}
+	}
+	return true
+}
@@ -11,10 +11,13 @@ import (
 	"github.com/rs/zerolog/log"
 	hnd "gl.dev.boquar.com/backend/device-status-aggregator/pkg/api/ws/handler"
 	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/config"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/history"
 	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/router"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/stats"
 )
 
-func NewServer(router *router.RouterHandler, env config.Environment) (*http.Server, error) {
+//history and stats are nil if they are disabled
+func NewServer(router *router.RouterHandler, history *history.Store, stats *stats.Tracker, env config.Environment) (*http.Server, error) {
 
 	m := mux.NewRouter()
 	m.Use(middlewareLogging, middlewareRecover)
@@ -33,14 +36,36 @@ func NewServer(router *router.RouterHandler, env config.Environment) (*http.Serv
 
 	m.Path("/ws/devices/status").
 		Methods("GET").
-		Handler(hnd.NewDeviceStatusHandler(router, env))
+		Handler(hnd.NewDeviceStatusHandler(router, history, stats, env))
+
+	m.Path("/api/devices/{id}/history").
+		Methods("GET").
+		Handler(hnd.NewDeviceHistoryHandler(router, history))
+
+	m.Path("/api/devices/{id}/stats").
+		Methods("GET").
+		Handler(hnd.NewDeviceStatsHandler(router, stats))
+
+	tlsConfig, err := config.NewServerTLSConfig(env)
+	if err != nil {
+		return nil, err
+	}
 
 	return &http.Server{
-		Addr:    fmt.Sprintf("%s:%d", "", env.WebSocketPort),
-		Handler: m,
+		Addr:      fmt.Sprintf("%s:%d", "", env.WebSocketPort),
+		Handler:   m,
+		TLSConfig: tlsConfig,
 	}, nil
 }
 
+//Serve with TLS if it is configured for server
+func ListenAndServe(server *http.Server) error {
+	if server.TLSConfig != nil {
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
+
 func middlewareRecover(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
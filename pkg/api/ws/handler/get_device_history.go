@@ -0,0 +1,154 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	uuid "github.com/gofrs/uuid"
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/history"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/model"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/router"
+)
+
+const (
+	requestTypeHistory   = "history"
+	defaultHistoryPeriod = 24 * time.Hour
+)
+
+//HTTP status of history-nack and stats-nack
+var queryStatuses = map[model.ErrorCode]int{
+	model.ErrorCodeNotFound:           http.StatusNotFound,
+	model.ErrorCodeForbidden:          http.StatusForbidden,
+	model.ErrorCodeDeviceDeleted:      http.StatusGone,
+	model.ErrorCodeUpstreamOverloaded: http.StatusServiceUnavailable,
+	model.ErrorCodeUnavailable:        http.StatusServiceUnavailable,
+	model.ErrorCodeUnauthorized:       http.StatusUnauthorized,
+	model.ErrorCodeTokenOutdated:      http.StatusUnauthorized,
+}
+
+//DeviceHistoryHandler serves GET /api/devices/{id}/history?from=&to=.
+//from and to are RFC3339 or unix seconds, last day if empty. Truncated history is continued with from=historyNext
+type DeviceHistoryHandler struct {
+	router  *router.RouterHandler
+	history *history.Store
+}
+
+func NewDeviceHistoryHandler(router *router.RouterHandler, history *history.Store) *DeviceHistoryHandler {
+	return &DeviceHistoryHandler{
+		router:  router,
+		history: history,
+	}
+}
+
+func (hnd *DeviceHistoryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	logger := zerolog.Ctx(r.Context())
+
+	id, err := uuid.FromString(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "wrong device id", http.StatusBadRequest)
+		return
+	}
+
+	var from, to *time.Time
+	for _, p := range []struct {
+		name string
+		dst  **time.Time
+	}{{"from", &from}, {"to", &to}} {
+		s := r.URL.Query().Get(p.name)
+		if s == "" {
+			continue
+		}
+		t, err := parseHistoryTime(s)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("wrong %s: %s", p.name, err), http.StatusBadRequest)
+			return
+		}
+		*p.dst = &t
+	}
+
+	msg := queryHistory(hnd.router, hnd.history, id, credentialsFromRequest(r, logger), from, to, logger)
+	writeQueryResponse(w, msg, logger)
+}
+
+func parseHistoryTime(s string) (time.Time, error) {
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+//Check access of client to data of device
+func authorizeQuery(router *router.RouterHandler, id uuid.UUID, creds model.Credentials, logger *zerolog.Logger) *model.Error {
+	if creds.Empty() {
+		return model.NewError(model.ErrorCodeUnauthorized, fmt.Errorf("no token"))
+	}
+	if err := router.Authorize(id, creds); err != nil {
+		logger.Err(err).Msgf("Access check failed: %s ", id.String())
+		return model.AsError(err)
+	}
+	return nil
+}
+
+//Write msg as JSON with HTTP status of its error
+func writeQueryResponse(w http.ResponseWriter, msg *model.ResponseMessage, logger *zerolog.Logger) {
+
+	status := http.StatusOK
+	if msg.ErrorResp != nil {
+		status = http.StatusInternalServerError
+		if s, ok := queryStatuses[model.ErrorCode(msg.ErrorResp.TypeRes)]; ok {
+			status = s
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(msg); err != nil {
+		logger.Err(err).Msg("failed to encode json")
+	}
+}
+
+//Send history of each device of request to client
+func (hnd *DeviceStatusWorker) sendHistory(ctx context.Context, req *model.RequestMessage) {
+	for _, id := range req.Ids {
+		msg := queryHistory(hnd.router, hnd.history, id, hnd.creds, req.From, req.To, hnd.logger)
+		select {
+		case hnd.aggregator.RespMessageAggregate <- msg:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+//Return history or history-nack if client has no access or history is disabled
+func queryHistory(router *router.RouterHandler, store *history.Store, id uuid.UUID, creds model.Credentials, from, to *time.Time, logger *zerolog.Logger) *model.ResponseMessage {
+
+	if store == nil {
+		return model.NewHistoryErrorResponseMessage(model.NewError(model.ErrorCodeNotFound, fmt.Errorf("history is disabled")), id)
+	}
+	if err := authorizeQuery(router, id, creds, logger); err != nil {
+		return model.NewHistoryErrorResponseMessage(err, id)
+	}
+
+	end := time.Now()
+	if to != nil {
+		end = *to
+	}
+	start := end.Add(-defaultHistoryPeriod)
+	if from != nil {
+		start = *from
+	}
+
+	entries, next, err := store.Query(id, start, end)
+	if err != nil {
+		logger.Err(err).Msgf("failed to query history: %s ", id.String())
+		return model.NewHistoryErrorResponseMessage(model.NewError(model.ErrorCodeGeneric, fmt.Errorf("history is unavailable")), id)
+	}
+	return model.NewHistoryResponseMessage(id, entries, next)
+}
@@ -0,0 +1,72 @@
+package ws
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	uuid "github.com/gofrs/uuid"
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/model"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/router"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/stats"
+)
+
+const requestTypeStats = "stats"
+
+//DeviceStatsHandler serves GET /api/devices/{id}/stats
+type DeviceStatsHandler struct {
+	router *router.RouterHandler
+	stats  *stats.Tracker
+}
+
+func NewDeviceStatsHandler(router *router.RouterHandler, stats *stats.Tracker) *DeviceStatsHandler {
+	return &DeviceStatsHandler{
+		router: router,
+		stats:  stats,
+	}
+}
+
+func (hnd *DeviceStatsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	logger := zerolog.Ctx(r.Context())
+
+	id, err := uuid.FromString(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "wrong device id", http.StatusBadRequest)
+		return
+	}
+
+	msg := queryStats(hnd.router, hnd.stats, id, credentialsFromRequest(r, logger), logger)
+	writeQueryResponse(w, msg, logger)
+}
+
+//Send stats of each device of request to client
+func (hnd *DeviceStatusWorker) sendStats(ctx context.Context, req *model.RequestMessage) {
+	for _, id := range req.Ids {
+		msg := queryStats(hnd.router, hnd.stats, id, hnd.creds, hnd.logger)
+		select {
+		case hnd.aggregator.RespMessageAggregate <- msg:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+//Return stats or stats-nack if client has no access or stats are disabled
+func queryStats(router *router.RouterHandler, tracker *stats.Tracker, id uuid.UUID, creds model.Credentials, logger *zerolog.Logger) *model.ResponseMessage {
+
+	if tracker == nil {
+		return model.NewStatsErrorResponseMessage(model.NewError(model.ErrorCodeNotFound, fmt.Errorf("stats are disabled")), id)
+	}
+	if err := authorizeQuery(router, id, creds, logger); err != nil {
+		return model.NewStatsErrorResponseMessage(err, id)
+	}
+	windows, err := tracker.Stats(id)
+	if err != nil {
+		logger.Err(err).Msgf("failed to compute stats: %s ", id.String())
+		return model.NewStatsErrorResponseMessage(model.NewError(model.ErrorCodeGeneric, fmt.Errorf("stats are unavailable")), id)
+	}
+	return model.NewStatsResponseMessage(id, windows)
+}
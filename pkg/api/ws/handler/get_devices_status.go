@@ -2,22 +2,31 @@ package ws
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 
 	gws "github.com/gobwas/ws"
 	"github.com/gobwas/ws/wsutil"
+	uuid "github.com/gofrs/uuid"
 	"github.com/rs/zerolog"
 	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/aggregator"
 	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/config"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/history"
 	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/model"
 	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/router"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/stats"
 )
 
 const (
+	requestTypeResume  = "resume"
+	requestTypeSummary = "summary"
+
 	readDeadline           = 30 * time.Second
 	writeDeadline          = 15 * time.Second
 	pingPeriod             = (readDeadline * 9) / 10
@@ -28,14 +37,19 @@ const (
 var codes = map[string]int{"200": 1000, "401": 4001, "403": 4003, "404": 4004, "500": 1011}
 
 type DeviceStatusHandler struct {
-	env    config.Environment
-	router *router.RouterHandler
+	env     config.Environment
+	router  *router.RouterHandler
+	history *history.Store
+	stats   *stats.Tracker
 }
 
-func NewDeviceStatusHandler(router *router.RouterHandler, env config.Environment) *DeviceStatusHandler {
+//history and stats are nil if they are disabled
+func NewDeviceStatusHandler(router *router.RouterHandler, history *history.Store, stats *stats.Tracker, env config.Environment) *DeviceStatusHandler {
 	return &DeviceStatusHandler{
-		env:    env,
-		router: router,
+		env:     env,
+		router:  router,
+		history: history,
+		stats:   stats,
 	}
 }
 
@@ -45,22 +59,74 @@ func (hnd *DeviceStatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 
 	logger.Debug().Msg("get new connect")
 
-	con, _, _, err := gws.UpgradeHTTP(r, w)
+	upgrader := gws.HTTPUpgrader{Protocol: supportedProtocol}
+	con, _, hs, err := upgrader.Upgrade(r, w)
 	if err != nil {
 		logger.Err(err).Msg("failed to upgrade connection to WS, will close")
 		return
 	}
 
-	var token string
+	creds := credentialsFromRequest(r, logger)
+
+	worker := NewDeviceStatusWorker(con, hs.Protocol, hnd.env, logger, hnd.router, hnd.history, hnd.stats, creds)
+	go worker.Run(creds)
+}
+
+//Sequence numbers of resume request by device id, wrong ids are skipped
+func parseSeqs(seqs map[string]uint64, logger *zerolog.Logger) map[uuid.UUID]uint64 {
+	r := make(map[uuid.UUID]uint64, len(seqs))
+	for s, seq := range seqs {
+		id, err := uuid.FromString(s)
+		if err != nil {
+			logger.Debug().Msgf("wrong device id in resume request: %s", s)
+			continue
+		}
+		r[id] = seq
+	}
+	return r
+}
+
+//Token from query or bearer header, otherwise identity from client certificate
+func credentialsFromRequest(r *http.Request, logger *zerolog.Logger) model.Credentials {
+
+	var creds model.Credentials
 	tokenArray := r.URL.Query()["token"]
-	if len(tokenArray) < 1 {
+	auth := r.Header.Get("Authorization")
+	switch {
+	case len(tokenArray) > 0:
+		creds.Token = tokenArray[0]
+	case strings.HasPrefix(auth, "Bearer "):
+		creds.Token = strings.TrimPrefix(auth, "Bearer ")
+	default:
 		logger.Debug().Msg("no token in query")
-	} else {
-		token = tokenArray[0]
 	}
 
-	worker := NewDeviceStatusWorker(con, hnd.env, logger, hnd.router, token)
-	go worker.Run(token)
+	if creds.Token == "" && r.TLS != nil {
+		creds.Identity = identityFromTLS(r.TLS)
+		if creds.Identity != "" {
+			logger.Debug().Msgf("client authenticated by certificate: %s", creds.Identity)
+		}
+	}
+	return creds
+}
+
+//Return identity from verified client certificate: first URI SAN, then DNS SAN, then subject CN.
+//Empty if client did not send certificate
+func identityFromTLS(state *tls.ConnectionState) string {
+
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	cert := state.VerifiedChains[0][0]
+
+	switch {
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	default:
+		return cert.Subject.CommonName
+	}
 }
 
 type DeviceStatusWorker struct {
@@ -73,11 +139,15 @@ type DeviceStatusWorker struct {
 	env             config.Environment
 	logger          *zerolog.Logger
 	router          *router.RouterHandler
-	token           string
+	history         *history.Store
+	stats           *stats.Tracker
+	creds           model.Credentials
+	protocol        *protocol
 }
 
-func NewDeviceStatusWorker(conn net.Conn, env config.Environment, logger *zerolog.Logger, router *router.RouterHandler, token string) *DeviceStatusWorker {
-	return &DeviceStatusWorker{conn: conn, env: env, logger: logger, router: router, token: token}
+//version is subprotocol selected on upgrade, empty if client did not request supported one
+func NewDeviceStatusWorker(conn net.Conn, version string, env config.Environment, logger *zerolog.Logger, router *router.RouterHandler, history *history.Store, stats *stats.Tracker, creds model.Credentials) *DeviceStatusWorker {
+	return &DeviceStatusWorker{conn: conn, env: env, logger: logger, router: router, history: history, stats: stats, creds: creds, protocol: newProtocol(version)}
 }
 
 type closeEvent struct {
@@ -86,7 +156,7 @@ type closeEvent struct {
 	code   int
 }
 
-func (hnd *DeviceStatusWorker) Run(token string) {
+func (hnd *DeviceStatusWorker) Run(creds model.Credentials) {
 
 	ctx, cancelServe := context.WithCancel(context.Background())
 
@@ -109,8 +179,14 @@ func (hnd *DeviceStatusWorker) Run(token string) {
 		}
 	}()
 
-	if token == "" {
-		if err := hnd.sendCloseWSocket(codes["403"], "no token"); err != nil {
+	if creds.Empty() {
+		//Token is the only accepted credential unless client certificates are verified
+		reason := "no token"
+		if hnd.env.TLSClientCAFile != "" {
+			reason = "no credentials"
+		}
+		closeErr := model.NewError(model.ErrorCodeUnauthorized, errors.New(reason))
+		if err := hnd.sendCloseWSocket(closeErr.CloseCode(), closeErr.Reason()); err != nil {
 			hnd.logger.Err(err).Msg("failed to send close")
 		}
 		return
@@ -118,37 +194,54 @@ func (hnd *DeviceStatusWorker) Run(token string) {
 
 	go hnd.listenConnection(ctx)
 
-	hnd.aggregator = aggregator.NewAggregatorStatusHandler(ctx, hnd.env, hnd.logger, hnd.router, hnd.token)
+	hnd.aggregator = aggregator.NewAggregatorStatusHandler(ctx, hnd.env, hnd.logger, hnd.router, hnd.creds)
 
 loop:
 	for {
 		select {
 		case msg := <-hnd.aggregator.RespMessageAggregate:
-			if closeCode := msg.GetCloseCode(); closeCode != 0 {
+			if closeErr := msg.GetCloseError(); closeErr != nil {
 				hnd.eventsCloseChan <- &closeEvent{
 					force:  false,
-					reason: nil,
-					code:   closeCode,
+					reason: closeErr,
+					code:   closeErr.CloseCode(),
 				}
 				continue loop
 			}
 
 			hnd.logger.Debug().Msgf("try to send messsage to ws client, id %s", msg.Id)
-			if closed, err := hnd.sendMessage(msg); err != nil {
-				hnd.logger.Err(err).Msg("failed to send message")
-				if closed {
-					hnd.eventsCloseChan <- &closeEvent{
-						force:  false,
-						reason: nil,
-						code:   500,
-					}
-					continue loop
-				}
-			}
+			hnd.sendResponse(msg)
 
 		case msg := <-hnd.inputChan:
 			hnd.logger.Debug().Msgf("Reciv msg  %s\n", time.Now().String()) //rem
-			hnd.aggregator.SubscribeDevices(ctx, msg.Ids)
+			if nack := hnd.protocol.check(msg); nack != nil {
+				hnd.sendResponse(nack)
+				continue loop
+			}
+			switch msg.TypeReq {
+			case requestTypeHello:
+				resp, version, features := hnd.protocol.hello(msg)
+				hnd.sendResponse(resp)
+				hnd.protocol.apply(version, features)
+				hnd.logger.Debug().Msgf("client protocol %s, features %+v", version, features)
+				continue loop
+			case requestTypeHistory:
+				go hnd.sendHistory(ctx, msg)
+			case requestTypeStats:
+				go hnd.sendStats(ctx, msg)
+			case requestTypeSummary:
+				hnd.protocol.reset()
+				hnd.aggregator.SubscribeSummary(ctx, msg.Ids, msg.Groups)
+			case requestTypeResume:
+				hnd.protocol.reset()
+				hnd.aggregator.ResumeDevices(ctx, msg.Ids, parseSeqs(msg.Seqs, hnd.logger))
+			default:
+				hnd.protocol.reset()
+				hnd.aggregator.SubscribeGroups(ctx, msg.Ids, msg.Groups)
+			}
+			if ack := hnd.protocol.ack(msg); ack != nil {
+				hnd.sendResponse(ack)
+			}
 
 		case <-hnd.pinger.C:
 			hnd.logger.Debug().Msg("WS: time to ping client")
@@ -179,7 +272,7 @@ loop:
 
 			errMsg := ""
 			if evt.reason != nil {
-				errMsg = evt.reason.Error()
+				errMsg = model.AsError(evt.reason).Reason()
 			}
 
 			if err := hnd.sendCloseWSocket(evt.code, errMsg); err != nil {
@@ -187,7 +280,7 @@ loop:
 				hnd.eventsCloseChan <- &closeEvent{
 					force:  true,
 					reason: err,
-					code:   500,
+					code:   codes["500"],
 				}
 
 			}
@@ -218,7 +311,7 @@ func (hnd *DeviceStatusWorker) sendPingPongMessage(Op gws.OpCode) (err error) {
 		hnd.eventsCloseChan <- &closeEvent{
 			force:  false,
 			reason: fmt.Errorf("failed to send ping-pong: %w", err),
-			code:   500,
+			code:   codes["500"],
 		}
 	}
 	return nil
@@ -239,7 +332,7 @@ loop:
 			hnd.eventsCloseChan <- &closeEvent{
 				force:  true,
 				reason: fmt.Errorf("failed to initially set read deadline: %w", err),
-				code:   500,
+				code:   codes["500"],
 			}
 			break loop
 		}
@@ -253,7 +346,7 @@ loop:
 			hnd.eventsCloseChan <- &closeEvent{
 				force:  true,
 				reason: fmt.Errorf("read error %w", err),
-				code:   500,
+				code:   codes["500"],
 			}
 			break loop
 
@@ -261,7 +354,7 @@ loop:
 			hnd.eventsCloseChan <- &closeEvent{
 				force:  true,
 				reason: fmt.Errorf("client send close event"),
-				code:   200,
+				code:   codes["200"],
 			}
 			break loop
 
@@ -289,18 +382,35 @@ loop:
 
 }
 
-//Return true if conn is closed. Msg == model.ResponseMessage or model.CloseMessage
+//Send message to client, connection is closed if it could not be written
+func (hnd *DeviceStatusWorker) sendResponse(msg *model.ResponseMessage) {
+	if closed, err := hnd.sendMessage(msg); err != nil {
+		hnd.logger.Err(err).Msg("failed to send message")
+		if closed {
+			hnd.eventsCloseChan <- &closeEvent{
+				force:  false,
+				reason: nil,
+				code:   codes["500"],
+			}
+		}
+	}
+}
+
+//Return true if conn is closed. Msg == model.ResponseMessage or model.CloseMessage.
+//Msg is encoded by negotiated protocol of client
 func (hnd *DeviceStatusWorker) sendMessage(msg interface{}) (bool, error) {
 
 	if err := (hnd.conn).SetWriteDeadline(time.Now().Add(writeDeadline)); err != nil {
 		return true, fmt.Errorf("failed to set write deadline: %w", err)
 	}
-	writer := wsutil.NewWriter((hnd.conn), state, gws.OpText)
 
-	var encoder = json.NewEncoder(writer)
-
-	if err := encoder.Encode(&msg); err != nil {
-		return false, fmt.Errorf("failed to encode json: %w", err)
+	op, payload, err := hnd.protocol.encode(msg)
+	if err != nil {
+		return false, fmt.Errorf("failed to encode message: %w", err)
+	}
+	writer := wsutil.NewWriter((hnd.conn), state, op)
+	if _, err := writer.Write(payload); err != nil {
+		return true, fmt.Errorf("failed to write ws: %w", err)
 	}
 	if err := writer.Flush(); err != nil {
 		return true, fmt.Errorf("failed to write ws: %w", err)
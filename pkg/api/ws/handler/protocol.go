@@ -0,0 +1,224 @@
+package ws
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	gws "github.com/gobwas/ws"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/model"
+)
+
+//Versions of client protocol, selected by Sec-WebSocket-Protocol header or hello request.
+//Client which selects nothing speaks v1, its messages must not change
+const (
+	ProtocolV1 = "dsa.v1"
+	ProtocolV2 = "dsa.v2"
+
+	requestTypeHello     = "hello"
+	requestTypeSubscribe = "subscribe"
+
+	encodingJSON    = "json"
+	compressionGzip = "gzip"
+)
+
+//In order of preference of server
+var protocolVersions = []string{ProtocolV2, ProtocolV1}
+
+//Request types known by v2, other types are rejected. v1 treats any unknown type as subscribe
+var protocolV2Requests = map[string]bool{
+	requestTypeHello:     true,
+	requestTypeSubscribe: true,
+	requestTypeResume:    true,
+	requestTypeSummary:   true,
+	requestTypeHistory:   true,
+	requestTypeStats:     true,
+}
+
+func supportedProtocol(version string) bool {
+	for _, v := range protocolVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+//Protocol of one client connection. Used only by goroutine of worker loop
+type protocol struct {
+	version string
+	//Version is selected by Sec-WebSocket-Protocol header and could not be changed by hello
+	fixed    bool
+	features model.Features
+	//Hello is accepted only as first request
+	requested bool
+	//Last status sent to client by device id, base of next delta
+	last map[string]map[string]interface{}
+}
+
+//version is subprotocol selected on upgrade, empty if client did not send supported one
+func newProtocol(version string) *protocol {
+	p := &protocol{version: ProtocolV1, last: make(map[string]map[string]interface{})}
+	if version != "" {
+		p.version, p.fixed = version, true
+	}
+	return p
+}
+
+//Check request before it is handled, return nack if it is rejected
+func (p *protocol) check(req *model.RequestMessage) *model.ResponseMessage {
+
+	first := !p.requested
+	p.requested = true
+
+	switch {
+	case req.TypeReq == requestTypeHello && !first:
+		return p.nack("hello-nack", req, fmt.Errorf("hello must be first request"))
+	case p.version != ProtocolV1 && !protocolV2Requests[req.TypeReq]:
+		return p.nack("request-nack", req, fmt.Errorf("unknown request type: %s", req.TypeReq))
+	}
+	return nil
+}
+
+//Negotiate version and features. Reply must be sent before they are applied, so it is returned with them
+func (p *protocol) hello(req *model.RequestMessage) (*model.ResponseMessage, string, model.Features) {
+
+	version := p.version
+	if len(req.Versions) > 0 {
+		version = ""
+		for _, v := range req.Versions {
+			if supportedProtocol(v) && (!p.fixed || v == p.version) {
+				version = v
+				break
+			}
+		}
+		if version == "" {
+			return p.nack("hello-nack", req, fmt.Errorf("no supported version, server supports %v", protocolVersions)), p.version, p.features
+		}
+	}
+
+	var features model.Features
+	if version != ProtocolV1 {
+		features.Encoding = encodingJSON
+		if req.Features != nil {
+			features.Deltas = req.Features.Deltas
+			features.Ack = req.Features.Ack
+			if req.Features.Compression == compressionGzip {
+				features.Compression = compressionGzip
+			}
+		}
+	}
+	return model.NewHelloResponseMessage(version, protocolVersions, features), version, features
+}
+
+func (p *protocol) apply(version string, features model.Features) {
+	p.version, p.features = version, features
+	p.reset()
+}
+
+//Next status of each device is sent in full
+func (p *protocol) reset() {
+	p.last = make(map[string]map[string]interface{})
+}
+
+//Return ack of handled request, nil if ack is not negotiated
+func (p *protocol) ack(req *model.RequestMessage) *model.ResponseMessage {
+	if !p.features.Ack {
+		return nil
+	}
+	return model.NewAckResponseMessage(req.ReqId, req.TypeReq)
+}
+
+func (p *protocol) nack(typeRes string, req *model.RequestMessage, err error) *model.ResponseMessage {
+	return model.NewRequestErrorResponseMessage(typeRes, model.NewError(model.ErrorCodeBadRequest, err), req.ReqId, req.TypeReq)
+}
+
+//Encode message for client with negotiated features, return opcode of frame and its payload
+func (p *protocol) encode(msg interface{}) (gws.OpCode, []byte, error) {
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if resp, ok := msg.(*model.ResponseMessage); ok {
+		if data, err = p.delta(resp, data); err != nil {
+			return 0, nil, err
+		}
+	}
+	//As written by json.Encoder before protocol versions, so v1 frames are not changed
+	data = append(data, '\n')
+
+	if p.features.Compression != compressionGzip {
+		return gws.OpText, data, nil
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return 0, nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return 0, nil, err
+	}
+	return gws.OpBinary, buf.Bytes(), nil
+}
+
+//Replace status of device by JSON merge patch (RFC 7386) of last sent one, if deltas are negotiated.
+//Patch always has type and id and is marked by delta flag
+func (p *protocol) delta(msg *model.ResponseMessage, data []byte) ([]byte, error) {
+
+	switch {
+	case !p.features.Deltas:
+		return data, nil
+	case msg.TypeRes == "sub-nack":
+		delete(p.last, msg.Id)
+		return data, nil
+	case msg.TypeRes != "status":
+		return data, nil
+	}
+
+	var cur map[string]interface{}
+	if err := json.Unmarshal(data, &cur); err != nil {
+		return nil, err
+	}
+	prev, ok := p.last[msg.Id]
+	p.last[msg.Id] = cur
+	if !ok {
+		return data, nil
+	}
+
+	patch := mergePatch(prev, cur)
+	patch["type"], patch["id"], patch["delta"] = msg.TypeRes, msg.Id, true
+	return json.Marshal(patch)
+}
+
+//Return patch which turns prev into cur, removed fields are null
+func mergePatch(prev, cur map[string]interface{}) map[string]interface{} {
+
+	patch := make(map[string]interface{})
+	for k := range prev {
+		if _, ok := cur[k]; !ok {
+			patch[k] = nil
+		}
+	}
+	for k, v := range cur {
+		old, ok := prev[k]
+		switch {
+		case !ok:
+			patch[k] = v
+		case reflect.DeepEqual(old, v):
+		default:
+			oldObj, ok1 := old.(map[string]interface{})
+			obj, ok2 := v.(map[string]interface{})
+			//Nested objects are patched recursively, other values are replaced
+			if ok1 && ok2 {
+				patch[k] = mergePatch(oldObj, obj)
+			} else {
+				patch[k] = v
+			}
+		}
+	}
+	return patch
+}
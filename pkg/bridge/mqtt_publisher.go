@@ -0,0 +1,193 @@
+package bridge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	uuid "github.com/gofrs/uuid"
+	"github.com/rs/zerolog"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/config"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/model"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/router"
+)
+
+const (
+	publishTimeout = 5 * time.Second
+	disconnectWait = 250
+	idPlaceholder  = "{id}"
+	queueSize      = 1000
+)
+
+//MQTTPublisher republishes status changes of devices to MQTT as retained messages,
+//so last state is available to new consumers. It observes every status routed by router.
+//Configured devices are kept subscribed by watcher with service identity,
+//so they are routed even without other clients and access of publisher is checked by right verifier
+type MQTTPublisher struct {
+	env     config.Environment
+	logger  zerolog.Logger
+	watcher *router.Watcher
+	client  mqtt.Client
+	ids     []uuid.UUID
+	//Only these devices are published, all if nil
+	filter  map[string]struct{}
+	queue   chan *model.ResponseMessage
+	topic   string
+	qos     byte
+	retain  bool
+	cancelF context.CancelFunc
+	//Last published status per device without fields which differ in every message, only changes are published
+	last map[string][]byte
+}
+
+func NewMQTTPublisher(env config.Environment, logger *zerolog.Logger, rt *router.RouterHandler) (*MQTTPublisher, error) {
+
+	if !strings.Contains(env.MQTTPublishTopic, idPlaceholder) {
+		return nil, fmt.Errorf("mqtt publish topic must contain %s", idPlaceholder)
+	}
+	//Source broker is shared with its credentials
+	brokerURL, username, password := env.MQTTPublishBrokerURL, env.MQTTPublishUsername, env.MQTTPublishPassword
+	if brokerURL == "" {
+		brokerURL, username, password = env.MQTTBrokerURL, env.MQTTUsername, env.MQTTPassword
+	}
+	if brokerURL == "" {
+		return nil, fmt.Errorf("mqtt publisher requires broker URL")
+	}
+	u, err := url.Parse(brokerURL)
+	if err != nil {
+		return nil, fmt.Errorf("wrong mqtt publish broker URL: %w", err)
+	}
+
+	var (
+		ids    []uuid.UUID
+		filter map[string]struct{}
+	)
+	if len(env.MQTTPublishDevices) > 0 {
+		filter = make(map[string]struct{}, len(env.MQTTPublishDevices))
+	}
+	for _, s := range env.MQTTPublishDevices {
+		id, err := uuid.FromString(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("wrong device id to publish %s: %w", s, err)
+		}
+		ids = append(ids, id)
+		filter[id.String()] = struct{}{}
+	}
+
+	tlsConfig, err := config.NewMQTTPublishTLSConfig(env)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(brokerURL).
+		SetClientID(env.MQTTPublishClientID).
+		SetUsername(username).
+		SetPassword(password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true)
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	return &MQTTPublisher{
+		env:     env,
+		logger:  logger.With().Str("MQTT_PUBLISHER", u.Host).Logger(),
+		watcher: router.NewWatcher(rt, model.Credentials{Identity: env.MQTTPublishIdentity}, logger),
+		client:  mqtt.NewClient(opts),
+		ids:     ids,
+		filter:  filter,
+		queue:   make(chan *model.ResponseMessage, queueSize),
+		topic:   env.MQTTPublishTopic,
+		qos:     byte(env.MQTTPublishQoS),
+		retain:  !env.MQTTPublishNoRetain,
+		last:    make(map[string][]byte),
+	}, nil
+}
+
+//Connect to broker and watch devices. Messages published while broker is disconnected are queued by client
+func (hnd *MQTTPublisher) Run(ctx context.Context) {
+
+	ctx, hnd.cancelF = context.WithCancel(ctx)
+	connectToken := hnd.client.Connect()
+	if len(hnd.ids) > 0 {
+		hnd.watcher.Set(hnd.ids)
+		hnd.logger.Debug().Msgf("Keep %d devices subscribed to publish to MQTT", len(hnd.ids))
+	}
+
+	go func() {
+		defer func() {
+			hnd.watcher.Stop()
+			//Client must not be disconnected while it is connecting
+			connectToken.WaitTimeout(publishTimeout)
+			hnd.client.Disconnect(disconnectWait)
+		}()
+
+		for {
+			select {
+			case msg := <-hnd.queue:
+				hnd.publish(msg)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+//Queue status routed to any client, it is published by goroutine of Run
+func (hnd *MQTTPublisher) OnMessage(id uuid.UUID, msg *model.ResponseMessage) {
+	if msg.TypeRes != "status" {
+		return
+	}
+	if _, ok := hnd.filter[id.String()]; hnd.filter != nil && !ok {
+		return
+	}
+	select {
+	case hnd.queue <- msg:
+	default:
+		hnd.logger.Warn().Msgf("Publish queue is full, status is dropped for id: %s", id.String())
+	}
+}
+
+func (hnd *MQTTPublisher) Stop() {
+	if hnd.cancelF != nil {
+		hnd.cancelF()
+	}
+}
+
+//Publish status if it is changed, the same status is routed again e.g. after reconnect to upstream
+func (hnd *MQTTPublisher) publish(msg *model.ResponseMessage) {
+
+	//Sequence number and receive time differ for every routed message, so they are not part of status
+	state := *msg
+	state.Seq = 0
+	state.ReceivedAt = nil
+	stateJSON, err := json.Marshal(&state)
+	if err != nil {
+		hnd.logger.Err(err).Msg("failed to encode json")
+		return
+	}
+	if bytes.Equal(stateJSON, hnd.last[msg.Id]) {
+		return
+	}
+	hnd.last[msg.Id] = stateJSON
+
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		hnd.logger.Err(err).Msg("failed to encode json")
+		return
+	}
+
+	topic := strings.Replace(hnd.topic, idPlaceholder, msg.Id, -1)
+	token := hnd.client.Publish(topic, hnd.qos, hnd.retain, payload)
+	go func() {
+		if token.WaitTimeout(publishTimeout) && token.Error() != nil {
+			hnd.logger.Err(token.Error()).Msgf("failed to publish to %s", topic)
+		}
+	}()
+}
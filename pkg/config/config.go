@@ -1,10 +1,78 @@
 package config
 
 type Environment struct {
-	LogLevel          string `long:"log-level" env:"LOG_LEVEL" required:"false" default:"debug"`
-	WebSocketPort     int    `long:"websocket-port" env:"WS_PORT" required:"true" default:"8089"`
-	DSNHostPort       string `long:"dsn-host-port" env:"DSN_HOST_PORT" required:"true" default:"localhost:8999"`
-	RightVerifURL     string `long:"rf-url" env:"RF_URL" required:"true" default:""`
-	AuthFieldName     string `long:"AuthFieldName" env:"AUTH_FIELD_NAME" required:"false" default:"auth_result"`
-	RightVerifSkipTLS bool   `long:"RfSkipTLS" env:"RF_SKIP_TLS" required:"false"`
+	LogLevel                 string   `long:"log-level" env:"LOG_LEVEL" required:"false" default:"debug"`
+	WebSocketPort            int      `long:"websocket-port" env:"WS_PORT" required:"true" default:"8089"`
+	SourceType               string   `long:"source" env:"SOURCE" required:"false" default:"dsn" choice:"dsn" choice:"http" choice:"mqtt" description:"upstream of device status"`
+	HTTPSourceURL            string   `long:"http-source-url" env:"HTTP_SOURCE_URL" required:"false" description:"status endpoint for http source, device id is appended"`
+	HTTPSourcePollPeriod     int      `long:"http-source-poll-period" env:"HTTP_SOURCE_POLL_PERIOD" required:"false" default:"10" description:"seconds between polls of status endpoint"`
+	MQTTBrokerURL            string   `long:"mqtt-broker-url" env:"MQTT_BROKER_URL" required:"false" description:"broker for mqtt source, e.g. tcp://localhost:1883"`
+	MQTTClientID             string   `long:"mqtt-client-id" env:"MQTT_CLIENT_ID" required:"false" default:"device-status-aggregator"`
+	MQTTUsername             string   `long:"mqtt-username" env:"MQTT_USERNAME" required:"false"`
+	MQTTPassword             string   `long:"mqtt-password" env:"MQTT_PASSWORD" required:"false"`
+	MQTTQoS                  int      `long:"mqtt-qos" env:"MQTT_QOS" required:"false" default:"1" choice:"0" choice:"1" choice:"2"`
+	MQTTStatusTopics         []string `long:"mqtt-status-topic" env:"MQTT_STATUS_TOPICS" env-delim:"," required:"false" default:"devices/{id}/status" description:"topics with status of device, {id} is replaced by device id. Payload is status json as from DSN or presence payload"`
+	MQTTPresenceTopics       []string `long:"mqtt-presence-topic" env:"MQTT_PRESENCE_TOPICS" env-delim:"," required:"false" description:"topics with presence of device, usually last will topic, e.g. devices/{id}/lwt"`
+	MQTTOnlinePayload        string   `long:"mqtt-online-payload" env:"MQTT_ONLINE_PAYLOAD" required:"false" default:"online"`
+	MQTTOfflinePayload       string   `long:"mqtt-offline-payload" env:"MQTT_OFFLINE_PAYLOAD" required:"false" default:"offline"`
+	MQTTPublish              bool     `long:"mqtt-publish" env:"MQTT_PUBLISH" required:"false" description:"republish status changes of routed devices to MQTT"`
+	MQTTPublishDevices       []string `long:"mqtt-publish-device" env:"MQTT_PUBLISH_DEVICES" env-delim:"," required:"false" description:"only these devices are republished and they are always subscribed, enables publisher"`
+	MQTTPublishBrokerURL     string   `long:"mqtt-publish-broker-url" env:"MQTT_PUBLISH_BROKER_URL" required:"false" description:"broker to republish status, mqtt-broker-url with its credentials and TLS if empty"`
+	MQTTPublishUsername      string   `long:"mqtt-publish-username" env:"MQTT_PUBLISH_USERNAME" required:"false"`
+	MQTTPublishPassword      string   `long:"mqtt-publish-password" env:"MQTT_PUBLISH_PASSWORD" required:"false"`
+	MQTTPublishCAFile        string   `long:"mqtt-publish-ca-file" env:"MQTT_PUBLISH_CA_FILE" required:"false" description:"CA bundle to verify publish broker, system pool if empty. TLS is used for ssl:// broker URL"`
+	MQTTPublishCertFile      string   `long:"mqtt-publish-cert-file" env:"MQTT_PUBLISH_CERT_FILE" required:"false" description:"client certificate for publish broker"`
+	MQTTPublishKeyFile       string   `long:"mqtt-publish-key-file" env:"MQTT_PUBLISH_KEY_FILE" required:"false"`
+	MQTTPublishSkipTLS       bool     `long:"mqtt-publish-skip-tls" env:"MQTT_PUBLISH_SKIP_TLS" required:"false" description:"do not verify certificate of publish broker"`
+	MQTTPublishClientID      string   `long:"mqtt-publish-client-id" env:"MQTT_PUBLISH_CLIENT_ID" required:"false" default:"device-status-aggregator-publisher"`
+	MQTTPublishTopic         string   `long:"mqtt-publish-topic" env:"MQTT_PUBLISH_TOPIC" required:"false" default:"aggregator/devices/{id}/status" description:"topic for retained status of device, {id} is replaced by device id"`
+	MQTTPublishQoS           int      `long:"mqtt-publish-qos" env:"MQTT_PUBLISH_QOS" required:"false" default:"1" choice:"0" choice:"1" choice:"2"`
+	MQTTPublishNoRetain      bool     `long:"mqtt-publish-no-retain" env:"MQTT_PUBLISH_NO_RETAIN" required:"false" description:"publish status without retain flag, new consumers get status only on its next change"`
+	MQTTPublishIdentity      string   `long:"mqtt-publish-identity" env:"MQTT_PUBLISH_IDENTITY" required:"false" default:"device-status-aggregator" description:"service identity of publisher passed to right verifier"`
+	DSNHostPort              string   `long:"dsn-host-port" env:"DSN_HOST_PORT" required:"true" default:"localhost:8999" description:"DSN address, comma separated for equivalent replicas"`
+	RightVerifURL            string   `long:"rf-url" env:"RF_URL" required:"true" default:""`
+	AuthFieldName            string   `long:"AuthFieldName" env:"AUTH_FIELD_NAME" required:"false" default:"auth_result"`
+	RightVerifSkipTLS        bool     `long:"RfSkipTLS" env:"RF_SKIP_TLS" required:"false"`
+	RightVerifIdentityHeader string   `long:"rf-identity-header" env:"RF_IDENTITY_HEADER" required:"false" default:"X-Client-Identity" description:"header to pass identity of client authenticated by certificate"`
+	TLSCertFile              string   `long:"tls-cert-file" env:"TLS_CERT_FILE" required:"false" description:"certificate for websocket port, enables TLS"`
+	TLSKeyFile               string   `long:"tls-key-file" env:"TLS_KEY_FILE" required:"false"`
+	TLSReloadPeriod          int      `long:"tls-reload-period" env:"TLS_RELOAD_PERIOD" required:"false" default:"10" description:"seconds between checks of certificate files for changes, 0 to check on every handshake"`
+	TLSClientCAFile          string   `long:"tls-client-ca-file" env:"TLS_CLIENT_CA_FILE" required:"false" description:"CA bundle to verify client certificates, enables authentication by certificate"`
+	DSNTLS                   bool     `long:"dsn-tls" env:"DSN_TLS" required:"false" description:"connect to DSN with wss"`
+	DSNCAFile                string   `long:"dsn-ca-file" env:"DSN_CA_FILE" required:"false" description:"CA bundle to verify DSN, system pool if empty"`
+	DSNCertFile              string   `long:"dsn-cert-file" env:"DSN_CERT_FILE" required:"false" description:"client certificate for DSN"`
+	DSNKeyFile               string   `long:"dsn-key-file" env:"DSN_KEY_FILE" required:"false"`
+	DSNServerName            string   `long:"dsn-server-name" env:"DSN_SERVER_NAME" required:"false" description:"SNI for DSN, host of dsn-host-port if empty"`
+	DSNBackends              []string `long:"dsn-backend" env:"DSN_BACKENDS" env-delim:"," required:"false" description:"named DSN backends name=host:port|host:port, dsn-host-port is the only backend if empty"`
+	DSNFailureThreshold      int      `long:"dsn-failure-threshold" env:"DSN_FAILURE_THRESHOLD" required:"false" default:"3" description:"consecutive failures before DSN endpoint is skipped"`
+	DSNCircuitOpenPeriod     int      `long:"dsn-circuit-open-period" env:"DSN_CIRCUIT_OPEN_PERIOD" required:"false" default:"30" description:"seconds to skip failed DSN endpoint"`
+	DSNRoutesFile            string   `long:"dsn-routes-file" env:"DSN_ROUTES_FILE" required:"false" description:"JSON file with rules to choose DSN backend by device id, consistent hash if empty"`
+	DSNAuthMode              string   `long:"dsn-auth-mode" env:"DSN_AUTH_MODE" required:"false" default:"legacy" choice:"legacy" choice:"token" choice:"forward" choice:"hmac" description:"authentication on DSN: legacy AuthFieldName query, static token, forward client token or hmac signature"`
+	DSNAuthToken             string   `long:"dsn-auth-token" env:"DSN_AUTH_TOKEN" required:"false" description:"service token for token mode"`
+	DSNAuthKeyID             string   `long:"dsn-auth-key-id" env:"DSN_AUTH_KEY_ID" required:"false" description:"key id sent with signature in hmac mode"`
+	DSNAuthSecret            string   `long:"dsn-auth-secret" env:"DSN_AUTH_SECRET" required:"false" description:"shared secret for hmac mode"`
+	RouteLinger              int      `long:"route-linger" env:"ROUTE_LINGER" required:"false" default:"10" description:"seconds to keep DSN connection after last subscriber left"`
+	DSNPingPeriod            int      `long:"dsn-ping-period" env:"DSN_PING_PERIOD" required:"false" default:"10" description:"seconds between pings to DSN, connection is closed if pong is not received until next ping"`
+	StaleTimeout             int      `long:"stale-timeout" env:"STALE_TIMEOUT" required:"false" default:"0" description:"seconds without updates from DSN before status is reported as stale, 0 to disable"`
+	ServiceIdentity          string   `long:"service-identity" env:"SERVICE_IDENTITY" required:"false" default:"device-status-aggregator" description:"identity of aggregator passed to right verifier and groups provider to watch devices of webhook rules"`
+	ResumeBufferSize         int      `long:"resume-buffer-size" env:"RESUME_BUFFER_SIZE" required:"false" default:"16" description:"last messages kept per device for clients resuming after reconnect"`
+	StoppedRoutesCap         int      `long:"stopped-routes-cap" env:"STOPPED_ROUTES_CAP" required:"false" default:"100000" description:"devices without route whose last presence and sequence number are kept, least recently routed are forgotten first, 0 for no limit"`
+	GroupsFile               string   `long:"groups-file" env:"GROUPS_FILE" required:"false" description:"JSON file with device groups, reloaded on change"`
+	GroupsURL                string   `long:"groups-url" env:"GROUPS_URL" required:"false" description:"endpoint with members of device group, group name is appended"`
+	GroupsRefreshPeriod      int      `long:"groups-refresh-period" env:"GROUPS_REFRESH_PERIOD" required:"false" default:"60" description:"seconds between updates of members of subscribed groups"`
+	WebhookRulesFile         string   `long:"webhook-rules-file" env:"WEBHOOK_RULES_FILE" required:"false" description:"JSON file with webhooks on device presence transitions, webhooks are disabled if empty"`
+	WebhookRetries           int      `long:"webhook-retries" env:"WEBHOOK_RETRIES" required:"false" default:"5" description:"retries of failed webhook before it is written to dead-letter log"`
+	WebhookBackoff           int      `long:"webhook-backoff" env:"WEBHOOK_BACKOFF" required:"false" default:"1" description:"seconds before first retry of webhook, doubled on each retry"`
+	WebhookDeadLetterFile    string   `long:"webhook-dead-letter-file" env:"WEBHOOK_DEAD_LETTER_FILE" required:"false" description:"file to append failed webhooks as JSON lines, only logged if empty"`
+	HistoryFile              string   `long:"history-file" env:"HISTORY_FILE" required:"false" description:"BoltDB file to persist changes of routed statuses, history is disabled if empty"`
+	HistoryDevices           []string `long:"history-device" env:"HISTORY_DEVICES" env-delim:"," required:"false" description:"devices kept routed to record history without subscribed clients"`
+	HistoryRetention         int      `long:"history-retention" env:"HISTORY_RETENTION" required:"false" default:"720" description:"hours to keep history, 0 to keep forever"`
+	HistoryMaxEntries        int      `long:"history-max-entries" env:"HISTORY_MAX_ENTRIES" required:"false" default:"0" description:"max entries of history per device, 0 for unlimited"`
+	HistoryQueryLimit        int      `long:"history-query-limit" env:"HISTORY_QUERY_LIMIT" required:"false" default:"1000" description:"max entries returned by one history request"`
+	AlertRulesFile           string   `long:"alert-rules-file" env:"ALERT_RULES_FILE" required:"false" description:"JSON file with alert rules on device status, alerts are disabled if empty"`
+	AlertRulesReloadPeriod   int      `long:"alert-rules-reload-period" env:"ALERT_RULES_RELOAD_PERIOD" required:"false" default:"5" description:"seconds between checks of alert rules file for changes"`
+	TelemetrySchemasFile     string   `long:"telemetry-schemas-file" env:"TELEMETRY_SCHEMAS_FILE" required:"false" description:"JSON file with JSON Schemas of telemetry per device type, telemetry is not validated if empty"`
+	TelemetryInvalidAction   string   `long:"telemetry-invalid-action" env:"TELEMETRY_INVALID_ACTION" required:"false" default:"flag" choice:"flag" choice:"drop" description:"status with invalid telemetry is passed with invalidTelemetry flag or dropped"`
+	TransformsFile           string   `long:"transforms-file" env:"TRANSFORMS_FILE" required:"false" description:"JSON file with transformation steps of extendedStatus per device type, extendedStatus is not changed if empty"`
+	StatusStates             []string `long:"status-states" env:"STATUS_STATES" env-delim:"," required:"false" default:"0:offline" default:"1:online" description:"names of raw device statuses as status:name, e.g. 2:sleeping"`
 }
@@ -0,0 +1,194 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+//Return nil if TLS is not configured for websocket port.
+//Certificate is reloaded from files on handshake if they were changed
+func NewServerTLSConfig(env Environment) (*tls.Config, error) {
+
+	if env.TLSCertFile == "" && env.TLSKeyFile == "" {
+		return nil, nil
+	}
+
+	reloader, err := newCertReloader(env.TLSCertFile, env.TLSKeyFile, env)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if env.TLSClientCAFile != "" {
+		if cfg.ClientCAs, err = loadCertPool(env.TLSClientCAFile); err != nil {
+			return nil, err
+		}
+		//Clients with token still can connect without certificate
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return cfg, nil
+}
+
+//Return nil if DSN is connected without TLS
+func NewDSNTLSConfig(env Environment) (*tls.Config, error) {
+
+	if !env.DSNTLS {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: env.DSNServerName,
+	}
+
+	if env.DSNCAFile != "" {
+		pool, err := loadCertPool(env.DSNCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+
+	if env.DSNCertFile != "" || env.DSNKeyFile != "" {
+		reloader, err := newCertReloader(env.DSNCertFile, env.DSNKeyFile, env)
+		if err != nil {
+			return nil, err
+		}
+		cfg.GetClientCertificate = reloader.GetClientCertificate
+	}
+
+	return cfg, nil
+}
+
+//Return TLS config for broker of MQTT publisher. Source broker config is used if publish broker is not set
+func NewMQTTPublishTLSConfig(env Environment) (*tls.Config, error) {
+
+	if env.MQTTPublishBrokerURL == "" {
+		return NewDSNTLSConfig(env)
+	}
+
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: env.MQTTPublishSkipTLS,
+	}
+
+	if env.MQTTPublishCAFile != "" {
+		pool, err := loadCertPool(env.MQTTPublishCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+
+	if env.MQTTPublishCertFile != "" || env.MQTTPublishKeyFile != "" {
+		reloader, err := newCertReloader(env.MQTTPublishCertFile, env.MQTTPublishKeyFile, env)
+		if err != nil {
+			return nil, err
+		}
+		cfg.GetClientCertificate = reloader.GetClientCertificate
+	}
+
+	return cfg, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in CA bundle %s", file)
+	}
+	return pool, nil
+}
+
+type certReloader struct {
+	sync.Mutex
+	certFile    string
+	keyFile     string
+	cert        *tls.Certificate
+	modTime     time.Time
+	checkedAt   time.Time
+	checkPeriod time.Duration
+}
+
+func newCertReloader(certFile, keyFile string, env Environment) (*certReloader, error) {
+	r := &certReloader{
+		certFile:    certFile,
+		keyFile:     keyFile,
+		checkPeriod: time.Duration(env.TLSReloadPeriod) * time.Second,
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.current(), nil
+}
+
+func (r *certReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.current(), nil
+}
+
+//Return loaded certificate, reload it if files were changed. Old certificate is kept on reload error
+func (r *certReloader) current() *tls.Certificate {
+	r.Lock()
+	defer r.Unlock()
+
+	if time.Since(r.checkedAt) >= r.checkPeriod {
+		r.checkedAt = time.Now()
+		if modTime, err := r.lastModTime(); err == nil && !modTime.Equal(r.modTime) {
+			if err := r.load(); err != nil {
+				log.Err(err).Msgf("failed to reload certificate %s, keep old one", r.certFile)
+			} else {
+				log.Info().Msgf("certificate %s reloaded", r.certFile)
+			}
+		}
+	}
+
+	return r.cert
+}
+
+func (r *certReloader) load() error {
+	modTime, err := r.lastModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("load certificate %s: %w", r.certFile, err)
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	r.checkedAt = time.Now()
+	return nil
+}
+
+func (r *certReloader) lastModTime() (time.Time, error) {
+	var last time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return last, fmt.Errorf("stat %s: %w", file, err)
+		}
+		if info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	return last, nil
+}
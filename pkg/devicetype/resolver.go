@@ -0,0 +1,53 @@
+package devicetype
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	uuid "github.com/gofrs/uuid"
+)
+
+//Resolver finds type of device: by list of ids, otherwise by field of telemetry, otherwise default type
+type Resolver struct {
+	field []string
+	def   string
+	ids   map[uuid.UUID]string
+}
+
+//typeField is dot separated path of field in telemetry, not used if empty
+func NewResolver(typeField string, def string) *Resolver {
+	r := &Resolver{def: def, ids: make(map[uuid.UUID]string)}
+	if typeField != "" {
+		r.field = strings.Split(typeField, ".")
+	}
+	return r
+}
+
+//Must be called before Type
+func (r *Resolver) AddIds(deviceType string, ids []uuid.UUID) {
+	for _, id := range ids {
+		r.ids[id] = deviceType
+	}
+}
+
+//Return type of device, telemetry may be nil
+func (r *Resolver) Type(id uuid.UUID, telemetry []byte) string {
+
+	if t, ok := r.ids[id]; ok {
+		return t
+	}
+	if len(r.field) > 0 && bytes.HasPrefix(bytes.TrimSpace(telemetry), []byte("{")) {
+		var cur interface{}
+		if err := json.Unmarshal(telemetry, &cur); err == nil {
+			for _, key := range r.field {
+				obj, _ := cur.(map[string]interface{})
+				cur = obj[key]
+			}
+			if t, ok := cur.(string); ok {
+				return t
+			}
+		}
+	}
+	return r.def
+}
@@ -0,0 +1,76 @@
+package groups
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	uuid "github.com/gofrs/uuid"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/model"
+)
+
+//Content of groups file
+type Groups struct {
+	Groups map[string][]uuid.UUID `json:"groups"`
+}
+
+//FileProvider reads groups from JSON file, file is read again when it is changed.
+//Groups are the same for all clients, access is checked per device
+type FileProvider struct {
+	sync.Mutex
+	file    string
+	modTime time.Time
+	groups  map[string][]uuid.UUID
+}
+
+func NewFileProvider(file string) (*FileProvider, error) {
+	p := &FileProvider{file: file}
+	if err := p.reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *FileProvider) Members(name string, creds model.Credentials) ([]uuid.UUID, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	//Keep previous groups if file is broken
+	if err := p.reload(); err != nil {
+		return nil, model.NewError(model.ErrorCodeUnavailable, err)
+	}
+
+	members, ok := p.groups[name]
+	if !ok {
+		return nil, model.NewError(model.ErrorCodeNotFound, fmt.Errorf("unknown group"))
+	}
+	return append([]uuid.UUID{}, members...), nil
+}
+
+//Read file if it is changed
+func (p *FileProvider) reload() error {
+	st, err := os.Stat(p.file)
+	if err != nil {
+		return fmt.Errorf("failed to read groups: %w", err)
+	}
+	if p.groups != nil && st.ModTime().Equal(p.modTime) {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(p.file)
+	if err != nil {
+		return fmt.Errorf("failed to read groups: %w", err)
+	}
+	var groups Groups
+	if err := json.Unmarshal(data, &groups); err != nil {
+		return fmt.Errorf("failed to parse groups: %w", err)
+	}
+	if groups.Groups == nil {
+		groups.Groups = make(map[string][]uuid.UUID)
+	}
+	p.groups, p.modTime = groups.Groups, st.ModTime()
+	return nil
+}
@@ -0,0 +1,81 @@
+package groups
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	uuid "github.com/gofrs/uuid"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/config"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/model"
+)
+
+const httpClientTimeout = 3 * time.Second
+
+//Response of groups endpoint
+type membersResponse struct {
+	Members []uuid.UUID `json:"members"`
+}
+
+//HTTPProvider gets members from <GroupsURL><name> with credentials of client,
+//so endpoint can return groups of user
+type HTTPProvider struct {
+	env    config.Environment
+	client *http.Client
+}
+
+func NewHTTPProvider(env config.Environment) *HTTPProvider {
+	return &HTTPProvider{
+		env: env,
+		client: &http.Client{
+			Timeout: httpClientTimeout,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: env.RightVerifSkipTLS},
+			},
+		},
+	}
+}
+
+func (p *HTTPProvider) Members(name string, creds model.Credentials) ([]uuid.UUID, error) {
+
+	u, err := url.Parse(p.env.GroupsURL + url.PathEscape(name))
+	if err != nil {
+		return nil, model.NewError(model.ErrorCodeGeneric, fmt.Errorf("groupsURL parse error: %w", err))
+	}
+
+	header := make(http.Header)
+	if creds.Token != "" {
+		header.Add("Authorization", "Bearer "+creds.Token)
+	} else {
+		header.Add(p.env.RightVerifIdentityHeader, creds.Identity)
+	}
+	req := &http.Request{
+		Method: "GET",
+		URL:    u,
+		Header: header,
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, model.NewError(model.ErrorCodeUnavailable, fmt.Errorf("cant connect to resolve group: %s : %w", name, err))
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var r membersResponse
+		if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+			return nil, model.NewError(model.ErrorCodeGeneric, fmt.Errorf("failed to decode members of group: %w", err))
+		}
+		return r.Members, nil
+	case http.StatusUnauthorized:
+		return nil, model.NewError(model.ErrorCodeTokenOutdated, fmt.Errorf("token outdated"))
+	case http.StatusForbidden, http.StatusNotFound:
+		return nil, model.NewError(model.ErrorCodeNotFound, fmt.Errorf("unknown group"))
+	default:
+		return nil, model.NewError(model.ErrorCodeGeneric, fmt.Errorf("unknown status code from groups server: %d", resp.StatusCode))
+	}
+}
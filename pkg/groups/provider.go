@@ -0,0 +1,29 @@
+package groups
+
+import (
+	"fmt"
+
+	uuid "github.com/gofrs/uuid"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/config"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/model"
+)
+
+//Provider resolves named group (home, room, fleet) to its devices
+type Provider interface {
+	//Return *model.Error: NOT_FOUND if group does not exist or is not visible with creds
+	Members(name string, creds model.Credentials) ([]uuid.UUID, error)
+}
+
+//Return provider from file or HTTP endpoint, nil if groups are not configured
+func NewProvider(env config.Environment) (Provider, error) {
+	switch {
+	case env.GroupsFile != "" && env.GroupsURL != "":
+		return nil, fmt.Errorf("groups file and groups url are exclusive")
+	case env.GroupsFile != "":
+		return NewFileProvider(env.GroupsFile)
+	case env.GroupsURL != "":
+		return NewHTTPProvider(env), nil
+	default:
+		return nil, nil
+	}
+}
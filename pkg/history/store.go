@@ -0,0 +1,433 @@
+package history
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	uuid "github.com/gofrs/uuid"
+	"github.com/rs/zerolog"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/config"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/model"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/router"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	queueSize    = 1000
+	batchSize    = 100
+	pruneEvery   = time.Hour
+	openTimeout  = 5 * time.Second
+	defaultLimit = 1000
+)
+
+var rootBucket = []byte("history")
+
+//Store persists changes of status routed by router in BoltDB file: presence, status, state or extendedStatus.
+//Devices are recorded while they are routed, configured devices are watched to be routed without clients.
+//Bucket of each device holds entries with keys <unix nano><sequence>, so they are ordered by time
+type Store struct {
+	db      *bolt.DB
+	queue   chan change
+	watcher *router.Watcher
+	watched []uuid.UUID
+	//Last stored entry per device, used only by writer goroutine
+	last       map[uuid.UUID]*lastEntry
+	retention  time.Duration
+	maxEntries int
+	limit      int
+	logger     zerolog.Logger
+	cancelF    context.CancelFunc
+	wg         sync.WaitGroup
+}
+
+type change struct {
+	id  uuid.UUID
+	at  time.Time
+	msg *model.ResponseMessage
+}
+
+type lastEntry struct {
+	presence model.Presence
+	state    []byte
+}
+
+//Fields of status which are stored when they are changed
+type statusState struct {
+	Online         *bool            `json:"online,omitempty"`
+	Status         *int             `json:"status,omitempty"`
+	State          string           `json:"state,omitempty"`
+	Stale          bool             `json:"stale,omitempty"`
+	ExtendedStatus *json.RawMessage `json:"extendedStatus,omitempty"`
+}
+
+//Devices of HistoryDevices are watched via r with service identity
+func Open(env config.Environment, logger *zerolog.Logger, r *router.RouterHandler) (*Store, error) {
+
+	var watched []uuid.UUID
+	for _, s := range env.HistoryDevices {
+		id, err := uuid.FromString(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("wrong device id of history %s: %w", s, err)
+		}
+		watched = append(watched, id)
+	}
+
+	db, err := bolt.Open(env.HistoryFile, 0640, &bolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open history: %w", err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(rootBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to init history: %w", err)
+	}
+
+	limit := env.HistoryQueryLimit
+	if limit <= 0 {
+		limit = defaultLimit
+	}
+
+	l := logger.With().Str("COMPONENT", "history").Logger()
+	return &Store{
+		db:         db,
+		queue:      make(chan change, queueSize),
+		watcher:    router.NewWatcher(r, model.Credentials{Identity: env.ServiceIdentity}, &l),
+		watched:    watched,
+		last:       make(map[uuid.UUID]*lastEntry),
+		retention:  time.Duration(env.HistoryRetention) * time.Hour,
+		maxEntries: env.HistoryMaxEntries,
+		limit:      limit,
+		logger:     l,
+	}, nil
+}
+
+//Apply retention and start writer goroutine
+func (s *Store) Run(ctx context.Context) {
+	ctx, s.cancelF = context.WithCancel(ctx)
+	s.prune(time.Now())
+	s.watcher.Set(s.watched)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(pruneEvery)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case c := <-s.queue:
+				s.writeBatch(c)
+			case now := <-ticker.C:
+				s.prune(now)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+//Stop writer and close file
+func (s *Store) Stop() {
+	if s.cancelF != nil {
+		s.cancelF()
+	}
+	s.watcher.Stop()
+	s.wg.Wait()
+	if err := s.db.Close(); err != nil {
+		s.logger.Err(err).Msg("failed to close history")
+	}
+}
+
+//Queue status routed to subscribers of device, it is stored by writer goroutine if it is changed.
+//Time of entry is time when status was received from upstream, or routed if it is not known
+func (s *Store) OnMessage(id uuid.UUID, msg *model.ResponseMessage) {
+	if _, ok := msg.Presence(); !ok {
+		return
+	}
+	at := time.Now()
+	if msg.ReceivedAt != nil {
+		at = *msg.ReceivedAt
+	}
+	select {
+	case s.queue <- change{id: id, at: at, msg: msg}:
+	default:
+		s.logger.Error().Msgf("History queue is full, status of id: %s is lost", id)
+	}
+}
+
+//Write c and changes already queued after it in one transaction, so burst of statuses does not sync file for each of them
+func (s *Store) writeBatch(c change) {
+	batch := []change{c}
+collect:
+	for len(batch) < batchSize {
+		select {
+		case c := <-s.queue:
+			batch = append(batch, c)
+		default:
+			break collect
+		}
+	}
+
+	//Applied to last entries only when transaction is committed
+	written := make(map[uuid.UUID]*lastEntry)
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, c := range batch {
+			last, ok := written[c.id]
+			if !ok {
+				var err error
+				if last, err = s.lastEntry(tx, c.id); err != nil {
+					return err
+				}
+			}
+			entry, err := s.write(tx, c, last)
+			if err != nil {
+				return err
+			}
+			if entry != nil {
+				written[c.id] = entry
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		s.logger.Err(err).Msgf("failed to write history of %d statuses", len(batch))
+		return
+	}
+	for id, last := range written {
+		s.last[id] = last
+	}
+}
+
+//Store c if it differs from last entry of device. Return new last entry, nil if c is not stored
+func (s *Store) write(tx *bolt.Tx, c change, last *lastEntry) (*lastEntry, error) {
+
+	to, _ := c.msg.Presence()
+	state, err := stateOf(c.msg)
+	if err != nil {
+		return nil, err
+	}
+
+	from := model.PresenceUnknown
+	if last != nil {
+		if bytes.Equal(last.state, state) {
+			return nil, nil
+		}
+		from = last.presence
+	}
+
+	value, err := json.Marshal(model.HistoryEntry{At: c.at.UTC(), From: from, To: to, Status: c.msg})
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := tx.Bucket(rootBucket).CreateBucketIfNotExists(c.id.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	seq, err := b.NextSequence()
+	if err != nil {
+		return nil, err
+	}
+	if err := b.Put(entryKey(c.at, seq), value); err != nil {
+		return nil, err
+	}
+	return &lastEntry{presence: to, state: state}, nil
+}
+
+//Return last stored entry of device, read from file after restart. Nil if nothing is stored
+func (s *Store) lastEntry(tx *bolt.Tx, id uuid.UUID) (*lastEntry, error) {
+
+	if last, ok := s.last[id]; ok {
+		return last, nil
+	}
+
+	b := tx.Bucket(rootBucket).Bucket(id.Bytes())
+	if b == nil {
+		return nil, nil
+	}
+	_, v := b.Cursor().Last()
+	if v == nil {
+		return nil, nil
+	}
+	e, err := decodeEntry(v)
+	if err != nil {
+		return nil, err
+	}
+	last := &lastEntry{presence: e.To}
+	if e.Status != nil {
+		state, err := stateOf(e.Status)
+		if err != nil {
+			return nil, err
+		}
+		last.state = state
+	}
+	return last, nil
+}
+
+//Return fields of status which are stored when they are changed
+func stateOf(msg *model.ResponseMessage) ([]byte, error) {
+	return json.Marshal(statusState{
+		Online:         msg.Online,
+		Status:         msg.Status,
+		State:          msg.State,
+		Stale:          msg.IsStale(),
+		ExtendedStatus: msg.ExtendedStatus,
+	})
+}
+
+//Return changes of device in [from, to), oldest first, at most HistoryQueryLimit entries.
+//If there are more entries in period, next is time of first of them to continue query from
+func (s *Store) Query(id uuid.UUID, from, to time.Time) (entries []model.HistoryEntry, next *time.Time, err error) {
+
+	err = s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(rootBucket).Bucket(id.Bytes())
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		min, max := entryKey(from, 0), entryKey(to, 0)
+		for k, v := c.Seek(min); k != nil && bytes.Compare(k, max) < 0; k, v = c.Next() {
+			if len(entries) == s.limit {
+				t := time.Unix(0, int64(binary.BigEndian.Uint64(k))).UTC()
+				next = &t
+				break
+			}
+			e, err := decodeEntry(v)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	return entries, next, err
+}
+
+//Return all changes of device in [from, to) preceded by the last change before from, if it is stored,
+//so state of device is known from start of period. Oldest first
+func (s *Store) Timeline(id uuid.UUID, from, to time.Time) ([]model.HistoryEntry, error) {
+
+	var entries []model.HistoryEntry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(rootBucket).Bucket(id.Bytes())
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		min, max := entryKey(from, 0), entryKey(to, 0)
+
+		k, _ := c.Seek(min)
+		var prev []byte
+		if k == nil {
+			_, prev = c.Last()
+		} else {
+			_, prev = c.Prev()
+		}
+		if prev != nil {
+			e, err := decodeEntry(prev)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, e)
+		}
+
+		for k, v := c.Seek(min); k != nil && bytes.Compare(k, max) < 0; k, v = c.Next() {
+			e, err := decodeEntry(v)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	return entries, err
+}
+
+func decodeEntry(v []byte) (model.HistoryEntry, error) {
+	var e model.HistoryEntry
+	if err := json.Unmarshal(v, &e); err != nil {
+		return e, fmt.Errorf("broken history entry: %w", err)
+	}
+	return e, nil
+}
+
+//Delete entries older than retention and oldest entries above max entries of device
+func (s *Store) prune(now time.Time) {
+
+	if s.retention <= 0 && s.maxEntries <= 0 {
+		return
+	}
+
+	var deleted int
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(rootBucket)
+
+		//Buckets must not be deleted during ForEach
+		var ids [][]byte
+		if err := root.ForEach(func(id, _ []byte) error {
+			ids = append(ids, append([]byte{}, id...))
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			b := root.Bucket(id)
+			if b == nil {
+				continue
+			}
+
+			var keys [][]byte
+			count := b.Stats().KeyN
+			cutoff := entryKey(now.Add(-s.retention), 0)
+			c := b.Cursor()
+			for k, _ := c.First(); k != nil; k, _ = c.Next() {
+				expired := s.retention > 0 && bytes.Compare(k, cutoff) < 0
+				overflow := s.maxEntries > 0 && count-len(keys) > s.maxEntries
+				if !expired && !overflow {
+					break
+				}
+				keys = append(keys, append([]byte{}, k...))
+			}
+
+			for _, k := range keys {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+
+			deleted += len(keys)
+			if len(keys) == count {
+				if err := root.DeleteBucket(id); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		s.logger.Err(err).Msg("failed to prune history")
+		return
+	}
+	s.logger.Debug().Msgf("Pruned %d history entries", deleted)
+}
+
+//Time before epoch is stored as epoch
+func entryKey(at time.Time, seq uint64) []byte {
+	var ns uint64
+	if at.After(time.Unix(0, 0)) {
+		ns = uint64(at.UnixNano())
+	}
+	k := make([]byte, 16)
+	binary.BigEndian.PutUint64(k, ns)
+	binary.BigEndian.PutUint64(k[8:], seq)
+	return k
+}
@@ -0,0 +1,13 @@
+package model
+
+//Credentials of client, used to check access rights to devices
+type Credentials struct {
+	//Bearer token of user
+	Token string
+	//Identity from verified client certificate, used by service clients without token
+	Identity string
+}
+
+func (c Credentials) Empty() bool {
+	return c.Token == "" && c.Identity == ""
+}
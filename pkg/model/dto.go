@@ -2,6 +2,7 @@ package model
 
 import (
 	"encoding/json"
+	"time"
 
 	uuid "github.com/gofrs/uuid"
 )
@@ -9,25 +10,128 @@ import (
 type RequestMessage struct {
 	TypeReq string      `json:"type"`
 	Ids     []uuid.UUID `json:"ids"`
+	//Named groups of devices to subscribe in addition to ids
+	Groups []string `json:"groups,omitempty"`
+	//Period of history request, last day if empty
+	From *time.Time `json:"from,omitempty"`
+	To   *time.Time `json:"to,omitempty"`
+	//Last seen sequence number of device for resume request
+	Seqs map[string]uint64 `json:"seqs,omitempty"`
+	//Acceptable protocol versions in order of preference and requested features, for hello request
+	Versions []string  `json:"versions,omitempty"`
+	Features *Features `json:"features,omitempty"`
+	//Id of request returned in ack, if ack feature is negotiated
+	ReqId string `json:"reqId,omitempty"`
+}
+
+//Optional features of client protocol, negotiated by hello request
+type Features struct {
+	//Encoding of messages, only json now
+	Encoding string `json:"encoding,omitempty"`
+	//Status of device is sent as JSON merge patch (RFC 7386) of previous status of device
+	Deltas bool `json:"deltas,omitempty"`
+	//Messages are compressed and sent in binary frames, only gzip now
+	Compression string `json:"compression,omitempty"`
+	//Every request with reqId is acknowledged when it is accepted
+	Ack bool `json:"ack,omitempty"`
 }
 
 type ErrorResponseMessage struct {
-	TypeRes string  `json:"type"`
-	Reason  *string `json:"reason,omitempty"`
+	TypeRes    string  `json:"type"`
+	Reason     *string `json:"reason,omitempty"`
+	Retryable  bool    `json:"retryable,omitempty"`
+	RetryAfter int     `json:"retryAfter,omitempty"` //seconds
 }
 
 type ResponseMessage struct {
-	closeCode      int
-	TypeRes        string                `json:"type"`
-	Id             string                `json:"id"`
-	Online         *bool                 `json:"online,omitempty"`
-	ExtendedStatus *json.RawMessage      `json:"extendedStatus,omitempty"`
-	ErrorResp      *ErrorResponseMessage `json:"error,omitempty"`
+	closeError *Error
+	TypeRes    string `json:"type"`
+	Id         string `json:"id"`
+	//Group of summary, or group which failed to resolve for group-nack
+	Group string `json:"group,omitempty"`
+	//Sequence number of message of device, 0 for messages not routed from upstream
+	Seq    uint64 `json:"seq,omitempty"`
+	Online *bool  `json:"online,omitempty"`
+	//Raw status from upstream and its name from StatusStates, online is true for status > 0
+	Status         *int             `json:"status,omitempty"`
+	State          string           `json:"state,omitempty"`
+	Stale          *bool            `json:"stale,omitempty"`
+	ExtendedStatus *json.RawMessage `json:"extendedStatus,omitempty"`
+	//Time of receipt by aggregator, time reported by upstream if it is known, and id of upstream endpoint
+	ReceivedAt *time.Time `json:"receivedAt,omitempty"`
+	ReportedAt *time.Time `json:"reportedAt,omitempty"`
+	Endpoint   string     `json:"endpoint,omitempty"`
+	//Telemetry does not match schema of device type
+	InvalidTelemetry *bool                 `json:"invalidTelemetry,omitempty"`
+	ErrorResp        *ErrorResponseMessage `json:"error,omitempty"`
+	History          []HistoryEntry        `json:"history,omitempty"`
+	//Set if history is truncated by limit, request history from this time to get the rest
+	HistoryNext *time.Time       `json:"historyNext,omitempty"`
+	Stats       []StatsWindow    `json:"stats,omitempty"`
+	Summary     *PresenceSummary `json:"summary,omitempty"`
+	Alert       *Alert           `json:"alert,omitempty"`
+	//Negotiated protocol version and features, and supported versions, for hello
+	Version  string    `json:"version,omitempty"`
+	Versions []string  `json:"versions,omitempty"`
+	Features *Features `json:"features,omitempty"`
+	//Acknowledged or rejected request
+	ReqId   string `json:"reqId,omitempty"`
+	Request string `json:"request,omitempty"`
+}
+
+//Presence statistics of device for window until now. Durations are in seconds
+type StatsWindow struct {
+	Window string `json:"window"`
+	//Percent of time online while presence was known, omitted if it was unknown whole window
+	Availability *float64 `json:"availability,omitempty"`
+	Online       float64  `json:"online"`
+	Offline      float64  `json:"offline"`
+	Unknown      float64  `json:"unknown"`
+	//Transitions from online to offline
+	Disconnects int `json:"disconnects"`
+	//Mean time online between outages, omitted if there were no disconnects
+	MTBO *float64 `json:"mtbo,omitempty"`
+}
+
+//Count of devices by presence in group or whole subscription
+type PresenceSummary struct {
+	Total   int `json:"total"`
+	Online  int `json:"online"`
+	Offline int `json:"offline"`
+	Unknown int `json:"unknown"`
+}
+
+type AlertState string
+
+const (
+	AlertFiring   AlertState = "firing"
+	AlertResolved AlertState = "resolved"
+)
+
+//Alert of rule on status of device
+type Alert struct {
+	Rule     string     `json:"rule"`
+	State    AlertState `json:"state"`
+	Severity string     `json:"severity,omitempty"`
+	Expr     string     `json:"expr"`
+	//Condition of rule is true since
+	Since time.Time `json:"since"`
+	At    time.Time `json:"at"`
+}
+
+//Change of status of device stored in history, From and To are equal if presence is not changed
+type HistoryEntry struct {
+	At     time.Time        `json:"at"`
+	From   Presence         `json:"from"`
+	To     Presence         `json:"to"`
+	Status *ResponseMessage `json:"status,omitempty"`
 }
 
 type DeviceStatusFromDSN struct {
 	Status          int              `json:"status"`
 	DeviceTelemetry *json.RawMessage `json:"extendedStatus"`
+	//Time of status on device, if DSN reports it
+	ReportedAt *Timestamp `json:"reportedAt"`
 }
 
 type CloseMessage struct {
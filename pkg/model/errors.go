@@ -0,0 +1,129 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+//ErrorCode is stable identifier of error shown to client. Never change values of existing codes
+type ErrorCode string
+
+const (
+	//Device does not exist or client has no access to it
+	ErrorCodeNotFound ErrorCode = "NOT_FOUND"
+	//DSN refused to give status of device to aggregator
+	ErrorCodeForbidden ErrorCode = "FORBIDDEN"
+	//Device was deleted, there is no reason to subscribe again
+	ErrorCodeDeviceDeleted ErrorCode = "DEVICE_DELETED"
+	//DSN is overloaded, client may subscribe again after RetryAfter
+	ErrorCodeUpstreamOverloaded ErrorCode = "UPSTREAM_OVERLOADED"
+	//DSN or auth server is unreachable, aggregator keeps trying to reconnect
+	ErrorCodeUnavailable ErrorCode = "UNAVAILABLE"
+	//Client did not send token
+	ErrorCodeUnauthorized ErrorCode = "UNAUTHORIZED"
+	//Token of client is outdated, client must reconnect with new one
+	ErrorCodeTokenOutdated ErrorCode = "TOKEN_OUTDATED"
+	//Request of client is wrong or not supported by negotiated protocol
+	ErrorCodeBadRequest ErrorCode = "BAD_REQUEST"
+	//Any other error
+	ErrorCodeGeneric ErrorCode = "GENERIC"
+)
+
+type errorKind struct {
+	retryable  bool
+	retryAfter time.Duration
+	//Reason of error is safe to show to client
+	showReason bool
+	//Shown to client instead of reason which is not safe to show
+	reason string
+	//WebSocket close code, used when error closes client connection
+	closeCode int
+}
+
+var errorKinds = map[ErrorCode]errorKind{
+	ErrorCodeNotFound:           {retryable: false, closeCode: 4004},
+	ErrorCodeForbidden:          {retryable: false, closeCode: 4003},
+	ErrorCodeDeviceDeleted:      {retryable: false, showReason: true, closeCode: 4004},
+	ErrorCodeUpstreamOverloaded: {retryable: true, retryAfter: 30 * time.Second, showReason: true, closeCode: 1013},
+	ErrorCodeUnavailable:        {retryable: true, retryAfter: 5 * time.Second, closeCode: 1011},
+	ErrorCodeUnauthorized:       {retryable: false, showReason: true, closeCode: 4003},
+	ErrorCodeTokenOutdated:      {retryable: false, showReason: true, closeCode: 4001},
+	ErrorCodeBadRequest:         {retryable: false, showReason: true, closeCode: 1008},
+	ErrorCodeGeneric:            {retryable: true, reason: "internal error", closeCode: 1011},
+}
+
+//Close codes from DSN mapped to error codes. Everything else is GENERIC
+var dsnCloseCodes = map[uint16]ErrorCode{
+	4001: ErrorCodeNotFound,
+	4003: ErrorCodeNotFound,
+	4004: ErrorCodeNotFound,
+	1008: ErrorCodeForbidden,
+	4005: ErrorCodeForbidden,
+	4010: ErrorCodeDeviceDeleted,
+	1013: ErrorCodeUpstreamOverloaded,
+	4029: ErrorCodeUpstreamOverloaded,
+}
+
+type Error struct {
+	Code       ErrorCode
+	RetryAfter time.Duration
+	Err        error
+}
+
+//Make new error with default retry hints of code. err is internal cause, can be nil
+func NewError(code ErrorCode, err error) *Error {
+	if _, ok := errorKinds[code]; !ok {
+		code = ErrorCodeGeneric
+	}
+	return &Error{
+		Code:       code,
+		RetryAfter: errorKinds[code].retryAfter,
+		Err:        err,
+	}
+}
+
+//Make error from close code received from DSN
+func NewErrorFromDSNCloseCode(closeCode uint16, err error) *Error {
+	code, ok := dsnCloseCodes[closeCode]
+	if !ok {
+		code = ErrorCodeGeneric
+	}
+	return NewError(code, err)
+}
+
+//Return err if it is *Error or wrap it into GENERIC
+func AsError(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return NewError(ErrorCodeGeneric, err)
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return string(e.Code)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Retryable() bool {
+	return errorKinds[e.Code].retryable
+}
+
+//Return text which is safe to show to client, or empty string
+func (e *Error) Reason() string {
+	if kind := errorKinds[e.Code]; !kind.showReason || e.Err == nil {
+		return kind.reason
+	}
+	return e.Err.Error()
+}
+
+func (e *Error) CloseCode() int {
+	return errorKinds[e.Code].closeCode
+}
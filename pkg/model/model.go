@@ -1,7 +1,7 @@
 package model
 
 import (
-	"fmt"
+	"time"
 
 	uuid "github.com/gofrs/uuid"
 )
@@ -9,30 +9,58 @@ import (
 func (hnd *DeviceStatusFromDSN) ResponseMessage(id uuid.UUID) *ResponseMessage {
 
 	online := hnd.Status > 0
+	status := hnd.Status
+	receivedAt := time.Now().UTC()
 	responseMessage := ResponseMessage{
 		TypeRes:        "status",
 		Id:             id.String(),
 		Online:         &online,
+		Status:         &status,
 		ExtendedStatus: hnd.DeviceTelemetry,
+		ReceivedAt:     &receivedAt,
+	}
+	if hnd.ReportedAt != nil && !hnd.ReportedAt.IsZero() {
+		reportedAt := hnd.ReportedAt.UTC()
+		responseMessage.ReportedAt = &reportedAt
 	}
 
 	return &responseMessage
 }
 
-func NewErrorResponseMessage(codeError uint16, err error, id uuid.UUID) *ResponseMessage {
+//Synthetic status without online flag, sent when DSN is disconnected or silent
+func NewStaleResponseMessage(id uuid.UUID) *ResponseMessage {
+	stale := true
+	return &ResponseMessage{
+		TypeRes: "status",
+		Id:      id.String(),
+		Stale:   &stale,
+	}
+}
 
-	typeRes := "GENERIC"
+func (m *ResponseMessage) IsStale() bool {
+	return m.Stale != nil && *m.Stale
+}
 
-	if codeError == 4001 || codeError == 4003 {
-		typeRes = "NOT_FOUND"
-	}
+//Mark first status after stale one, so client knows that data resumed
+func (m *ResponseMessage) MarkRecovered() {
+	stale := false
+	m.Stale = &stale
+}
+
+//Make sub-nack from close code received from DSN
+func NewErrorResponseMessage(codeError uint16, err error, id uuid.UUID) *ResponseMessage {
+	return NewErrorResponseMessageFromError(NewErrorFromDSNCloseCode(codeError, err), id)
+}
+
+func NewErrorResponseMessageFromError(e *Error, id uuid.UUID) *ResponseMessage {
 
 	ErrorResp := ErrorResponseMessage{
-		TypeRes: typeRes,
+		TypeRes:    string(e.Code),
+		Retryable:  e.Retryable(),
+		RetryAfter: int(e.RetryAfter / time.Second),
 	}
-	if typeRes == "GENERIC" && err != nil {
-		errStr := err.Error()
-		ErrorResp.Reason = &errStr
+	if reason := e.Reason(); reason != "" {
+		ErrorResp.Reason = &reason
 	}
 	responseMessage := ResponseMessage{
 		TypeRes:   "sub-nack",
@@ -43,25 +71,101 @@ func NewErrorResponseMessage(codeError uint16, err error, id uuid.UUID) *Respons
 	return &responseMessage
 }
 
-func NewErrorResponseMessageNoAccess(err error, id uuid.UUID) *ResponseMessage {
-	return NewErrorResponseMessage(4003, err, id)
+//History is omitted if there are no changes in requested period, next is set if entries are truncated by limit
+func NewHistoryResponseMessage(id uuid.UUID, entries []HistoryEntry, next *time.Time) *ResponseMessage {
+	return &ResponseMessage{
+		TypeRes:     "history",
+		Id:          id.String(),
+		History:     entries,
+		HistoryNext: next,
+	}
+}
+
+func NewHistoryErrorResponseMessage(e *Error, id uuid.UUID) *ResponseMessage {
+	msg := NewErrorResponseMessageFromError(e, id)
+	msg.TypeRes = "history-nack"
+	return msg
 }
 
-func NewErrorResponseMessageInternalError(err error, id uuid.UUID) *ResponseMessage {
-	if err == nil {
-		err = fmt.Errorf("internal error")
+func NewStatsResponseMessage(id uuid.UUID, stats []StatsWindow) *ResponseMessage {
+	return &ResponseMessage{
+		TypeRes: "stats",
+		Id:      id.String(),
+		Stats:   stats,
 	}
-	return NewErrorResponseMessage(5000, err, id)
 }
 
-func NewErrorResponseMessageTokenOutdated() *ResponseMessage {
+func NewStatsErrorResponseMessage(e *Error, id uuid.UUID) *ResponseMessage {
+	msg := NewErrorResponseMessageFromError(e, id)
+	msg.TypeRes = "stats-nack"
+	return msg
+}
+
+//Summary of group, or of whole subscription if group is empty
+func NewSummaryResponseMessage(group string, summary PresenceSummary) *ResponseMessage {
+	return &ResponseMessage{
+		TypeRes: "summary",
+		Group:   group,
+		Summary: &summary,
+	}
+}
+
+func NewAlertResponseMessage(id uuid.UUID, alert Alert) *ResponseMessage {
+	return &ResponseMessage{
+		TypeRes: "alert",
+		Id:      id.String(),
+		Alert:   &alert,
+	}
+}
+
+//Reply to hello with negotiated protocol
+func NewHelloResponseMessage(version string, versions []string, features Features) *ResponseMessage {
+	return &ResponseMessage{
+		TypeRes:  "hello",
+		Version:  version,
+		Versions: versions,
+		Features: &features,
+	}
+}
+
+//Request is accepted, sent only if ack feature is negotiated
+func NewAckResponseMessage(reqId, request string) *ResponseMessage {
+	return &ResponseMessage{
+		TypeRes: "ack",
+		ReqId:   reqId,
+		Request: request,
+	}
+}
+
+//Request is rejected, typeRes is hello-nack or request-nack
+func NewRequestErrorResponseMessage(typeRes string, e *Error, reqId, request string) *ResponseMessage {
+	msg := NewErrorResponseMessageFromError(e, uuid.Nil)
+	msg.TypeRes = typeRes
+	msg.Id = ""
+	msg.ReqId = reqId
+	msg.Request = request
+	return msg
+}
+
+//Group could not be resolved, devices of group are not subscribed
+func NewGroupErrorResponseMessage(e *Error, group string) *ResponseMessage {
+	msg := NewErrorResponseMessageFromError(e, uuid.Nil)
+	msg.TypeRes = "group-nack"
+	msg.Id = ""
+	msg.Group = group
+	return msg
+}
+
+//Message is not sent to client, but closes its connection with code of e
+func NewCloseResponseMessage(e *Error) *ResponseMessage {
 	return &ResponseMessage{
-		closeCode: 4001,
+		closeError: e,
 	}
 }
 
-func (m *ResponseMessage) GetCloseCode() int {
-	return m.closeCode
+//Return nil if message should not close connection
+func (m *ResponseMessage) GetCloseError() *Error {
+	return m.closeError
 }
 
 func NewCloseMessage(code int, reason string) *CloseMessage {
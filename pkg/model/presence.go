@@ -0,0 +1,27 @@
+package model
+
+//Presence of device derived from status messages
+type Presence string
+
+const (
+	PresenceOnline  Presence = "online"
+	PresenceOffline Presence = "offline"
+	//Upstream is disconnected or silent, or nothing was received yet
+	PresenceUnknown Presence = "unknown"
+)
+
+//Return presence reported by status message, ok is false for other messages
+func (m *ResponseMessage) Presence() (p Presence, ok bool) {
+	switch {
+	case m.TypeRes != "status":
+		return "", false
+	case m.IsStale():
+		return PresenceUnknown, true
+	case m.Online == nil:
+		return PresenceUnknown, true
+	case *m.Online:
+		return PresenceOnline, true
+	default:
+		return PresenceOffline, true
+	}
+}
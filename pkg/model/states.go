@@ -0,0 +1,41 @@
+package model
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//Names of raw statuses of device, e.g. 0 is offline, 2 is sleeping
+type StatusStates map[int]string
+
+//Parse entries like "2:sleeping"
+func ParseStatusStates(entries []string) (StatusStates, error) {
+	states := make(StatusStates, len(entries))
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		parts := strings.SplitN(e, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("wrong status state %q, expected status:name", e)
+		}
+		status, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil {
+			return nil, fmt.Errorf("wrong status state %q: %w", e, err)
+		}
+		if _, ok := states[status]; ok {
+			return nil, fmt.Errorf("status %d is named twice", status)
+		}
+		states[status] = strings.TrimSpace(parts[1])
+	}
+	return states, nil
+}
+
+//Set name of raw status of message, state is empty if status has no name
+func (s StatusStates) Name(msg *ResponseMessage) {
+	if msg.Status != nil {
+		msg.State = s[*msg.Status]
+	}
+}
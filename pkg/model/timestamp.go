@@ -0,0 +1,37 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+)
+
+//Unix seconds or milliseconds above it
+const unixMillisThreshold = 1e12
+
+//Timestamp is decoded from RFC3339 string, unix seconds or unix milliseconds.
+//Wrong value is ignored and leaves zero time, so status is not lost because of it
+type Timestamp struct {
+	time.Time
+}
+
+func (t *Timestamp) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(data, []byte(`"`)) {
+		var s string
+		if err := json.Unmarshal(data, &s); err == nil {
+			t.Time, _ = time.Parse(time.RFC3339Nano, s)
+		}
+		return nil
+	}
+
+	var f float64
+	if err := json.Unmarshal(data, &f); err != nil || f <= 0 {
+		return nil
+	}
+	if f >= unixMillisThreshold {
+		t.Time = time.Unix(0, int64(f*float64(time.Millisecond)))
+	} else {
+		t.Time = time.Unix(0, int64(f*float64(time.Second)))
+	}
+	return nil
+}
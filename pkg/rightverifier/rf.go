@@ -9,6 +9,7 @@ import (
 
 	uuid "github.com/gofrs/uuid"
 	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/config"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/model"
 )
 
 const (
@@ -25,8 +26,9 @@ func NewRightVerifierHandler(env config.Environment) *RightVerifierHandler {
 	}
 }
 
-//return http code, 200 ok, 401 token outdated, 403 no access
-func (hnd *RightVerifierHandler) Validate(id uuid.UUID, token string) (int, error) {
+//return nil if access granted, otherwise *model.Error: TOKEN_OUTDATED on 401, NOT_FOUND on 403/404
+//Token is sent as bearer, identity from client certificate is sent in header RightVerifIdentityHeader
+func (hnd *RightVerifierHandler) Validate(id uuid.UUID, creds model.Credentials) error {
 
 	var (
 		u   *url.URL
@@ -36,7 +38,7 @@ func (hnd *RightVerifierHandler) Validate(id uuid.UUID, token string) (int, erro
 	rawUrl := fmt.Sprintf("%s%s", hnd.env.RightVerifURL, id.String())
 
 	if u, err = url.Parse(rawUrl); err != nil {
-		return 403, fmt.Errorf("rightVerifURL parse error: %w", err)
+		return model.NewError(model.ErrorCodeGeneric, fmt.Errorf("rightVerifURL parse error: %w", err))
 	}
 
 	client := http.Client{
@@ -46,7 +48,11 @@ func (hnd *RightVerifierHandler) Validate(id uuid.UUID, token string) (int, erro
 		},
 	}
 	header := make(http.Header)
-	header.Add("Authorization", "Bearer "+token)
+	if creds.Token != "" {
+		header.Add("Authorization", "Bearer "+creds.Token)
+	} else {
+		header.Add(hnd.env.RightVerifIdentityHeader, creds.Identity)
+	}
 	req := &http.Request{
 		Method: "GET",
 		URL:    u,
@@ -55,9 +61,18 @@ func (hnd *RightVerifierHandler) Validate(id uuid.UUID, token string) (int, erro
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return 403, fmt.Errorf("cant connect to validate access right: %s : %w", id.String(), err)
+		return model.NewError(model.ErrorCodeUnavailable, fmt.Errorf("cant connect to validate access right: %s : %w", id.String(), err))
 	}
 	defer resp.Body.Close()
 
-	return resp.StatusCode, nil
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized:
+		return model.NewError(model.ErrorCodeTokenOutdated, fmt.Errorf("token outdated"))
+	case http.StatusForbidden, http.StatusNotFound:
+		return model.NewError(model.ErrorCodeNotFound, fmt.Errorf("access denied: %d", resp.StatusCode))
+	default:
+		return model.NewError(model.ErrorCodeGeneric, fmt.Errorf("unknown status code from auth server: %d", resp.StatusCode))
+	}
 }
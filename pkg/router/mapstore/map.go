@@ -1,7 +1,9 @@
 package mapstore
 
 import (
+	"container/list"
 	"context"
+	"sort"
 	"sync"
 
 	uuid "github.com/gofrs/uuid"
@@ -15,18 +17,53 @@ type Store struct {
 	sync.Mutex
 	idList map[uuid.UUID]*ItemStore
 	isStop bool
+	//Last presence of device, kept after route is stopped so new route continues from last known state
+	presences map[uuid.UUID]model.Presence
+	//Last sequence number of device, kept after route is stopped so sequence does not go back
+	seqs map[uuid.UUID]uint64
+	//Devices without route which still have presence and sequence number, most recently stopped first
+	stopped    *list.List
+	stoppedIdx map[uuid.UUID]*list.Element
+	stoppedCap int
 }
 
-func NewStore() *Store {
+//stoppedCap is count of devices without route whose presence and sequence number are kept, 0 for no limit.
+//Device forgotten above the limit starts sequence from 1 on its next route, so clients resuming with older
+//sequence number get only last message, and its first presence is observed as initial one
+func NewStore(stoppedCap int) *Store {
 	return &Store{
-		idList: make(map[uuid.UUID]*ItemStore),
-		isStop: false,
+		idList:     make(map[uuid.UUID]*ItemStore),
+		isStop:     false,
+		presences:  make(map[uuid.UUID]model.Presence),
+		seqs:       make(map[uuid.UUID]uint64),
+		stopped:    list.New(),
+		stoppedIdx: make(map[uuid.UUID]*list.Element),
+		stoppedCap: stoppedCap,
 	}
 }
 
+//Needed to call PreFlight() before. ok is false if presence of device was never observed
+func (s *Store) LastPresence(id uuid.UUID) (p model.Presence, ok bool) {
+	p, ok = s.presences[id]
+	return p, ok
+}
+
+//Needed to call PreFlight() before
+func (s *Store) SetPresence(id uuid.UUID, p model.Presence) {
+	s.presences[id] = p
+}
+
+//Needed to call PreFlight() before
+func (s *Store) NextSeq(id uuid.UUID) uint64 {
+	s.seqs[id]++
+	return s.seqs[id]
+}
+
 //Return true if item exist, or false if new item was created.
 //Return r *ItemStore == nil if GetAllWorkerCancelArray() was called and we going to die ;(
-func (s *Store) GetOrCreate(id uuid.UUID, newItemStore *ItemStore, respMessagechan *chan *model.ResponseMessage, ctx context.Context) (r *ItemStore, exist bool) {
+//resumeFrom is last sequence number seen by aggregator, 0 if it needs only last message.
+//creds of aggregator may be used by worker to connect to upstream
+func (s *Store) GetOrCreate(id uuid.UUID, newItemStore *ItemStore, respMessagechan *chan *model.ResponseMessage, resumeFrom uint64, creds model.Credentials, ctx context.Context) (r *ItemStore, exist bool) {
 	s.Lock()
 	defer s.Unlock()
 
@@ -35,22 +72,43 @@ func (s *Store) GetOrCreate(id uuid.UUID, newItemStore *ItemStore, respMessagech
 	}
 
 	if r, exist = s.idList[id]; !exist {
+		if e, ok := s.stoppedIdx[id]; ok {
+			s.stopped.Remove(e)
+			delete(s.stoppedIdx, id)
+		}
 		newItemStore.store = s
-		newItemStore.itemsAggregatorArray = append(newItemStore.itemsAggregatorArray, *NewItemAggregatorArray(respMessagechan, ctx))
+		newItemStore.itemsAggregatorArray = append(newItemStore.itemsAggregatorArray, *NewItemAggregatorArray(respMessagechan, resumeFrom, creds, ctx))
 		s.idList[id] = newItemStore
+		newItemStore.watchAggregator(ctx)
 		return newItemStore, exist
 
 	} else {
-		r.itemsAggregatorArray = append(r.itemsAggregatorArray, *NewItemAggregatorArray(respMessagechan, ctx))
+		r.itemsAggregatorArray = append(r.itemsAggregatorArray, *NewItemAggregatorArray(respMessagechan, resumeFrom, creds, ctx))
+		r.watchAggregator(ctx)
+		r.notifyChanged()
 		return r, exist
 	}
 
 }
 
-//Make Unlock on ItemStore before delete. Needed to Lock Store before call Delete()
+//Needed to call PreFlight() before. Return nil if device is not routed
+func (s *Store) Get(id uuid.UUID) *ItemStore {
+	return s.idList[id]
+}
+
+//Make Unlock on ItemStore before delete. Needed to Lock Store before call Delete().
+//Presence and sequence number of device are kept until it is the oldest stopped one above the limit
 func (s *Store) Delete(id uuid.UUID) {
 	defer s.Unlock()
 	delete(s.idList, id)
+
+	s.stoppedIdx[id] = s.stopped.PushFront(id)
+	for s.stoppedCap > 0 && s.stopped.Len() > s.stoppedCap {
+		forgotten := s.stopped.Remove(s.stopped.Back()).(uuid.UUID)
+		delete(s.stoppedIdx, forgotten)
+		delete(s.presences, forgotten)
+		delete(s.seqs, forgotten)
+	}
 }
 
 //Calling this function is block Store on forever. Need shutdown service after this
@@ -77,40 +135,212 @@ func (s *Store) AfterFlight() {
 
 type ItemStore struct {
 	itemsAggregatorArray []itemAggregatorArray
-	Worker               *worker.RequesterStatusHandler
+	Worker               worker.Source
 	WorkerChan           chan *model.ResponseMessage
 	workerCancel         context.CancelFunc
-	store                *Store
+	changedChan          chan struct{}
+	//Last routed messages, oldest first. Used to resume aggregators
+	ring     []*model.ResponseMessage
+	ringSize int
+	store    *Store
+	//Credentials given to worker for the last connection to upstream
+	upstreamCreds  model.Credentials
+	upstreamPicked bool
+	//Firing alerts of device by rule, sent to new aggregators after last messages
+	alerts map[string]*model.ResponseMessage
 }
 
-func NewItemStore(worker *worker.RequesterStatusHandler, workerCancel context.CancelFunc) *ItemStore {
+//ringSize is count of last messages kept to resume aggregators, at least 1
+func NewItemStore(worker worker.Source, workerCancel context.CancelFunc, ringSize int) *ItemStore {
+	if ringSize < 1 {
+		ringSize = 1
+	}
 	return &ItemStore{
 		itemsAggregatorArray: []itemAggregatorArray{},
 		Worker:               worker,
 		WorkerChan:           make(chan *model.ResponseMessage, 5),
 		workerCancel:         workerCancel,
+		changedChan:          make(chan struct{}, 1),
+		ring:                 make([]*model.ResponseMessage, 0, ringSize),
+		ringSize:             ringSize,
+		alerts:               make(map[string]*model.ResponseMessage),
 	}
 }
 
+//Aggregator subscribed to route. Messages are sent to Chan without lock of Store, until Ctx is done
+type Aggregator struct {
+	Chan *chan *model.ResponseMessage
+	Ctx  context.Context
+}
+
 //Needed to call PreFlight() before and Unlock with AfterFlight() or Delete().
-//Return array of chan only with open status. Chan with "closed"/true status will be deleted
-func (i *ItemStore) GetAggregatorChanArray() []*chan *model.ResponseMessage {
+//Return array of aggregators only with open status. Aggregators with "closed"/true status will be deleted.
+//All returned aggregators are considered as served with next routed message
+func (i *ItemStore) GetAggregatorArray() []Aggregator {
 
 	var (
-		aggregatorChanArray     []*chan *model.ResponseMessage
+		aggregatorArray         []Aggregator
 		newItemsAggregatorArray []itemAggregatorArray
 	)
 
 	for _, v := range i.itemsAggregatorArray {
 		if ch, closed := v.GetAggregatorChan(); !closed {
-			aggregatorChanArray = append(aggregatorChanArray, ch)
+			v.fresh = false
+			aggregatorArray = append(aggregatorArray, Aggregator{Chan: ch, Ctx: v.ctx})
 			newItemsAggregatorArray = append(newItemsAggregatorArray, v)
 		}
 	}
 
 	i.itemsAggregatorArray = newItemsAggregatorArray
 
-	return aggregatorChanArray
+	return aggregatorArray
+}
+
+//Needed to call PreFlight() before.
+//Return open aggregators which already got routed messages, aggregators are not changed
+func (i *ItemStore) PeekAggregatorArray() []Aggregator {
+
+	var r []Aggregator
+
+	for _, v := range i.itemsAggregatorArray {
+		if ch, closed := v.GetAggregatorChan(); !closed && !v.fresh {
+			r = append(r, Aggregator{Chan: ch, Ctx: v.ctx})
+		}
+	}
+
+	return r
+}
+
+//Aggregator subscribed after the last routed message
+type NewAggregator struct {
+	Aggregator
+	ResumeFrom uint64
+}
+
+//Needed to call PreFlight() before.
+//Return open aggregators subscribed after the last routed message and mark them as served
+func (i *ItemStore) PopNewAggregatorArray() []NewAggregator {
+
+	var r []NewAggregator
+
+	for k, v := range i.itemsAggregatorArray {
+		if ch, closed := v.GetAggregatorChan(); !closed && v.fresh {
+			r = append(r, NewAggregator{Aggregator: Aggregator{Chan: ch, Ctx: v.ctx}, ResumeFrom: v.resumeFrom})
+			i.itemsAggregatorArray[k].fresh = false
+		}
+	}
+
+	return r
+}
+
+//Needed to call PreFlight() before
+func (i *ItemStore) SetLastMessage(msg *model.ResponseMessage) {
+	if len(i.ring) == i.ringSize {
+		copy(i.ring, i.ring[1:])
+		i.ring = i.ring[:len(i.ring)-1]
+	}
+	i.ring = append(i.ring, msg)
+}
+
+//Needed to call PreFlight() before. Return nil if nothing was received from worker yet
+func (i *ItemStore) GetLastMessage() *model.ResponseMessage {
+	if len(i.ring) == 0 {
+		return nil
+	}
+	return i.ring[len(i.ring)-1]
+}
+
+//Needed to call PreFlight() before. Return copy of messages after seq if they are all kept,
+//otherwise only last message, so aggregator sees the gap in sequence
+func (i *ItemStore) GetMessagesSince(seq uint64) []*model.ResponseMessage {
+	if len(i.ring) == 0 {
+		return nil
+	}
+	//Messages are dropped from ring, or seq is from before restart of aggregator
+	if i.ring[0].Seq > seq+1 || i.ring[len(i.ring)-1].Seq < seq {
+		return []*model.ResponseMessage{i.ring[len(i.ring)-1]}
+	}
+	for k, msg := range i.ring {
+		if msg.Seq > seq {
+			return append([]*model.ResponseMessage(nil), i.ring[k:]...)
+		}
+	}
+	return nil
+}
+
+//Needed to call PreFlight() before. Remember firing alert, forget it when it is resolved
+func (i *ItemStore) SetAlert(msg *model.ResponseMessage) {
+	if msg.Alert.State == model.AlertFiring {
+		i.alerts[msg.Alert.Rule] = msg
+		return
+	}
+	delete(i.alerts, msg.Alert.Rule)
+}
+
+//Needed to call PreFlight() before. Return firing alerts ordered by rule
+func (i *ItemStore) GetAlerts() []*model.ResponseMessage {
+	r := make([]*model.ResponseMessage, 0, len(i.alerts))
+	for _, msg := range i.alerts {
+		r = append(r, msg)
+	}
+	sort.Slice(r, func(a, b int) bool { return r[a].Alert.Rule < r[b].Alert.Rule })
+	return r
+}
+
+//Receive signal when aggregator was added or ctx of any aggregator is done
+func (i *ItemStore) ChangedChan() <-chan struct{} {
+	return i.changedChan
+}
+
+func (i *ItemStore) notifyChanged() {
+	select {
+	case i.changedChan <- struct{}{}:
+	default:
+	}
+}
+
+func (i *ItemStore) watchAggregator(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		i.notifyChanged()
+	}()
+}
+
+//Needed to call PreFlight() before.
+//Return credentials of open aggregator for connection to upstream, preferring one with token.
+//Empty credentials are returned if there is no open aggregator
+func (i *ItemStore) PickCredentials() model.Credentials {
+	i.upstreamCreds, i.upstreamPicked = model.Credentials{}, true
+	for _, v := range i.itemsAggregatorArray {
+		if _, closed := v.GetAggregatorChan(); closed {
+			continue
+		}
+		if v.creds.Token != "" {
+			i.upstreamCreds = v.creds
+			break
+		}
+		if i.upstreamCreds.Empty() {
+			i.upstreamCreds = v.creds
+		}
+	}
+	return i.upstreamCreds
+}
+
+//Needed to call PreFlight() before.
+//Return true if credentials used for the last connection to upstream are not of open aggregator anymore,
+//or they have no token while some open aggregator has it
+func (i *ItemStore) UpstreamCredentialsOutdated() bool {
+	if !i.upstreamPicked {
+		return false
+	}
+	var owned, token bool
+	for _, v := range i.itemsAggregatorArray {
+		if _, closed := v.GetAggregatorChan(); !closed {
+			owned = owned || v.creds == i.upstreamCreds
+			token = token || v.creds.Token != ""
+		}
+	}
+	return !owned || (i.upstreamCreds.Token == "" && token)
 }
 
 func (i *ItemStore) GetWorkerCancel() context.CancelFunc {
@@ -120,12 +350,18 @@ func (i *ItemStore) GetWorkerCancel() context.CancelFunc {
 type itemAggregatorArray struct {
 	aggregatorChan *chan *model.ResponseMessage
 	ctx            context.Context
+	fresh          bool
+	resumeFrom     uint64
+	creds          model.Credentials
 }
 
-func NewItemAggregatorArray(aggregatorChan *chan *model.ResponseMessage, ctx context.Context) *itemAggregatorArray {
+func NewItemAggregatorArray(aggregatorChan *chan *model.ResponseMessage, resumeFrom uint64, creds model.Credentials, ctx context.Context) *itemAggregatorArray {
 	return &itemAggregatorArray{
 		aggregatorChan: aggregatorChan,
 		ctx:            ctx,
+		fresh:          true,
+		resumeFrom:     resumeFrom,
+		creds:          creds,
 	}
 }
 
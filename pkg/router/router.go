@@ -2,13 +2,17 @@ package router
 
 import (
 	"context"
+	"fmt"
+	"time"
 
 	uuid "github.com/gofrs/uuid"
 	"github.com/rs/zerolog"
 	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/config"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/groups"
 	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/model"
 	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/rightverifier"
 	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/router/mapstore"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/transform"
 	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/worker"
 )
 
@@ -17,32 +21,111 @@ type RouterHandler struct {
 	logger        *zerolog.Logger
 	env           config.Environment
 	rightVerifier *rightverifier.RightVerifierHandler
+	sources       worker.SourceFactory
+	observers     []TransitionObserver
+	msgObservers  []MessageObserver
+	groups        groups.Provider
+	transforms    *transform.Pipeline
+	states        model.StatusStates
 }
 
-func NewRouterHandler(logger *zerolog.Logger, env config.Environment) *RouterHandler {
+//Change of device presence observed by route
+type Transition struct {
+	Id      uuid.UUID
+	From    model.Presence
+	To      model.Presence
+	At      time.Time
+	Message *model.ResponseMessage
+	//First presence of device observed since start of aggregator, From is unknown
+	Initial bool
+}
+
+//TransitionObserver is notified from route goroutine, so it must not block
+type TransitionObserver interface {
+	OnTransition(t Transition)
+}
+
+//MessageObserver is notified about every message routed to subscribers of device, from route goroutine, so it must not block
+type MessageObserver interface {
+	OnMessage(id uuid.UUID, msg *model.ResponseMessage)
+}
+
+//RouteObserver is optionally implemented by TransitionObserver or MessageObserver to know that presence of device is not observed anymore
+type RouteObserver interface {
+	OnRouteStopped(id uuid.UUID)
+}
+
+func NewRouterHandler(logger *zerolog.Logger, env config.Environment) (*RouterHandler, error) {
+
+	sources, err := worker.NewSourceFactory(env, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	groupProvider, err := groups.NewProvider(env)
+	if err != nil {
+		return nil, err
+	}
+
+	transforms, err := transform.NewPipeline(env)
+	if err != nil {
+		return nil, err
+	}
+
+	states, err := model.ParseStatusStates(env.StatusStates)
+	if err != nil {
+		return nil, err
+	}
 
 	routerHandler := RouterHandler{
-		idList:        mapstore.NewStore(),
+		idList:        mapstore.NewStore(env.StoppedRoutesCap),
 		logger:        logger,
 		env:           env,
 		rightVerifier: rightverifier.NewRightVerifierHandler(env),
+		sources:       sources,
+		groups:        groupProvider,
+		transforms:    transforms,
+		states:        states,
 	}
 
-	return &routerHandler
+	return &routerHandler, nil
+}
+
+//Must be called before first subscription
+func (hnd *RouterHandler) AddTransitionObserver(o TransitionObserver) {
+	hnd.observers = append(hnd.observers, o)
 }
 
-func (hnd *RouterHandler) AddIds(ids []uuid.UUID, respMessagechan *chan *model.ResponseMessage, token string, ctxAggregator context.Context) {
+//Must be called before first subscription
+func (hnd *RouterHandler) AddMessageObserver(o MessageObserver) {
+	hnd.msgObservers = append(hnd.msgObservers, o)
+}
+
+func (hnd *RouterHandler) AddIds(ids []uuid.UUID, respMessagechan *chan *model.ResponseMessage, creds model.Credentials, ctxAggregator context.Context) {
+	hnd.ResumeIds(ids, nil, respMessagechan, creds, ctxAggregator)
+}
+
+//Subscribe like AddIds, but aggregator gets messages missed after its last seen sequence number of device
+//instead of only last message, if they are still kept by route
+func (hnd *RouterHandler) ResumeIds(ids []uuid.UUID, seqs map[uuid.UUID]uint64, respMessagechan *chan *model.ResponseMessage, creds model.Credentials, ctxAggregator context.Context) {
 
 	for _, id := range ids {
 
-		if !hnd.checkPermit(id, respMessagechan, token) {
+		if !hnd.checkPermit(id, mapstore.Aggregator{Chan: respMessagechan, Ctx: ctxAggregator}, creds) {
 			continue
 		}
 		ctx, cancelFunc := context.WithCancel(context.Background())
 
-		newListItem := mapstore.NewItemStore(worker.NewRequesterStatusHandler(id, hnd.env, hnd.logger), cancelFunc)
+		//Worker connects to upstream with credentials of current subscribers, not only of this one
+		var newListItem *mapstore.ItemStore
+		upstreamCreds := func() model.Credentials {
+			hnd.idList.PreFlight()
+			defer hnd.idList.AfterFlight()
+			return newListItem.PickCredentials()
+		}
+		newListItem = mapstore.NewItemStore(hnd.sources.NewSource(id, upstreamCreds, hnd.logger), cancelFunc, hnd.env.ResumeBufferSize)
 
-		listItem, exist := hnd.idList.GetOrCreate(id, newListItem, respMessagechan, ctxAggregator)
+		listItem, exist := hnd.idList.GetOrCreate(id, newListItem, respMessagechan, seqs[id], creds, ctxAggregator)
 
 		if listItem == nil {
 			cancelFunc()
@@ -63,30 +146,125 @@ func (hnd *RouterHandler) AddIds(ids []uuid.UUID, respMessagechan *chan *model.R
 
 func (hnd *RouterHandler) startRoute(ctx context.Context, id uuid.UUID, listItem *mapstore.ItemStore) {
 	go func() {
+		//Not nil while route has no subscribers and waiting to be stopped
+		var lingerChan <-chan time.Time
+
+		//Fires when nothing was received from DSN during staleness window. Nil if disabled
+		var (
+			staleChan    <-chan time.Time
+			stale        bool
+			staleTimeout = time.Duration(hnd.env.StaleTimeout) * time.Second
+			staleTimer   = time.NewTimer(staleTimeout)
+		)
+		defer staleTimer.Stop()
+		if staleTimeout > 0 {
+			staleChan = staleTimer.C
+		}
+
 	loop:
 		for {
 			select {
 			case msg := <-listItem.WorkerChan:
 
-				hnd.idList.PreFlight()
-				aggregatorChanArray := listItem.GetAggregatorChanArray()
+				switch {
+				case msg.IsStale():
+					if stale {
+						continue loop
+					}
+					hnd.logger.Debug().Msgf("DSN disconnected, status is stale for id: %s ", id.String())
+					stale = true
+				case msg.TypeRes == "status":
+					hnd.states.Name(msg)
+					if err := hnd.transforms.Apply(id, msg); err != nil {
+						hnd.logger.Err(err).Msgf("Failed to transform extendedStatus for id: %s ", id.String())
+					}
+					if staleChan != nil {
+						resetTimer(staleTimer, staleTimeout)
+					}
+					if stale {
+						hnd.logger.Debug().Msgf("Status recovered for id: %s ", id.String())
+						msg.MarkRecovered()
+						stale = false
+					}
+				}
 
-				if len(aggregatorChanArray) == 0 {
-					hnd.logger.Debug().Msgf("Stop route for id: %s ", id.String())
-					listItem.GetWorkerCancel()()
-					hnd.idList.Delete(id)
-					break loop
+				subscribers := hnd.routeMessage(id, listItem, msg)
+				hnd.observe(id, msg)
+				if subscribers == 0 && lingerChan == nil {
+					lingerChan = hnd.startLinger(id)
 				}
+				continue loop
 
-				for _, ch := range aggregatorChanArray {
-					*ch <- msg
-					hnd.logger.Debug().Msgf("Route for id: %s ", id.String())
+			case <-staleChan:
+
+				if stale {
+					continue loop
+				}
+				hnd.logger.Debug().Msgf("No updates from DSN during %s, status is stale for id: %s ", staleTimeout, id.String())
+				stale = true
+				msg := model.NewStaleResponseMessage(id)
+				receivedAt := time.Now().UTC()
+				msg.ReceivedAt = &receivedAt
+				//Endpoint which went silent is the one of last status
+				hnd.idList.PreFlight()
+				if last := listItem.GetLastMessage(); last != nil {
+					msg.Endpoint = last.Endpoint
+				}
+				hnd.idList.AfterFlight()
+				subscribers := hnd.routeMessage(id, listItem, msg)
+				hnd.observe(id, msg)
+				if subscribers == 0 && lingerChan == nil {
+					lingerChan = hnd.startLinger(id)
 				}
+				continue loop
+
+			case <-listItem.ChangedChan():
 
+				hnd.idList.PreFlight()
+				replays := hnd.popReplays(listItem)
+				subscribers := len(listItem.GetAggregatorArray())
+				reconnect := subscribers > 0 && hnd.env.DSNAuthMode == worker.DSNAuthForward && listItem.UpstreamCredentialsOutdated()
 				hnd.idList.AfterFlight()
+
+				//Last message was received with outdated credentials, new subscribers get the next one
+				if reconnect {
+					replays = nil
+				}
+				hnd.sendReplays(id, replays)
+
+				//Forwarded token must be of current subscriber, not of one who left
+				if r, ok := listItem.Worker.(worker.Reconnector); ok && reconnect {
+					hnd.logger.Debug().Msgf("Upstream credentials are outdated, reconnect for id: %s ", id.String())
+					r.Reconnect()
+				}
+
+				switch {
+				case subscribers == 0 && lingerChan == nil:
+					lingerChan = hnd.startLinger(id)
+				case subscribers > 0 && lingerChan != nil:
+					hnd.logger.Debug().Msgf("Route for id: %s got new subscriber, linger canceled", id.String())
+					lingerChan = nil
+				}
 				continue loop
+
+			case <-lingerChan:
+
+				hnd.idList.PreFlight()
+				if len(listItem.GetAggregatorArray()) != 0 {
+					hnd.idList.AfterFlight()
+					lingerChan = nil
+					continue loop
+				}
+
+				hnd.logger.Debug().Msgf("Stop route for id: %s ", id.String())
+				listItem.GetWorkerCancel()()
+				hnd.idList.Delete(id)
+				hnd.notifyRouteStopped(id)
+				break loop
+
 			case <-ctx.Done():
 				hnd.logger.Debug().Msgf("Stop route goroutine for id: %s , because ctx.Done()", id.String())
+				hnd.notifyRouteStopped(id)
 				break loop
 			}
 		}
@@ -94,31 +272,190 @@ func (hnd *RouterHandler) startRoute(ctx context.Context, id uuid.UUID, listItem
 	}()
 }
 
-func (hnd *RouterHandler) checkPermit(id uuid.UUID, respMessagechan *chan *model.ResponseMessage, token string) bool {
+//Send msg to aggregator, message is dropped when aggregator is unsubscribed.
+//Must be called without lock of Store, slow aggregator blocks only its route
+func send(a mapstore.Aggregator, msg *model.ResponseMessage) {
+	select {
+	case *a.Chan <- msg:
+	case <-a.Ctx.Done():
+	}
+}
+
+//Assign sequence number to msg, send it to all subscribers of route and remember it as last message.
+//msg must not be changed after that. Return count of subscribers
+func (hnd *RouterHandler) routeMessage(id uuid.UUID, listItem *mapstore.ItemStore, msg *model.ResponseMessage) int {
 
-	code, err := hnd.rightVerifier.Validate(id, token)
+	hnd.idList.PreFlight()
+	//New subscribers must get missed messages before this one
+	replays := hnd.popReplays(listItem)
+	msg.Seq = hnd.idList.NextSeq(id)
+	listItem.SetLastMessage(msg)
+	aggregatorArray := listItem.GetAggregatorArray()
+	hnd.idList.AfterFlight()
 
-	switch code {
+	hnd.sendReplays(id, replays)
+	for _, a := range aggregatorArray {
+		send(a, msg)
+		hnd.logger.Debug().Msgf("Route for id: %s ", id.String())
+	}
+
+	return len(aggregatorArray)
+}
+
+//Messages sent to new subscriber before routed ones
+type replay struct {
+	aggregator mapstore.Aggregator
+	msgs       []*model.ResponseMessage
+}
+
+//Needed to call PreFlight() before. Return last message, or messages missed since resume sequence, for new subscribers.
+//Firing alerts of device follow them. Nothing is returned before the first message, new subscribers get it as routed one
+func (hnd *RouterHandler) popReplays(listItem *mapstore.ItemStore) []replay {
+
+	last := listItem.GetLastMessage()
+	if last == nil {
+		return nil
+	}
+	var replays []replay
+	for _, a := range listItem.PopNewAggregatorArray() {
+		msgs := []*model.ResponseMessage{last}
+		if a.ResumeFrom != 0 {
+			msgs = listItem.GetMessagesSince(a.ResumeFrom)
+		}
+		msgs = append(msgs, listItem.GetAlerts()...)
+		replays = append(replays, replay{aggregator: a.Aggregator, msgs: msgs})
+	}
+	return replays
+}
 
-	case 200:
+//Must be called without lock of Store
+func (hnd *RouterHandler) sendReplays(id uuid.UUID, replays []replay) {
+	for _, r := range replays {
+		for _, msg := range r.msgs {
+			send(r.aggregator, msg)
+		}
+		hnd.logger.Debug().Msgf("Route %d last messages for id: %s ", len(r.msgs), id.String())
+	}
+}
+
+//Notify observers if msg changes presence of device.
+//Presence is compared with last known one, also observed by previous routes of device
+func (hnd *RouterHandler) observe(id uuid.UUID, msg *model.ResponseMessage) {
+
+	for _, o := range hnd.msgObservers {
+		o.OnMessage(id, msg)
+	}
+
+	to, ok := msg.Presence()
+	if !ok {
+		return
+	}
+	hnd.idList.PreFlight()
+	from, known := hnd.idList.LastPresence(id)
+	hnd.idList.SetPresence(id, to)
+	hnd.idList.AfterFlight()
+	if !known {
+		from = model.PresenceUnknown
+	}
+	if from == to {
+		return
+	}
+	t := Transition{Id: id, From: from, To: to, At: time.Now(), Message: msg, Initial: !known}
+
+	for _, o := range hnd.observers {
+		o.OnTransition(t)
+	}
+}
+
+func (hnd *RouterHandler) notifyRouteStopped(id uuid.UUID) {
+	for _, o := range hnd.observers {
+		if ro, ok := o.(RouteObserver); ok {
+			ro.OnRouteStopped(id)
+		}
+	}
+	for _, o := range hnd.msgObservers {
+		if ro, ok := o.(RouteObserver); ok {
+			ro.OnRouteStopped(id)
+		}
+	}
+}
+
+//Send msg to current subscribers of device without sequence number. Only firing alerts are replayed to new subscribers,
+//until they are resolved or route of device is stopped. Like routed messages, msg is sent without lock of Store until subscriber is unsubscribed
+func (hnd *RouterHandler) Notify(id uuid.UUID, msg *model.ResponseMessage) {
+
+	hnd.idList.PreFlight()
+	var aggregatorArray []mapstore.Aggregator
+	if listItem := hnd.idList.Get(id); listItem != nil {
+		if msg.Alert != nil {
+			listItem.SetAlert(msg)
+		}
+		aggregatorArray = listItem.PeekAggregatorArray()
+	}
+	hnd.idList.AfterFlight()
+
+	for _, a := range aggregatorArray {
+		send(a, msg)
+	}
+	hnd.logger.Debug().Msgf("Notify %s for id: %s ", msg.TypeRes, id.String())
+}
+
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
+//Return chan which fires when route without subscribers should be stopped
+func (hnd *RouterHandler) startLinger(id uuid.UUID) <-chan time.Time {
+	linger := time.Duration(hnd.env.RouteLinger) * time.Second
+	if linger < 0 {
+		linger = 0
+	}
+	hnd.logger.Debug().Msgf("Route for id: %s has no subscribers, will stop in %s", id.String(), linger)
+	return time.After(linger)
+}
+
+func (hnd *RouterHandler) checkPermit(id uuid.UUID, aggregator mapstore.Aggregator, creds model.Credentials) bool {
+
+	err := hnd.rightVerifier.Validate(id, creds)
+	if err == nil {
 		return true
-	case 401:
-		*respMessagechan <- model.NewErrorResponseMessageTokenOutdated()
-		hnd.logger.Err(err).Msgf("Token outdated: %s ", id.String())
-	case 403:
-		*respMessagechan <- model.NewErrorResponseMessageNoAccess(err, id)
-		hnd.logger.Err(err).Msgf("Access denied: %s ", id.String())
-	default:
-		*respMessagechan <- model.NewErrorResponseMessageInternalError(err, id)
-		hnd.logger.Err(err).Msgf("Unknown status code from auth server: %d", code)
 	}
 
+	e := model.AsError(err)
+	if e.Code == model.ErrorCodeTokenOutdated {
+		send(aggregator, model.NewCloseResponseMessage(e))
+	} else {
+		send(aggregator, model.NewErrorResponseMessageFromError(e, id))
+	}
+	hnd.logger.Err(err).Msgf("Access check failed: %s ", id.String())
+
 	return false
 }
 
+//Return nil if client has access to device, otherwise *model.Error
+func (hnd *RouterHandler) Authorize(id uuid.UUID, creds model.Credentials) error {
+	return hnd.rightVerifier.Validate(id, creds)
+}
+
+//Return current members of group visible with creds, otherwise *model.Error.
+//Access to every member is checked on subscription
+func (hnd *RouterHandler) ResolveGroup(name string, creds model.Credentials) ([]uuid.UUID, error) {
+	if hnd.groups == nil {
+		return nil, model.NewError(model.ErrorCodeNotFound, fmt.Errorf("groups are disabled"))
+	}
+	return hnd.groups.Members(name, creds)
+}
+
 func (hnd *RouterHandler) Stop() {
 	hnd.logger.Debug().Msg("Stop router")
 	for _, workerCancel := range hnd.idList.GetAllWorkerCancelArray() {
 		workerCancel()
 	}
+	hnd.sources.Close()
 }
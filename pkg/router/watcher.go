@@ -0,0 +1,125 @@
+package router
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	uuid "github.com/gofrs/uuid"
+	"github.com/rs/zerolog"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/model"
+)
+
+const (
+	watcherChanDepth = 20
+	rewatchDelay     = 5 * time.Second
+)
+
+//Watcher keeps devices routed like a regular client with service credentials, so observers of router
+//see their statuses even if no client is subscribed. Access of service is checked by right verifier
+type Watcher struct {
+	sync.Mutex
+	router  *RouterHandler
+	creds   model.Credentials
+	logger  zerolog.Logger
+	ctx     context.Context
+	cancelF context.CancelFunc
+	//Cancel func of subscription per watched device
+	watched map[uuid.UUID]context.CancelFunc
+}
+
+func NewWatcher(router *RouterHandler, creds model.Credentials, logger *zerolog.Logger) *Watcher {
+	ctx, cancelF := context.WithCancel(context.Background())
+	return &Watcher{
+		router:  router,
+		creds:   creds,
+		logger:  logger.With().Str("WATCHER", creds.Identity).Logger(),
+		ctx:     ctx,
+		cancelF: cancelF,
+		watched: make(map[uuid.UUID]context.CancelFunc),
+	}
+}
+
+//Watch exactly ids, devices watched before and missing in ids are unsubscribed
+func (w *Watcher) Set(ids []uuid.UUID) {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.ctx.Err() != nil {
+		return
+	}
+	keep := make(map[uuid.UUID]bool, len(ids))
+	for _, id := range ids {
+		keep[id] = true
+		if _, ok := w.watched[id]; ok {
+			continue
+		}
+		ctx, cancelF := context.WithCancel(w.ctx)
+		w.watched[id] = cancelF
+		go w.watch(ctx, id)
+	}
+	for id, cancelF := range w.watched {
+		if !keep[id] {
+			cancelF()
+			delete(w.watched, id)
+		}
+	}
+}
+
+//Unsubscribe all devices
+func (w *Watcher) Stop() {
+	w.Lock()
+	defer w.Unlock()
+	w.cancelF()
+	w.watched = make(map[uuid.UUID]context.CancelFunc)
+}
+
+//Keep device subscribed until ctx is done, subscribe again if subscription failed
+func (w *Watcher) watch(ctx context.Context, id uuid.UUID) {
+	for {
+		subCtx, cancelF := context.WithCancel(ctx)
+		ch := make(chan *model.ResponseMessage, watcherChanDepth)
+		w.router.AddIds([]uuid.UUID{id}, &ch, w.creds, subCtx)
+		delay := w.drain(ctx, id, ch)
+		cancelF()
+		if ctx.Err() != nil {
+			return
+		}
+
+		w.logger.Debug().Msgf("Will watch again in %s id: %s", delay, id.String())
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+//Read messages of subscription, router must not be blocked by watcher.
+//Return delay before subscribe again if subscription failed, 0 when ctx is done
+func (w *Watcher) drain(ctx context.Context, id uuid.UUID, ch chan *model.ResponseMessage) time.Duration {
+	var subscribed bool
+	for {
+		select {
+		case msg := <-ch:
+			if closeErr := msg.GetCloseError(); closeErr != nil {
+				w.logger.Error().Err(closeErr).Msgf("Watcher is unsubscribed by router for id: %s", id.String())
+				return rewatchDelay
+			}
+			if msg.ErrorResp == nil {
+				subscribed = true
+				continue
+			}
+			w.logger.Warn().Msgf("Watcher got %s for id: %s", msg.ErrorResp.TypeRes, id.String())
+			//Device was not subscribed, e.g. right verifier is unavailable
+			if !subscribed && msg.ErrorResp.Retryable {
+				if msg.ErrorResp.RetryAfter > 0 {
+					return time.Duration(msg.ErrorResp.RetryAfter) * time.Second
+				}
+				return rewatchDelay
+			}
+		case <-ctx.Done():
+			return 0
+		}
+	}
+}
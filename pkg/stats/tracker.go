@@ -0,0 +1,173 @@
+package stats
+
+import (
+	"sync"
+	"time"
+
+	uuid "github.com/gofrs/uuid"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/history"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/model"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/router"
+)
+
+const (
+	//Longest window of statistics, older segments are dropped
+	maxWindow = 7 * 24 * time.Hour
+	//Limit of memory for flapping device
+	maxSegments = 10000
+)
+
+//Windows of statistics in response
+var Windows = []struct {
+	Name     string
+	Duration time.Duration
+}{
+	{"1h", time.Hour},
+	{"24h", 24 * time.Hour},
+	{"7d", maxWindow},
+}
+
+//Presence of device since start until start of next segment
+type segment struct {
+	start    time.Time
+	presence model.Presence
+}
+
+//Tracker computes statistics from presence timeline of device. Timeline is read from history if it is enabled,
+//so it survives restarts, otherwise it is kept in memory for the longest window.
+//Presence lasts until it is changed, also while device has no route, as router continues from last known presence
+type Tracker struct {
+	sync.Mutex
+	devices map[uuid.UUID][]segment
+	history *history.Store
+}
+
+//history may be nil, then timeline is kept in memory since start of aggregator
+func NewTracker(history *history.Store) *Tracker {
+	return &Tracker{
+		devices: make(map[uuid.UUID][]segment),
+		history: history,
+	}
+}
+
+func (tr *Tracker) OnTransition(t router.Transition) {
+	if tr.history != nil {
+		return
+	}
+	tr.add(t.Id, t.At, t.To)
+}
+
+func (tr *Tracker) add(id uuid.UUID, at time.Time, p model.Presence) {
+	tr.Lock()
+	defer tr.Unlock()
+
+	segments := tr.devices[id]
+	if n := len(segments); n > 0 && segments[n-1].presence == p {
+		return
+	}
+	segments = append(segments, segment{start: at, presence: p})
+
+	//Keep one segment which started before the longest window, it covers start of the window
+	cutoff := at.Add(-maxWindow)
+	drop := 0
+	for drop+1 < len(segments) && !segments[drop+1].start.After(cutoff) {
+		drop++
+	}
+	if over := len(segments) - drop - maxSegments; over > 0 {
+		drop += over
+	}
+	if drop > 0 {
+		segments = append(segments[:0:0], segments[drop:]...)
+	}
+
+	//Device is removed when it is unknown for whole window
+	if len(segments) == 1 && p == model.PresenceUnknown {
+		delete(tr.devices, id)
+		return
+	}
+	tr.devices[id] = segments
+}
+
+//Return statistics of device for each of Windows
+func (tr *Tracker) Stats(id uuid.UUID) ([]model.StatsWindow, error) {
+
+	now := time.Now()
+	segments, err := tr.timeline(id, now)
+	if err != nil {
+		return nil, err
+	}
+	r := make([]model.StatsWindow, 0, len(Windows))
+	for _, w := range Windows {
+		r = append(r, compute(segments, w.Name, now.Add(-w.Duration), now))
+	}
+	return r, nil
+}
+
+//Return presence segments of device for the longest window before now
+func (tr *Tracker) timeline(id uuid.UUID, now time.Time) ([]segment, error) {
+
+	if tr.history == nil {
+		tr.Lock()
+		defer tr.Unlock()
+		return append([]segment{}, tr.devices[id]...), nil
+	}
+
+	entries, err := tr.history.Timeline(id, now.Add(-maxWindow), now)
+	if err != nil {
+		return nil, err
+	}
+	var segments []segment
+	for _, e := range entries {
+		if n := len(segments); n > 0 && segments[n-1].presence == e.To {
+			continue
+		}
+		segments = append(segments, segment{start: e.At, presence: e.To})
+	}
+	return segments, nil
+}
+
+func compute(segments []segment, name string, from, to time.Time) model.StatsWindow {
+
+	var (
+		durations   = make(map[model.Presence]time.Duration)
+		disconnects int
+		prev        model.Presence
+	)
+
+	for i, s := range segments {
+		end := to
+		if i+1 < len(segments) {
+			end = segments[i+1].start
+		}
+		start := s.start
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(start) {
+			durations[s.presence] += end.Sub(start)
+		}
+		if prev == model.PresenceOnline && s.presence == model.PresenceOffline && !s.start.Before(from) {
+			disconnects++
+		}
+		prev = s.presence
+	}
+
+	total := to.Sub(from)
+	unknown := total - durations[model.PresenceOnline] - durations[model.PresenceOffline]
+	w := model.StatsWindow{
+		Window:      name,
+		Online:      durations[model.PresenceOnline].Seconds(),
+		Offline:     durations[model.PresenceOffline].Seconds(),
+		Unknown:     unknown.Seconds(),
+		Disconnects: disconnects,
+	}
+	if known := durations[model.PresenceOnline] + durations[model.PresenceOffline]; known > 0 {
+		availability := 100 * float64(durations[model.PresenceOnline]) / float64(known)
+		w.Availability = &availability
+	}
+	if disconnects > 0 {
+		mtbo := durations[model.PresenceOnline].Seconds() / float64(disconnects)
+		w.MTBO = &mtbo
+	}
+	return w
+}
@@ -0,0 +1,230 @@
+package main_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	uuid "github.com/gofrs/uuid"
+	"github.com/rs/zerolog"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/alerts"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/config"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/model"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/router"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/worker"
+)
+
+func TestAlerts(t *testing.T) {
+	broker, err := startMQTTBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	dir, err := ioutil.TempDir("", "alerts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rulesFile := filepath.Join(dir, "alerts.json")
+	writeRules := func(modTime time.Time, rules string) {
+		if err := ioutil.WriteFile(rulesFile, []byte(`{"rules": [`+rules+`]}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(rulesFile, modTime, modTime)
+	}
+	lowBattery := `{"name": "low-battery", "expr": "battery.level < 15 && online", "severity": "warning"}`
+	writeRules(time.Now().Add(-time.Minute), lowBattery+`, {"name": "offline", "expr": "online == false for 1s"}`)
+
+	var env config.Environment
+	env.RightVerifURL = "http://127.0.0.1:9096/check/"
+	env.RouteLinger = 10
+	env.SourceType = worker.SourceMQTT
+	env.MQTTBrokerURL = broker.URL()
+	env.MQTTClientID = "aggregator"
+	env.MQTTStatusTopics = []string{"devices/{id}/status"}
+	env.AlertRulesFile = rulesFile
+	env.AlertRulesReloadPeriod = 1
+
+	rf := startRF(env.RightVerifURL)
+	defer rf.Close()
+
+	logger := zerolog.Nop()
+	r, err := router.NewRouterHandler(&logger, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	engine, err := alerts.NewEngine(env, &logger, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.AddMessageObserver(engine)
+	engine.Run(context.Background())
+	defer engine.Stop()
+
+	device := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(broker.URL()).SetClientID("device"))
+	if token := device.Connect(); !token.WaitTimeout(3*time.Second) || token.Error() != nil {
+		t.Fatalf("device connect: %v", token.Error())
+	}
+	defer device.Disconnect(0)
+
+	id := uuid.Must(uuid.NewV4())
+	publish := func(payload string) {
+		device.Publish("devices/"+id.String()+"/status", 0, true, payload).WaitTimeout(3 * time.Second)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *model.ResponseMessage, 20)
+
+	wait := func(typeRes string) *model.ResponseMessage {
+		select {
+		case msg := <-ch:
+			if msg.TypeRes != typeRes {
+				t.Fatalf("unexpected message, want %s: %+v", typeRes, msg)
+			}
+			return msg
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for %s", typeRes)
+		}
+		return nil
+	}
+	waitAlert := func(rule string, state model.AlertState) {
+		msg := wait("alert")
+		if msg.Id != id.String() || msg.Alert.Rule != rule || msg.Alert.State != state {
+			t.Fatalf("unexpected alert, want %s %s: %+v", rule, state, msg.Alert)
+		}
+	}
+
+	publish(`{"status": 1, "extendedStatus": {"battery": {"level": 80}}}`)
+	r.AddIds([]uuid.UUID{id}, &ch, model.Credentials{Token: "200"}, ctx)
+	wait("status")
+
+	publish(`{"status": 1, "extendedStatus": {"battery": {"level": 10}}}`)
+	wait("status")
+	waitAlert("low-battery", model.AlertFiring)
+
+	//Offline alert fires only after condition holds for 1s
+	publish(`{"status": 0, "extendedStatus": {"battery": {"level": 10}}}`)
+	wait("status")
+	waitAlert("low-battery", model.AlertResolved)
+	waitAlert("offline", model.AlertFiring)
+
+	//New subscriber gets firing alert after last status
+	late := make(chan *model.ResponseMessage, 20)
+	r.AddIds([]uuid.UUID{id}, &late, model.Credentials{Token: "200"}, ctx)
+	for _, typeRes := range []string{"status", "alert"} {
+		select {
+		case msg := <-late:
+			if msg.TypeRes != typeRes || typeRes == "alert" && (msg.Alert.Rule != "offline" || msg.Alert.State != model.AlertFiring) {
+				t.Fatalf("unexpected message, want %s: %+v", typeRes, msg)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for %s", typeRes)
+		}
+	}
+
+	//Removed rule resolves its alert
+	writeRules(time.Now(), lowBattery)
+	waitAlert("offline", model.AlertResolved)
+}
+
+type alertRecorder chan model.Alert
+
+func (a alertRecorder) OnAlert(id uuid.UUID, alert model.Alert) {
+	a <- alert
+}
+
+func TestAlertsWatch(t *testing.T) {
+	broker, err := startMQTTBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	dir, err := ioutil.TempDir("", "alerts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	watched, subscribed := uuid.Must(uuid.NewV4()), uuid.Must(uuid.NewV4())
+
+	rf := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer rf.Close()
+
+	var env config.Environment
+	env.RightVerifURL = rf.URL + "/check/"
+	env.RightVerifIdentityHeader = "X-Client-Identity"
+	env.ServiceIdentity = "aggregator"
+	env.RouteLinger = 1
+	env.SourceType = worker.SourceMQTT
+	env.MQTTBrokerURL = broker.URL()
+	env.MQTTClientID = "aggregator"
+	env.MQTTStatusTopics = []string{"devices/{id}/status"}
+	env.AlertRulesFile = filepath.Join(dir, "alerts.json")
+	rules := fmt.Sprintf(`{"rules": [
+		{"name": "low-battery", "expr": "battery.level < 15", "ids": ["%s"]},
+		{"name": "offline", "expr": "online == false"}
+	]}`, watched)
+	if err := ioutil.WriteFile(env.AlertRulesFile, []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	device := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(broker.URL()).SetClientID("device"))
+	if token := device.Connect(); !token.WaitTimeout(3*time.Second) || token.Error() != nil {
+		t.Fatalf("device connect: %v", token.Error())
+	}
+	defer device.Disconnect(0)
+	device.Publish("devices/"+watched.String()+"/status", 0, true, `{"status": 1, "extendedStatus": {"battery": {"level": 10}}}`).WaitTimeout(3 * time.Second)
+	device.Publish("devices/"+subscribed.String()+"/status", 0, true, `{"status": 0}`).WaitTimeout(3 * time.Second)
+
+	logger := zerolog.Nop()
+	r, err := router.NewRouterHandler(&logger, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	engine, err := alerts.NewEngine(env, &logger, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := make(alertRecorder, 10)
+	engine.AddSink(sink)
+	r.AddMessageObserver(engine)
+	engine.Run(context.Background())
+	defer engine.Stop()
+
+	waitAlert := func(rule string, state model.AlertState) {
+		select {
+		case alert := <-sink:
+			if alert.Rule != rule || alert.State != state {
+				t.Fatalf("unexpected alert, want %s %s: %+v", rule, state, alert)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for %s %s", rule, state)
+		}
+	}
+
+	//Device of rule is evaluated without subscribed clients
+	waitAlert("low-battery", model.AlertFiring)
+
+	//Alert of device which is not observed anymore is resolved
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan *model.ResponseMessage, 20)
+	r.AddIds([]uuid.UUID{subscribed}, &ch, model.Credentials{Token: "200"}, ctx)
+	waitAlert("offline", model.AlertFiring)
+	cancel()
+	waitAlert("offline", model.AlertResolved)
+}
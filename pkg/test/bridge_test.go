@@ -0,0 +1,119 @@
+package main_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	uuid "github.com/gofrs/uuid"
+	"github.com/rs/zerolog"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/bridge"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/config"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/model"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/router"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/worker"
+)
+
+func TestMQTTPublisher(t *testing.T) {
+	broker, err := startMQTTBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	var env config.Environment
+	env.RightVerifURL = "http://127.0.0.1:9092/check/"
+	env.RightVerifIdentityHeader = "X-Client-Identity"
+	env.RouteLinger = 1
+	env.SourceType = worker.SourceMQTT
+	env.MQTTBrokerURL = broker.URL()
+	env.MQTTClientID = "aggregator"
+	env.MQTTStatusTopics = []string{"devices/{id}/status"}
+	env.MQTTPublishDevices = []string{ok_device}
+	env.MQTTPublishClientID = "publisher"
+	env.MQTTPublishTopic = "aggregator/devices/{id}/status"
+	env.MQTTPublishIdentity = "spiffe://cluster/publisher"
+
+	rf := startRF(env.RightVerifURL)
+	defer rf.Close()
+
+	logger := zerolog.Nop()
+	router, err := router.NewRouterHandler(&logger, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.Stop()
+
+	publisher, err := bridge.NewMQTTPublisher(env, &logger, router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router.AddMessageObserver(publisher)
+	publisher.Run(context.Background())
+	defer publisher.Stop()
+
+	//Without device list every routed status is published
+	allEnv := env
+	allEnv.MQTTPublish = true
+	allEnv.MQTTPublishDevices = nil
+	allEnv.MQTTPublishClientID = "publisher-all"
+	allEnv.MQTTPublishTopic = "all/devices/{id}/status"
+	allPublisher, err := bridge.NewMQTTPublisher(allEnv, &logger, router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router.AddMessageObserver(allPublisher)
+	allPublisher.Run(context.Background())
+	defer allPublisher.Stop()
+
+	device := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(broker.URL()).SetClientID("device"))
+	if token := device.Connect(); !token.WaitTimeout(3*time.Second) || token.Error() != nil {
+		t.Fatalf("device connect: %v", token.Error())
+	}
+	defer device.Disconnect(0)
+
+	//Wait for retained status with online flag on topic
+	waitPublished := func(topic string, online bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if payload, ok := broker.Retained(topic); ok {
+				var msg model.ResponseMessage
+				if err := json.Unmarshal(payload, &msg); err != nil {
+					t.Fatal(err)
+				}
+				if msg.Online != nil && *msg.Online == online {
+					return
+				}
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("online %v is not published to %s", online, topic)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	for _, status := range []int{1, 0} {
+		//Retained, so status is received even if aggregator is not subscribed yet
+		token := device.Publish("devices/"+ok_device+"/status", 0, true, fmt.Sprintf(`{"status": %d}`, status))
+		token.WaitTimeout(3 * time.Second)
+
+		waitPublished("aggregator/devices/"+ok_device+"/status", status > 0)
+		waitPublished("all/devices/"+ok_device+"/status", status > 0)
+	}
+
+	//Device watched only by regular client is published by publisher without device list
+	other := uuid.Must(uuid.NewV4())
+	device.Publish("devices/"+other.String()+"/status", 0, true, `{"status": 1}`).WaitTimeout(3 * time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *model.ResponseMessage, 5)
+	router.AddIds([]uuid.UUID{other}, &ch, model.Credentials{Token: "200"}, ctx)
+
+	waitPublished("all/devices/"+other.String()+"/status", true)
+	if _, ok := broker.Retained("aggregator/devices/" + other.String() + "/status"); ok {
+		t.Errorf("device out of publish list is published")
+	}
+}
@@ -1,8 +1,12 @@
 package main_test
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"reflect"
 	"testing"
+	"time"
 
 	uuid "github.com/gofrs/uuid"
 	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/model"
@@ -16,6 +20,9 @@ func TestNewErrorResponseMessageFromDeviceStatusFromDSN(t *testing.T) {
 	}
 
 	id := uuid.Must(uuid.NewV4())
+	reasonDeleted := "device removed"
+	reasonOverloaded := "try again later"
+	reasonGeneric := "internal error"
 
 	tests := []struct {
 		name string
@@ -63,7 +70,58 @@ func TestNewErrorResponseMessageFromDeviceStatusFromDSN(t *testing.T) {
 				TypeRes: "sub-nack",
 				Id:      id.String(),
 				ErrorResp: &model.ErrorResponseMessage{
-					TypeRes: "GENERIC",
+					TypeRes:   "GENERIC",
+					Reason:    &reasonGeneric,
+					Retryable: true,
+				},
+			},
+		},
+		{
+			name: "deleted",
+			args: args{
+				codeError: 4010,
+				err:       errors.New("device removed"),
+				id:        id,
+			},
+			want: &model.ResponseMessage{
+				TypeRes: "sub-nack",
+				Id:      id.String(),
+				ErrorResp: &model.ErrorResponseMessage{
+					TypeRes: "DEVICE_DELETED",
+					Reason:  &reasonDeleted,
+				},
+			},
+		},
+		{
+			name: "forbidden",
+			args: args{
+				codeError: 1008,
+				err:       errors.New("aggregator is not allowed"),
+				id:        id,
+			},
+			want: &model.ResponseMessage{
+				TypeRes: "sub-nack",
+				Id:      id.String(),
+				ErrorResp: &model.ErrorResponseMessage{
+					TypeRes: "FORBIDDEN",
+				},
+			},
+		},
+		{
+			name: "overloaded",
+			args: args{
+				codeError: 1013,
+				err:       errors.New("try again later"),
+				id:        id,
+			},
+			want: &model.ResponseMessage{
+				TypeRes: "sub-nack",
+				Id:      id.String(),
+				ErrorResp: &model.ErrorResponseMessage{
+					TypeRes:    "UPSTREAM_OVERLOADED",
+					Reason:     &reasonOverloaded,
+					Retryable:  true,
+					RetryAfter: 30,
 				},
 			},
 		},
@@ -76,3 +134,80 @@ func TestNewErrorResponseMessageFromDeviceStatusFromDSN(t *testing.T) {
 		})
 	}
 }
+
+func TestAsError(t *testing.T) {
+	typed := model.NewError(model.ErrorCodeTokenOutdated, errors.New("token outdated"))
+
+	got := model.AsError(fmt.Errorf("wrapped: %w", typed))
+	if got != typed {
+		t.Errorf("AsError() = %v, want %v", got, typed)
+	}
+	if got.CloseCode() != 4001 || got.Retryable() {
+		t.Errorf("AsError() close code = %d, retryable = %v", got.CloseCode(), got.Retryable())
+	}
+
+	//Internal text of GENERIC error is not shown to client
+	generic := model.AsError(errors.New("rightVerifURL parse error"))
+	if generic.Code != model.ErrorCodeGeneric || generic.Reason() != "internal error" {
+		t.Errorf("AsError() reason = %q, want fixed reason of GENERIC", generic.Reason())
+	}
+
+	//Clients which do not know retryable flag get the same payload as before
+	data, err := json.Marshal(model.NewErrorResponseMessageFromError(model.NewError(model.ErrorCodeNotFound, nil), uuid.Nil).ErrorResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"type":"NOT_FOUND"}` {
+		t.Errorf("error payload = %s", data)
+	}
+}
+
+func TestStatusStates(t *testing.T) {
+	states, err := model.ParseStatusStates([]string{"0:offline", "1:online", " 2: sleeping", "3:updating"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := uuid.Must(uuid.NewV4())
+	for status, want := range map[int]string{0: "offline", 2: "sleeping", 3: "updating", 7: ""} {
+		msg := (&model.DeviceStatusFromDSN{Status: status}).ResponseMessage(id)
+		states.Name(msg)
+		if msg.State != want || *msg.Status != status || *msg.Online != (status > 0) {
+			t.Errorf("status %d: state = %q, online = %v", status, msg.State, *msg.Online)
+		}
+	}
+
+	for _, wrong := range [][]string{{"sleeping"}, {"x:sleeping"}, {"2:"}, {"2:a", "2:b"}} {
+		if _, err := model.ParseStatusStates(wrong); err == nil {
+			t.Errorf("%v is parsed", wrong)
+		}
+	}
+}
+
+func TestReportedAt(t *testing.T) {
+	want := time.Date(2021, 11, 5, 10, 30, 0, 0, time.UTC)
+	id := uuid.Must(uuid.NewV4())
+
+	for _, reported := range []string{`"2021-11-05T12:30:00+02:00"`, `1636108200`, `1636108200000`} {
+		var status model.DeviceStatusFromDSN
+		if err := json.Unmarshal([]byte(`{"status": 1, "reportedAt": `+reported+`}`), &status); err != nil {
+			t.Fatal(err)
+		}
+		msg := status.ResponseMessage(id)
+		if msg.ReportedAt == nil || !msg.ReportedAt.Equal(want) {
+			t.Errorf("%s: reportedAt = %v", reported, msg.ReportedAt)
+		}
+		if msg.ReceivedAt == nil {
+			t.Errorf("%s: no receivedAt", reported)
+		}
+	}
+
+	//Wrong time does not break status
+	var status model.DeviceStatusFromDSN
+	if err := json.Unmarshal([]byte(`{"status": 1, "reportedAt": "yesterday"}`), &status); err != nil {
+		t.Fatal(err)
+	}
+	if msg := status.ResponseMessage(id); msg.ReportedAt != nil {
+		t.Errorf("reportedAt = %v", msg.ReportedAt)
+	}
+}
@@ -0,0 +1,139 @@
+package main_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	uuid "github.com/gofrs/uuid"
+	"github.com/rs/zerolog"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/aggregator"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/config"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/model"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/router"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/worker"
+)
+
+func TestGroups(t *testing.T) {
+	broker, err := startMQTTBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	dir, err := ioutil.TempDir("", "groups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first := uuid.Must(uuid.NewV4())
+	second := uuid.Must(uuid.NewV4())
+	groupsFile := filepath.Join(dir, "groups.json")
+	writeGroups := func(modTime time.Time, ids ...uuid.UUID) {
+		data := `{"groups": {"home": [`
+		for k, id := range ids {
+			if k > 0 {
+				data += ","
+			}
+			data += fmt.Sprintf("%q", id.String())
+		}
+		data += "]}}"
+		if err := ioutil.WriteFile(groupsFile, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(groupsFile, modTime, modTime)
+	}
+	writeGroups(time.Now().Add(-time.Minute), first)
+
+	var env config.Environment
+	env.RightVerifURL = "http://127.0.0.1:9095/check/"
+	env.RouteLinger = 10
+	env.SourceType = worker.SourceMQTT
+	env.MQTTBrokerURL = broker.URL()
+	env.MQTTClientID = "aggregator"
+	env.MQTTStatusTopics = []string{"devices/{id}/status"}
+	env.GroupsFile = groupsFile
+	env.GroupsRefreshPeriod = 1
+
+	rf := startRF(env.RightVerifURL)
+	defer rf.Close()
+
+	logger := zerolog.Nop()
+	r, err := router.NewRouterHandler(&logger, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	device := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(broker.URL()).SetClientID("device"))
+	if token := device.Connect(); !token.WaitTimeout(3*time.Second) || token.Error() != nil {
+		t.Fatalf("device connect: %v", token.Error())
+	}
+	defer device.Disconnect(0)
+	for id, status := range map[uuid.UUID]int{first: 1, second: 0} {
+		device.Publish("devices/"+id.String()+"/status", 0, true, fmt.Sprintf(`{"status": %d}`, status)).WaitTimeout(3 * time.Second)
+	}
+
+	wait := func(ch chan *model.ResponseMessage, typeRes string) *model.ResponseMessage {
+		select {
+		case msg := <-ch:
+			if msg.TypeRes != typeRes {
+				t.Fatalf("unexpected message, want %s: %+v", typeRes, msg)
+			}
+			return msg
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for %s", typeRes)
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	agg := aggregator.NewAggregatorStatusHandler(ctx, env, &logger, r, model.Credentials{Token: "200"})
+	defer agg.Stop()
+
+	agg.SubscribeGroups(ctx, nil, []string{"home", "office"})
+	if msg := wait(agg.RespMessageAggregate, "group-nack"); msg.Group != "office" || msg.ErrorResp.TypeRes != string(model.ErrorCodeNotFound) {
+		t.Fatalf("unexpected nack: %+v", msg)
+	}
+	if msg := wait(agg.RespMessageAggregate, "status"); msg.Id != first.String() {
+		t.Fatalf("unexpected status: %+v", msg)
+	}
+
+	//Added member is subscribed, already seen member is not sent again
+	writeGroups(time.Now(), first, second)
+	if msg := wait(agg.RespMessageAggregate, "status"); msg.Id != second.String() {
+		t.Fatalf("unexpected status: %+v", msg)
+	}
+	select {
+	case msg := <-agg.RespMessageAggregate:
+		t.Fatalf("unexpected message: %+v", msg)
+	case <-time.After(1500 * time.Millisecond):
+	}
+
+	//Removed member is forgotten, so it gets its status again when it is added back
+	writeGroups(time.Now().Add(time.Second), first)
+	time.Sleep(1500 * time.Millisecond)
+	writeGroups(time.Now().Add(2*time.Second), first, second)
+	if msg := wait(agg.RespMessageAggregate, "status"); msg.Id != second.String() {
+		t.Fatalf("unexpected status: %+v", msg)
+	}
+
+	//Summary of group and of whole subscription reaches counts of both members
+	summaryAgg := aggregator.NewAggregatorStatusHandler(ctx, env, &logger, r, model.Credentials{Token: "200"})
+	defer summaryAgg.Stop()
+	summaryAgg.SubscribeSummary(ctx, nil, []string{"home"})
+
+	want := model.PresenceSummary{Total: 2, Online: 1, Offline: 1}
+	got := make(map[string]model.PresenceSummary)
+	for got[""] != want || got["home"] != want {
+		msg := wait(summaryAgg.RespMessageAggregate, "summary")
+		got[msg.Group] = *msg.Summary
+	}
+}
@@ -0,0 +1,157 @@
+package main_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	uuid "github.com/gofrs/uuid"
+	"github.com/rs/zerolog"
+	wsAPI "gl.dev.boquar.com/backend/device-status-aggregator/pkg/api/ws"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/config"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/history"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/model"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/router"
+)
+
+func TestHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var env config.Environment
+	env.HistoryFile = filepath.Join(dir, "history.db")
+	env.DSNHostPort = "127.0.0.1:8099"
+	env.RightVerifURL = "http://127.0.0.1:9093/check/"
+	env.RightVerifIdentityHeader = "X-Client-Identity"
+	env.HistoryQueryLimit = 3
+
+	logger := zerolog.Nop()
+	rf := startRF(env.RightVerifURL)
+	defer rf.Close()
+	r, err := router.NewRouterHandler(&logger, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := history.Open(env, &logger, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Run(context.Background())
+
+	id := uuid.FromStringOrNil(ok_device)
+	status := func(s int, extended string) *model.ResponseMessage {
+		raw := json.RawMessage(extended)
+		return (&model.DeviceStatusFromDSN{Status: s, DeviceTelemetry: &raw}).ResponseMessage(id)
+	}
+	waitEntries := func(want int) []model.HistoryEntry {
+		deadline := time.Now().Add(3 * time.Second)
+		for {
+			//Follow pages of history truncated by limit
+			var entries []model.HistoryEntry
+			for from := time.Now().Add(-time.Hour); ; {
+				page, next, err := store.Query(id, from, time.Now().Add(time.Hour))
+				if err != nil {
+					t.Fatal(err)
+				}
+				entries = append(entries, page...)
+				if next == nil {
+					break
+				}
+				from = *next
+			}
+			if len(entries) == want {
+				return entries
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d entries: %+v", want, entries)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	store.OnMessage(id, status(1, `{"battery": 90}`))
+	//Repeated status is not a change
+	store.OnMessage(id, status(1, `{"battery": 90}`))
+	offlineAt := time.Now().UTC()
+	store.OnMessage(id, status(0, `{"battery": 90}`))
+	store.OnMessage(id, status(1, `{"battery": 90}`))
+	//Change of extendedStatus is stored without change of presence
+	store.OnMessage(id, status(1, `{"battery": 80}`))
+	entries := waitEntries(4)
+	if e := entries[3]; e.From != model.PresenceOnline || e.To != model.PresenceOnline || string(*e.Status.ExtendedStatus) != `{"battery":80}` {
+		t.Errorf("unexpected change of extendedStatus: %+v", e)
+	}
+
+	server, err := wsAPI.NewServer(r, store, nil, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(server.Handler)
+	defer srv.Close()
+
+	get := func(query string) (int, *model.ResponseMessage) {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/devices/"+ok_device+"/history?"+query, nil)
+		req.Header.Set("Authorization", "Bearer 200")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var msg model.ResponseMessage
+		if resp.StatusCode == http.StatusBadRequest {
+			return resp.StatusCode, &msg
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&msg); err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, &msg
+	}
+
+	//Last day by default, truncated by limit
+	code, msg := get("")
+	if code != http.StatusOK || len(msg.History) != 3 || msg.HistoryNext == nil || !msg.HistoryNext.Equal(entries[3].At) {
+		t.Fatalf("unexpected history: %d %+v", code, msg)
+	}
+	code, msg = get("from=" + msg.HistoryNext.Format(time.RFC3339Nano))
+	if code != http.StatusOK || len(msg.History) != 1 || msg.HistoryNext != nil {
+		t.Errorf("unexpected rest of history: %d %+v", code, msg)
+	}
+	code, msg = get("from=" + offlineAt.Format(time.RFC3339Nano))
+	if code != http.StatusOK || len(msg.History) != 3 || msg.History[0].To != model.PresenceOffline {
+		t.Errorf("unexpected history from: %d %+v", code, msg)
+	}
+	if code, _ := get("from=yesterday"); code != http.StatusBadRequest {
+		t.Errorf("unexpected status of wrong from: %d", code)
+	}
+	store.Stop()
+
+	//Retention keeps only last entry
+	env.HistoryMaxEntries = 1
+	store, err = history.Open(env, &logger, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Run(context.Background())
+	defer store.Stop()
+	entries = waitEntries(1)
+	if len(entries) != 1 || entries[0].To != model.PresenceOnline || entries[0].From != model.PresenceOnline {
+		t.Errorf("unexpected history after retention: %+v", entries)
+	}
+
+	//Last stored status is known after restart
+	store.OnMessage(id, status(1, `{"battery": 80}`))
+	store.OnMessage(id, status(0, `{"battery": 80}`))
+	if entries := waitEntries(2); entries[1].From != model.PresenceOnline || entries[1].To != model.PresenceOffline {
+		t.Errorf("unexpected history after restart: %+v", entries)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/binary"
 	"encoding/json"
+	"io"
 	"net/http"
 	ur "net/url"
 	"os"
@@ -42,9 +43,12 @@ func Test_Flow(t *testing.T) {
 
 	log.Logger = zerolog.New(os.Stderr).With().Str("DSA-test", "DSA").Timestamp().Caller().Logger()
 
-	router := router.NewRouterHandler(&log.Logger, env)
+	router, err := router.NewRouterHandler(&log.Logger, env)
+	if err != nil {
+		t.Error("unable to create router")
+	}
 
-	serverWS, err := wsAPI.NewServer(router, env)
+	serverWS, err := wsAPI.NewServer(router, nil, nil, env)
 	if err != nil {
 		t.Error("unable to create websocket server")
 	}
@@ -65,13 +69,21 @@ func Test_Flow(t *testing.T) {
 		go RunMockServer(env.DSNHostPort, t, ctx, ok_device)
 		//1
 		online := true
+		status := 1
 		reqExp := &model.ResponseMessage{
-			TypeRes: "status",
-			Id:      ok_device,
-			Online:  &online,
+			TypeRes:  "status",
+			Id:       ok_device,
+			Seq:      1,
+			Online:   &online,
+			Status:   &status,
+			Endpoint: env.DSNHostPort,
 		}
 		req := &model.ResponseMessage{}
 		SendQuery(ctx, u.String(), t, uuid.FromStringOrNil(ok_device), "adsas", env, req)
+		if assert.NotNil(t, req.ReceivedAt) {
+			assert.WithinDuration(t, time.Now(), *req.ReceivedAt, 5*time.Second)
+		}
+		req.ReceivedAt = nil
 		assert.Equal(t, reqExp, req)
 
 		CancelRM()
@@ -84,6 +96,7 @@ func Test_Flow(t *testing.T) {
 		reqExp2 := &model.ResponseMessage{
 			TypeRes: "sub-nack",
 			Id:      idDevice.String(),
+			Seq:     1,
 			ErrorResp: &model.ErrorResponseMessage{
 				TypeRes: "NOT_FOUND",
 			},
@@ -116,7 +129,7 @@ func SendQuery(ctx context.Context, urlstr string, t *testing.T, id uuid.UUID, t
 
 	dialer := ws.Dialer{}
 	dialer.Timeout = 2 * time.Second
-	conn, _, _, err := dialer.Dial(ctx, urlstr)
+	conn, br, _, err := dialer.Dial(ctx, urlstr)
 
 	if err != nil {
 		t.Error(err)
@@ -139,7 +152,11 @@ func SendQuery(ctx context.Context, urlstr string, t *testing.T, id uuid.UUID, t
 	}
 	assert.NoError(t, err)
 
-	reader := wsutil.NewReader(conn, ws.StateClientSide)
+	var src io.Reader = conn
+	if br != nil {
+		src = br
+	}
+	reader := wsutil.NewReader(src, ws.StateClientSide)
 	decoder := json.NewDecoder(reader)
 
 	//req := model.ResponseMessage{}
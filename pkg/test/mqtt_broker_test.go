@@ -0,0 +1,374 @@
+package main_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+//Minimal in-process MQTT 3.1.1 broker for tests, only packets used by paho client are handled.
+//Publish with QoS 0 and 1 is accepted, subscriptions are granted QoS 0 so delivery needs no acknowledgement.
+//Retained messages and last will are supported
+type mqttBroker struct {
+	sync.Mutex
+	listener net.Listener
+	clients  map[*mqttBrokerClient]bool
+	retained map[string]*mqttBrokerMessage
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+type mqttBrokerClient struct {
+	sync.Mutex
+	id      string
+	conn    net.Conn
+	filters map[string]bool
+	will    *mqttBrokerMessage
+}
+
+type mqttBrokerMessage struct {
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+const (
+	mqttConnect     = 1
+	mqttConnack     = 2
+	mqttPublish     = 3
+	mqttPuback      = 4
+	mqttSubscribe   = 8
+	mqttSuback      = 9
+	mqttUnsubscribe = 10
+	mqttUnsuback    = 11
+	mqttPingreq     = 12
+	mqttPingresp    = 13
+	mqttDisconnect  = 14
+)
+
+func startMQTTBroker() (*mqttBroker, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	b := &mqttBroker{
+		listener: l,
+		clients:  make(map[*mqttBrokerClient]bool),
+		retained: make(map[string]*mqttBrokerMessage),
+	}
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c := &mqttBrokerClient{conn: conn, filters: make(map[string]bool)}
+			b.Lock()
+			b.clients[c] = true
+			if b.closed {
+				conn.Close()
+			}
+			b.Unlock()
+			b.wg.Add(1)
+			go b.serve(c)
+		}
+	}()
+	return b, nil
+}
+
+func (b *mqttBroker) URL() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+//Close connections and wait until all of them are served
+func (b *mqttBroker) Close() {
+	b.listener.Close()
+	b.Lock()
+	b.closed = true
+	for c := range b.clients {
+		c.conn.Close()
+	}
+	b.Unlock()
+	b.wg.Wait()
+}
+
+//Drop connection of client without DISCONNECT, so its last will is published
+func (b *mqttBroker) Kick(clientID string) {
+	b.Lock()
+	defer b.Unlock()
+	for c := range b.clients {
+		if c.id == clientID {
+			c.conn.Close()
+		}
+	}
+}
+
+//Payload of retained message on topic
+func (b *mqttBroker) Retained(topic string) ([]byte, bool) {
+	b.Lock()
+	defer b.Unlock()
+	msg, ok := b.retained[topic]
+	if !ok {
+		return nil, false
+	}
+	return msg.payload, true
+}
+
+func (b *mqttBroker) serve(c *mqttBrokerClient) {
+	defer b.wg.Done()
+	r := bufio.NewReader(c.conn)
+
+	defer func() {
+		c.conn.Close()
+		b.Lock()
+		delete(b.clients, c)
+		b.Unlock()
+		c.Lock()
+		will := c.will
+		c.Unlock()
+		if will != nil {
+			b.publish(will)
+		}
+	}()
+
+	for {
+		typ, flags, body, err := readMQTTPacket(r)
+		if err != nil {
+			return
+		}
+
+		switch typ {
+		case mqttConnect:
+			id, will, err := parseMQTTConnect(body)
+			if err != nil {
+				return
+			}
+			b.Lock()
+			c.id = id
+			b.Unlock()
+			c.Lock()
+			c.will = will
+			c.Unlock()
+			if c.write(mqttConnack<<4, []byte{0, 0}) != nil {
+				return
+			}
+
+		case mqttPublish:
+			topic, rest := readMQTTString(body)
+			switch (flags >> 1) & 3 {
+			case 0:
+			case 1:
+				if len(rest) < 2 || c.write(mqttPuback<<4, rest[:2]) != nil {
+					return
+				}
+				rest = rest[2:]
+			default:
+				//PUBREC flow of QoS 2 is not implemented
+				return
+			}
+			b.publish(&mqttBrokerMessage{topic: topic, payload: rest, retain: flags&1 == 1})
+
+		case mqttSubscribe:
+			if len(body) < 2 {
+				return
+			}
+			id, rest := body[:2], body[2:]
+			var (
+				codes   []byte
+				matched []*mqttBrokerMessage
+			)
+			for len(rest) > 0 {
+				var filter string
+				filter, rest = readMQTTString(rest)
+				if len(rest) == 0 {
+					return
+				}
+				rest = rest[1:]
+				codes = append(codes, 0)
+				c.Lock()
+				c.filters[filter] = true
+				c.Unlock()
+				b.Lock()
+				for topic, msg := range b.retained {
+					if mqttTopicMatch(filter, topic) {
+						matched = append(matched, msg)
+					}
+				}
+				b.Unlock()
+			}
+			if c.write(mqttSuback<<4, append(append([]byte{}, id...), codes...)) != nil {
+				return
+			}
+			for _, msg := range matched {
+				c.deliver(msg, true)
+			}
+
+		case mqttUnsubscribe:
+			if len(body) < 2 {
+				return
+			}
+			id, rest := body[:2], body[2:]
+			for len(rest) > 0 {
+				var filter string
+				filter, rest = readMQTTString(rest)
+				c.Lock()
+				delete(c.filters, filter)
+				c.Unlock()
+			}
+			if c.write(mqttUnsuback<<4, id) != nil {
+				return
+			}
+
+		case mqttPingreq:
+			if c.write(mqttPingresp<<4, nil) != nil {
+				return
+			}
+
+		case mqttDisconnect:
+			c.Lock()
+			c.will = nil
+			c.Unlock()
+			return
+
+		default:
+			return
+		}
+	}
+}
+
+func (b *mqttBroker) publish(msg *mqttBrokerMessage) {
+	b.Lock()
+	if msg.retain {
+		if len(msg.payload) == 0 {
+			delete(b.retained, msg.topic)
+		} else {
+			b.retained[msg.topic] = msg
+		}
+	}
+	clients := make([]*mqttBrokerClient, 0, len(b.clients))
+	for c := range b.clients {
+		clients = append(clients, c)
+	}
+	b.Unlock()
+
+	for _, c := range clients {
+		c.deliver(msg, false)
+	}
+}
+
+func parseMQTTConnect(body []byte) (id string, will *mqttBrokerMessage, err error) {
+	_, rest := readMQTTString(body)
+	if len(rest) < 4 {
+		return "", nil, errors.New("short connect packet")
+	}
+	flags := rest[1]
+	rest = rest[4:]
+	id, rest = readMQTTString(rest)
+	if flags&0x04 != 0 {
+		var topic, payload string
+		topic, rest = readMQTTString(rest)
+		payload, _ = readMQTTString(rest)
+		will = &mqttBrokerMessage{topic: topic, payload: []byte(payload), retain: flags&0x20 != 0}
+	}
+	return id, will, nil
+}
+
+//Send message with QoS 0 if client is subscribed to its topic, retain flag is set only for retained message on subscribe
+func (c *mqttBrokerClient) deliver(msg *mqttBrokerMessage, retained bool) {
+	c.Lock()
+	subscribed := false
+	for filter := range c.filters {
+		subscribed = subscribed || mqttTopicMatch(filter, msg.topic)
+	}
+	c.Unlock()
+	if !subscribed {
+		return
+	}
+	header := byte(mqttPublish << 4)
+	if retained {
+		header |= 1
+	}
+	if c.write(header, append(appendMQTTString(nil, msg.topic), msg.payload...)) != nil {
+		c.conn.Close()
+	}
+}
+
+func (c *mqttBrokerClient) write(header byte, body []byte) error {
+	c.Lock()
+	defer c.Unlock()
+	packet := []byte{header}
+	n := len(body)
+	for {
+		d := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			d |= 0x80
+		}
+		packet = append(packet, d)
+		if n == 0 {
+			break
+		}
+	}
+	_, err := c.conn.Write(append(packet, body...))
+	return err
+}
+
+func readMQTTPacket(r *bufio.Reader) (typ byte, flags byte, body []byte, err error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; i < 4; i++ {
+		d, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		length += int(d&0x7f) * multiplier
+		multiplier *= 128
+		if d&0x80 == 0 {
+			break
+		}
+	}
+	body = make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, 0, nil, err
+	}
+	return header >> 4, header & 0x0f, body, nil
+}
+
+func readMQTTString(b []byte) (string, []byte) {
+	if len(b) < 2 {
+		return "", nil
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return "", nil
+	}
+	return string(b[2 : 2+n]), b[2+n:]
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+//Match topic with filter which can contain + and # wildcards
+func mqttTopicMatch(filter, topic string) bool {
+	f, t := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, part := range f {
+		if part == "#" {
+			return true
+		}
+		if i >= len(t) || (part != "+" && part != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
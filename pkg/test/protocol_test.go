@@ -0,0 +1,171 @@
+package main_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	uuid "github.com/gofrs/uuid"
+	"github.com/rs/zerolog"
+	wsAPI "gl.dev.boquar.com/backend/device-status-aggregator/pkg/api/ws"
+	hnd "gl.dev.boquar.com/backend/device-status-aggregator/pkg/api/ws/handler"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/config"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/router"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/worker"
+)
+
+func TestProtocolV2(t *testing.T) {
+	broker, err := startMQTTBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	var env config.Environment
+	env.WebSocketPort = 8092
+	env.RightVerifURL = "http://127.0.0.1:9097/check/"
+	env.SourceType = worker.SourceMQTT
+	env.MQTTBrokerURL = broker.URL()
+	env.MQTTClientID = "aggregator"
+	env.MQTTStatusTopics = []string{"devices/{id}/status"}
+
+	rf := startRF(env.RightVerifURL)
+	defer rf.Close()
+
+	logger := zerolog.Nop()
+	r, err := router.NewRouterHandler(&logger, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	server, err := wsAPI.NewServer(r, nil, nil, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ListenAndServe()
+	defer server.Shutdown(context.Background())
+
+	id := uuid.Must(uuid.NewV4())
+	device := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(broker.URL()).SetClientID("device"))
+	if token := device.Connect(); !token.WaitTimeout(3*time.Second) || token.Error() != nil {
+		t.Fatalf("device connect: %v", token.Error())
+	}
+	defer device.Disconnect(0)
+	publish := func(payload string) {
+		device.Publish("devices/"+id.String()+"/status", 0, true, payload).WaitTimeout(3 * time.Second)
+	}
+	publish(`{"status": 1, "extendedStatus": {"temp": 20, "fw": "1.0"}}`)
+
+	dialer := ws.Dialer{Timeout: 2 * time.Second, Protocols: []string{"dsa.v3", hnd.ProtocolV2}}
+	var (
+		conn net.Conn
+		hs   ws.Handshake
+	)
+	for k := 0; ; k++ {
+		if conn, _, hs, err = dialer.Dial(context.Background(), "ws://127.0.0.1:8092/ws/devices/status?token=200"); err == nil {
+			break
+		}
+		if k == 20 {
+			t.Fatal(err)
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	defer conn.Close()
+	if hs.Protocol != hnd.ProtocolV2 {
+		t.Fatalf("unexpected subprotocol: %q", hs.Protocol)
+	}
+
+	send := func(req string) {
+		if err := wsutil.WriteClientMessage(conn, ws.OpText, []byte(req)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func() map[string]interface{} {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		data, op, err := wsutil.ReadServerData(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if op == ws.OpBinary {
+			zr, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data, err = ioutil.ReadAll(zr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var msg map[string]interface{}
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	//Ack and status are sent by different goroutines, so their order is not fixed
+	readTypes := func(types ...string) map[string]map[string]interface{} {
+		r := make(map[string]map[string]interface{})
+		for len(r) < len(types) {
+			msg := read()
+			r[fmt.Sprint(msg["type"])] = msg
+		}
+		for _, typeRes := range types {
+			if r[typeRes] == nil {
+				t.Fatalf("no %s: %v", typeRes, r)
+			}
+		}
+		return r
+	}
+
+	//Unsupported encoding falls back to json, version must match subprotocol
+	send(`{"type": "hello", "versions": ["dsa.v2"], "features": {"encoding": "cbor", "deltas": true, "compression": "gzip", "ack": true}}`)
+	hello := read()
+	if hello["type"] != "hello" || hello["version"] != "dsa.v2" {
+		t.Fatalf("unexpected hello: %v", hello)
+	}
+	want := map[string]interface{}{"encoding": "json", "deltas": true, "compression": "gzip", "ack": true}
+	if fmt.Sprint(hello["features"]) != fmt.Sprint(want) {
+		t.Fatalf("unexpected features: %v", hello["features"])
+	}
+
+	send(fmt.Sprintf(`{"type": "subscribe", "reqId": "1", "ids": [%q]}`, id.String()))
+	msgs := readTypes("ack", "status")
+	if msgs["ack"]["reqId"] != "1" || msgs["ack"]["request"] != "subscribe" {
+		t.Fatalf("unexpected ack: %v", msgs["ack"])
+	}
+	if full := msgs["status"]; full["delta"] != nil || full["online"] != true {
+		t.Fatalf("first status must be full: %v", full)
+	}
+
+	//Only changed fields are sent
+	publish(`{"status": 1, "extendedStatus": {"temp": 21, "fw": "1.0"}}`)
+	delta := read()
+	if delta["type"] != "status" || delta["id"] != id.String() || delta["delta"] != true {
+		t.Fatalf("unexpected delta: %v", delta)
+	}
+	if _, ok := delta["online"]; ok {
+		t.Fatalf("unchanged field in delta: %v", delta)
+	}
+	if fmt.Sprint(delta["extendedStatus"]) != "map[temp:21]" {
+		t.Fatalf("unexpected extendedStatus in delta: %v", delta["extendedStatus"])
+	}
+
+	send(`{"type": "asd", "reqId": "2"}`)
+	if nack := read(); nack["type"] != "request-nack" || nack["reqId"] != "2" || fmt.Sprint(nack["error"].(map[string]interface{})["type"]) != "BAD_REQUEST" {
+		t.Fatalf("unexpected nack: %v", nack)
+	}
+
+	send(`{"type": "hello", "versions": ["dsa.v2"]}`)
+	if nack := read(); nack["type"] != "hello-nack" {
+		t.Fatalf("unexpected nack: %v", nack)
+	}
+}
@@ -0,0 +1,633 @@
+package main_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	uuid "github.com/gofrs/uuid"
+	"github.com/rs/zerolog"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/aggregator"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/config"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/model"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/router"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/router/mapstore"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/worker"
+)
+
+//DSN which sends online status of every device on connect and on Update, keeps connection open
+type mockDSN struct {
+	*httptest.Server
+	mu       sync.Mutex
+	connects map[string]int
+	update   chan struct{}
+}
+
+func startDSN() *mockDSN {
+	d := &mockDSN{connects: make(map[string]int), update: make(chan struct{})}
+	d.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _, err := ws.UpgradeHTTP(r, w)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		parts := strings.Split(r.URL.Path, "/")
+		d.mu.Lock()
+		d.connects[parts[len(parts)-1]]++
+		d.mu.Unlock()
+
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			for {
+				if _, _, err := wsutil.ReadClientData(conn); err != nil {
+					return
+				}
+			}
+		}()
+
+		//Worker does not read frames buffered by dialer with handshake response
+		time.Sleep(100 * time.Millisecond)
+		status, _ := json.Marshal(model.DeviceStatusFromDSN{Status: 1})
+		for {
+			if err := wsutil.WriteServerText(conn, status); err != nil {
+				return
+			}
+			d.mu.Lock()
+			update := d.update
+			d.mu.Unlock()
+			select {
+			case <-update:
+			case <-closed:
+				return
+			}
+		}
+	}))
+	return d
+}
+
+//Count of connections to DSN for device
+func (d *mockDSN) Connects(id uuid.UUID) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.connects[id.String()]
+}
+
+//Send status of every connected device again
+func (d *mockDSN) Update() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	close(d.update)
+	d.update = make(chan struct{})
+}
+
+func (d *mockDSN) HostPort() string {
+	return strings.TrimPrefix(d.URL, "http://")
+}
+
+//Router with mock DSN and right verifier which allows everything
+func startRouter(t *testing.T, linger int, stale int) (*router.RouterHandler, config.Environment, *mockDSN, func()) {
+	dsn := startDSN()
+	rf := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	var env config.Environment
+	env.DSNHostPort = dsn.HostPort()
+	env.RightVerifURL = rf.URL + "/check/"
+	env.AuthFieldName = "auth_result"
+	env.RouteLinger = linger
+	env.StaleTimeout = stale
+
+	logger := zerolog.Nop()
+	r, err := router.NewRouterHandler(&logger, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, env, dsn, func() {
+		r.Stop()
+		rf.Close()
+		dsn.Close()
+	}
+}
+
+//Records presence transitions
+type transitionRecorder struct {
+	transitions chan router.Transition
+}
+
+func (o *transitionRecorder) OnTransition(t router.Transition) {
+	o.transitions <- t
+}
+
+func TestRouteLinger(t *testing.T) {
+	r, _, dsn, stop := startRouter(t, 2, 0)
+	defer stop()
+
+	id := uuid.Must(uuid.NewV4())
+	subscribe := func() context.CancelFunc {
+		ctx, cancel := context.WithCancel(context.Background())
+		ch := make(chan *model.ResponseMessage, 5)
+		r.AddIds([]uuid.UUID{id}, &ch, model.Credentials{Token: "200"}, ctx)
+		select {
+		case msg := <-ch:
+			if msg.TypeRes != "status" {
+				t.Fatalf("unexpected message: %+v", msg)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("timeout waiting for status")
+		}
+		return cancel
+	}
+
+	cancel := subscribe()
+	cancel()
+	time.Sleep(time.Second)
+
+	//Resubscription within linger gets last status of the same upstream connection
+	cancel = subscribe()
+	if n := dsn.Connects(id); n != 1 {
+		t.Fatalf("route was restarted, %d connections to DSN", n)
+	}
+
+	//Route is stopped after linger, so next subscription connects again
+	cancel()
+	time.Sleep(3 * time.Second)
+	cancel = subscribe()
+	defer cancel()
+	if n := dsn.Connects(id); n != 2 {
+		t.Fatalf("route is not stopped after linger, %d connections to DSN", n)
+	}
+}
+
+func TestRouteTransitions(t *testing.T) {
+	r, _, dsn, stop := startRouter(t, 1, 0)
+	defer stop()
+	recorder := &transitionRecorder{transitions: make(chan router.Transition, 5)}
+	r.AddTransitionObserver(recorder)
+
+	id := uuid.Must(uuid.NewV4())
+	subscribe := func() context.CancelFunc {
+		ctx, cancel := context.WithCancel(context.Background())
+		ch := make(chan *model.ResponseMessage, 5)
+		r.AddIds([]uuid.UUID{id}, &ch, model.Credentials{Token: "200"}, ctx)
+		select {
+		case <-ch:
+		case <-time.After(3 * time.Second):
+			t.Fatal("timeout waiting for status")
+		}
+		return cancel
+	}
+
+	cancel := subscribe()
+	select {
+	case tr := <-recorder.transitions:
+		if !tr.Initial || tr.From != model.PresenceUnknown || tr.To != model.PresenceOnline {
+			t.Fatalf("unexpected first transition: %+v", tr)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for transition")
+	}
+	cancel()
+	time.Sleep(2 * time.Second)
+
+	//New route continues from last known presence
+	cancel = subscribe()
+	defer cancel()
+	if n := dsn.Connects(id); n != 2 {
+		t.Fatalf("route is not stopped after linger, %d connections to DSN", n)
+	}
+	select {
+	case tr := <-recorder.transitions:
+		t.Fatalf("transition on new route: %+v", tr)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestSubscribeManyRouted(t *testing.T) {
+	r, env, _, stop := startRouter(t, 10, 0)
+	defer stop()
+	logger := zerolog.Nop()
+
+	//More devices than buffers of aggregator, all of them already routed
+	ids := make([]uuid.UUID, 50)
+	for k := range ids {
+		ids[k] = uuid.Must(uuid.NewV4())
+	}
+	receive := func(agg *aggregator.AggregatorStatusHandler) {
+		seen := make(map[string]bool)
+		for len(seen) < len(ids) {
+			select {
+			case msg := <-agg.RespMessageAggregate:
+				seen[msg.Id] = true
+			case <-time.After(5 * time.Second):
+				t.Fatalf("got statuses of %d devices from %d", len(seen), len(ids))
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	first := aggregator.NewAggregatorStatusHandler(ctx, env, &logger, r, model.Credentials{Token: "200"})
+	defer first.Stop()
+	first.SubscribeDevices(ctx, ids)
+	receive(first)
+
+	done := make(chan struct{})
+	second := aggregator.NewAggregatorStatusHandler(ctx, env, &logger, r, model.Credentials{Token: "200"})
+	defer second.Stop()
+	go func() {
+		second.SubscribeDevices(ctx, ids)
+		close(done)
+	}()
+	receive(second)
+	<-done
+}
+
+func TestResubscribeWithNacks(t *testing.T) {
+	_, env, _, stop := startRouter(t, 10, 0)
+	defer stop()
+
+	//Only one device is allowed, nacks of the others are sent while subscription is changed
+	allowed := uuid.Must(uuid.NewV4())
+	rf := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, allowed.String()) {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer rf.Close()
+	env.RightVerifURL = rf.URL + "/check/"
+
+	logger := zerolog.Nop()
+	r, err := router.NewRouterHandler(&logger, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	agg := aggregator.NewAggregatorStatusHandler(ctx, env, &logger, r, model.Credentials{Token: "200"})
+	defer agg.Stop()
+
+	agg.SubscribeDevices(ctx, []uuid.UUID{allowed})
+	select {
+	case <-agg.RespMessageAggregate:
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for status")
+	}
+
+	//More nacks than buffers of aggregator, last status of routed device is replayed meanwhile
+	ids := []uuid.UUID{allowed}
+	for i := 0; i < 50; i++ {
+		ids = append(ids, uuid.Must(uuid.NewV4()))
+	}
+	done := make(chan struct{})
+	go func() {
+		agg.SubscribeDevices(ctx, ids)
+		close(done)
+	}()
+	for received := 0; received < len(ids); received++ {
+		select {
+		case <-agg.RespMessageAggregate:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d messages from %d", received, len(ids))
+		}
+	}
+	<-done
+}
+
+func TestStale(t *testing.T) {
+	r, env, dsn, stop := startRouter(t, 1, 1)
+	defer stop()
+
+	next := func(ch chan *model.ResponseMessage) *model.ResponseMessage {
+		select {
+		case msg := <-ch:
+			return msg
+		case <-time.After(4 * time.Second):
+			t.Fatal("timeout waiting for message")
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	id := uuid.Must(uuid.NewV4())
+	ch := make(chan *model.ResponseMessage, 5)
+	r.AddIds([]uuid.UUID{id}, &ch, model.Credentials{Token: "200"}, ctx)
+	if msg := next(ch); msg.IsStale() || msg.Stale != nil || msg.Endpoint != env.DSNHostPort {
+		t.Fatalf("unexpected first status: %+v", msg)
+	}
+
+	//Silent upstream makes status stale once
+	if msg := next(ch); !msg.IsStale() || msg.Online != nil || msg.ReceivedAt == nil || msg.Endpoint != env.DSNHostPort {
+		t.Fatalf("status is not stale after timeout: %+v", msg)
+	}
+	select {
+	case msg := <-ch:
+		t.Fatalf("stale is repeated: %+v", msg)
+	case <-time.After(1500 * time.Millisecond):
+	}
+
+	dsn.Update()
+	if msg := next(ch); msg.Stale == nil || *msg.Stale || msg.Online == nil || !*msg.Online {
+		t.Fatalf("status is not marked recovered: %+v", msg)
+	}
+
+	//Unreachable DSN makes status stale before nack
+	logger := zerolog.Nop()
+	env.DSNHostPort = "127.0.0.1:1"
+	unreachable, err := router.NewRouterHandler(&logger, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unreachable.Stop()
+	unreachableCh := make(chan *model.ResponseMessage, 5)
+	unreachable.AddIds([]uuid.UUID{id}, &unreachableCh, model.Credentials{Token: "200"}, ctx)
+	if msg := next(unreachableCh); !msg.IsStale() {
+		t.Fatalf("status is not stale after dial failure: %+v", msg)
+	}
+	if msg := next(unreachableCh); msg.ErrorResp == nil || msg.ErrorResp.TypeRes != string(model.ErrorCodeUnavailable) {
+		t.Fatalf("unexpected nack: %+v", msg)
+	}
+}
+
+func TestForwardCredentials(t *testing.T) {
+	//Authorization header of every connection to DSN
+	auths := make(chan string, 5)
+	dsn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auths <- r.Header.Get("Authorization")
+		conn, _, _, err := ws.UpgradeHTTP(r, w)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		wsutil.WriteServerMessage(conn, ws.OpText, []byte(`{"status": 1}`))
+		for {
+			if _, _, err := wsutil.ReadClientData(conn); err != nil {
+				return
+			}
+		}
+	}))
+	defer dsn.Close()
+
+	rf := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer rf.Close()
+
+	var env config.Environment
+	env.RightVerifURL = rf.URL + "/check/"
+	env.RightVerifIdentityHeader = "X-Client-Identity"
+	env.RouteLinger = 1
+	env.DSNHostPort = strings.TrimPrefix(dsn.URL, "http://")
+	env.DSNAuthMode = worker.DSNAuthForward
+
+	logger := zerolog.Nop()
+	r, err := router.NewRouterHandler(&logger, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	nextAuth := func() string {
+		select {
+		case auth := <-auths:
+			return auth
+		case <-time.After(4 * time.Second):
+			t.Fatal("timeout waiting for connection to DSN")
+		}
+		return ""
+	}
+	next := func(ch chan *model.ResponseMessage) *model.ResponseMessage {
+		select {
+		case msg := <-ch:
+			return msg
+		case <-time.After(4 * time.Second):
+			t.Fatal("timeout waiting for message")
+		}
+		return nil
+	}
+
+	id := uuid.Must(uuid.NewV4())
+	ctxA, cancelA := context.WithCancel(context.Background())
+	defer cancelA()
+	chA := make(chan *model.ResponseMessage, 5)
+	r.AddIds([]uuid.UUID{id}, &chA, model.Credentials{Token: "token-a"}, ctxA)
+	if auth := nextAuth(); auth != "Bearer token-a" {
+		t.Fatalf("route is opened with %q", auth)
+	}
+
+	//Second subscriber shares connection of route
+	ctxB, cancelB := context.WithCancel(context.Background())
+	defer cancelB()
+	chB := make(chan *model.ResponseMessage, 5)
+	r.AddIds([]uuid.UUID{id}, &chB, model.Credentials{Token: "token-b"}, ctxB)
+	select {
+	case auth := <-auths:
+		t.Fatalf("unexpected connection with %q", auth)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	//Token of subscriber who left is not used anymore
+	cancelA()
+	if auth := nextAuth(); auth != "Bearer token-b" {
+		t.Fatalf("route is reconnected with %q", auth)
+	}
+
+	//Client authenticated only by certificate has no token to forward
+	other := uuid.Must(uuid.NewV4())
+	chC := make(chan *model.ResponseMessage, 5)
+	r.AddIds([]uuid.UUID{other}, &chC, model.Credentials{Identity: "spiffe://cluster/dashboard"}, ctxB)
+	if msg := next(chC); msg.ErrorResp == nil || msg.ErrorResp.TypeRes != string(model.ErrorCodeForbidden) {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+
+	//Nack is not repeated by respawn, the same credentials would be refused again
+	select {
+	case msg := <-chC:
+		t.Fatalf("unexpected message after nack: %+v", msg)
+	case auth := <-auths:
+		t.Fatalf("unexpected connection with %q", auth)
+	case <-time.After(6 * time.Second):
+	}
+
+	//Subscriber with token makes route connect again
+	chD := make(chan *model.ResponseMessage, 5)
+	r.AddIds([]uuid.UUID{other}, &chD, model.Credentials{Token: "token-d"}, ctxB)
+	if auth := nextAuth(); auth != "Bearer token-d" {
+		t.Fatalf("route is reconnected with %q", auth)
+	}
+	if msg := next(chD); msg.TypeRes != "status" || msg.Online == nil || !*msg.Online {
+		t.Fatalf("unexpected message after reconnect: %+v", msg)
+	}
+}
+
+//Records ids of routed messages
+type messageRecorder struct {
+	messages chan uuid.UUID
+}
+
+func (o *messageRecorder) OnMessage(id uuid.UUID, msg *model.ResponseMessage) {
+	select {
+	case o.messages <- id:
+	default:
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	r, _, dsn, stop := startRouter(t, 1, 0)
+	defer stop()
+	recorder := &messageRecorder{messages: make(chan uuid.UUID, 5)}
+	r.AddMessageObserver(recorder)
+
+	logger := zerolog.Nop()
+	watcher := router.NewWatcher(r, model.Credentials{Token: "200"}, &logger)
+	defer watcher.Stop()
+
+	id := uuid.Must(uuid.NewV4())
+	expectRouted := func() {
+		select {
+		case routed := <-recorder.messages:
+			if routed != id {
+				t.Fatalf("unexpected routed device: %s", routed)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("timeout waiting for routed status")
+		}
+	}
+
+	//Watched device is routed without subscribed clients
+	watcher.Set([]uuid.UUID{id})
+	expectRouted()
+
+	//Route of device which is not watched anymore is stopped after linger
+	watcher.Set(nil)
+	time.Sleep(2 * time.Second)
+	watcher.Set([]uuid.UUID{id})
+	expectRouted()
+	if n := dsn.Connects(id); n != 2 {
+		t.Fatalf("route is not stopped after unwatch, %d connections to DSN", n)
+	}
+}
+
+func TestResume(t *testing.T) {
+	broker, err := startMQTTBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	var env config.Environment
+	env.RightVerifURL = "http://127.0.0.1:9094/check/"
+	env.RouteLinger = 10
+	env.ResumeBufferSize = 16
+	env.SourceType = worker.SourceMQTT
+	env.MQTTBrokerURL = broker.URL()
+	env.MQTTClientID = "aggregator"
+	env.MQTTStatusTopics = []string{"devices/{id}/status"}
+
+	rf := startRF(env.RightVerifURL)
+	defer rf.Close()
+
+	logger := zerolog.Nop()
+	r, err := router.NewRouterHandler(&logger, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	device := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(broker.URL()).SetClientID("device"))
+	if token := device.Connect(); !token.WaitTimeout(3*time.Second) || token.Error() != nil {
+		t.Fatalf("device connect: %v", token.Error())
+	}
+	defer device.Disconnect(0)
+
+	id := uuid.FromStringOrNil(ok_device)
+	creds := model.Credentials{Token: "200"}
+
+	wait := func(ch chan *model.ResponseMessage, seq uint64) {
+		select {
+		case msg := <-ch:
+			if msg.Seq != seq {
+				t.Fatalf("unexpected message, want seq %d: %+v", seq, msg)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timeout waiting for seq %d", seq)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan *model.ResponseMessage, 20)
+	r.AddIds([]uuid.UUID{id}, &ch, creds, ctx)
+	for i, status := range []int{1, 0, 1} {
+		//Retained, so status is received even if source is not subscribed yet
+		device.Publish("devices/"+ok_device+"/status", 0, true, fmt.Sprintf(`{"status": %d}`, status)).WaitTimeout(3 * time.Second)
+		wait(ch, uint64(i+1))
+	}
+	cancel()
+
+	//Reconnected client gets messages after its last seen sequence
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	ch = make(chan *model.ResponseMessage, 20)
+	r.ResumeIds([]uuid.UUID{id}, map[uuid.UUID]uint64{id: 1}, &ch, creds, ctx)
+	wait(ch, 2)
+	wait(ch, 3)
+
+	//Nothing is missed
+	ch2 := make(chan *model.ResponseMessage, 20)
+	r.ResumeIds([]uuid.UUID{id}, map[uuid.UUID]uint64{id: 3}, &ch2, creds, ctx)
+	select {
+	case msg := <-ch2:
+		t.Errorf("unexpected message: %+v", msg)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestStoppedRoutesCap(t *testing.T) {
+	store := mapstore.NewStore(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *model.ResponseMessage, 1)
+
+	//Start route of device, route one message and stop it. Return sequence number of message
+	route := func(id uuid.UUID) uint64 {
+		store.GetOrCreate(id, mapstore.NewItemStore(nil, func() {}, 1), &ch, 0, model.Credentials{}, ctx)
+		store.PreFlight()
+		seq := store.NextSeq(id)
+		store.SetPresence(id, model.PresenceOnline)
+		store.Delete(id)
+		return seq
+	}
+
+	first, second := uuid.Must(uuid.NewV4()), uuid.Must(uuid.NewV4())
+	route(first)
+	if seq := route(first); seq != 2 {
+		t.Fatalf("sequence is not continued after route is stopped: %d", seq)
+	}
+
+	//Device stopped before the last one is forgotten above the limit
+	route(second)
+	store.PreFlight()
+	_, known := store.LastPresence(first)
+	store.AfterFlight()
+	if known {
+		t.Fatal("presence of forgotten device is kept")
+	}
+	if seq := route(first); seq != 1 {
+		t.Fatalf("sequence of forgotten device is continued: %d", seq)
+	}
+	store.PreFlight()
+	_, known = store.LastPresence(first)
+	store.AfterFlight()
+	if !known {
+		t.Fatal("presence of last stopped device is forgotten")
+	}
+}
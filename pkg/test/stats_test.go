@@ -0,0 +1,144 @@
+package main_test
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	uuid "github.com/gofrs/uuid"
+	"github.com/rs/zerolog"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/config"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/history"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/model"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/router"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/stats"
+)
+
+func TestStatsTracker(t *testing.T) {
+	tracker := stats.NewTracker(nil)
+	id := uuid.FromStringOrNil(ok_device)
+	now := time.Now()
+
+	for _, tr := range []struct {
+		ago      time.Duration
+		from, to model.Presence
+	}{
+		{50 * time.Minute, model.PresenceUnknown, model.PresenceOnline},
+		{30 * time.Minute, model.PresenceOnline, model.PresenceOffline},
+		{20 * time.Minute, model.PresenceOffline, model.PresenceOnline},
+	} {
+		tracker.OnTransition(router.Transition{Id: id, From: tr.from, To: tr.to, At: now.Add(-tr.ago)})
+	}
+
+	near := func(got, want float64) bool {
+		return math.Abs(got-want) < 1
+	}
+
+	windows, err := tracker.Stats(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(windows) != 3 || windows[0].Window != "1h" {
+		t.Fatalf("unexpected windows: %+v", windows)
+	}
+	w := windows[0]
+	if !near(w.Online, 40*60) || !near(w.Offline, 10*60) || !near(w.Unknown, 10*60) || w.Disconnects != 1 {
+		t.Errorf("unexpected stats of 1h: %+v", w)
+	}
+	if w.Availability == nil || !near(*w.Availability, 80) {
+		t.Errorf("unexpected availability: %v", w.Availability)
+	}
+	if w.MTBO == nil || !near(*w.MTBO, 40*60) {
+		t.Errorf("unexpected mtbo: %v", w.MTBO)
+	}
+	if w := windows[2]; !near(w.Unknown, 7*24*3600-50*60) || w.Disconnects != 1 {
+		t.Errorf("unexpected stats of 7d: %+v", w)
+	}
+
+	if windows, _ := tracker.Stats(uuid.Must(uuid.NewV4())); windows[0].Availability != nil || !near(windows[0].Unknown, 3600) {
+		t.Errorf("unexpected stats of unknown device: %+v", windows[0])
+	}
+}
+
+func TestStatsFromHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var env config.Environment
+	env.HistoryFile = filepath.Join(dir, "history.db")
+	env.DSNHostPort = "127.0.0.1:1"
+	env.RightVerifURL = "http://127.0.0.1:1/check/"
+
+	logger := zerolog.Nop()
+	r, err := router.NewRouterHandler(&logger, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	store, err := history.Open(env, &logger, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Run(context.Background())
+
+	id := uuid.FromStringOrNil(ok_device)
+	now := time.Now()
+	//Device is offline since before the longest window, it was not routed until 50 minutes ago
+	for _, s := range []struct {
+		ago    time.Duration
+		status int
+	}{
+		{8 * 24 * time.Hour, 0},
+		{50 * time.Minute, 1},
+		{30 * time.Minute, 0},
+		{20 * time.Minute, 1},
+	} {
+		msg := (&model.DeviceStatusFromDSN{Status: s.status}).ResponseMessage(id)
+		received := now.Add(-s.ago)
+		msg.ReceivedAt = &received
+		store.OnMessage(id, msg)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		entries, err := store.Timeline(id, now.Add(-time.Hour), now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) == 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("history is not stored: %+v", entries)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	store.Stop()
+
+	//Stats survive restart
+	store, err = history.Open(env, &logger, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Stop()
+	windows, err := stats.NewTracker(store).Stats(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	near := func(got, want float64) bool {
+		return math.Abs(got-want) < 1
+	}
+	if w := windows[0]; !near(w.Online, 40*60) || !near(w.Offline, 20*60) || !near(w.Unknown, 0) || w.Disconnects != 1 {
+		t.Errorf("unexpected stats of 1h: %+v", w)
+	}
+	if w := windows[2]; !near(w.Unknown, 0) || w.Availability == nil || *w.Availability > 1 {
+		t.Errorf("unexpected stats of 7d: %+v", w)
+	}
+}
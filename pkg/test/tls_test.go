@@ -0,0 +1,306 @@
+package main_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	uuid "github.com/gofrs/uuid"
+	"github.com/rs/zerolog"
+	wsAPI "gl.dev.boquar.com/backend/device-status-aggregator/pkg/api/ws"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/config"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/model"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/router"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+//Make certificate from template, signed by parent or self-signed if parent is nil
+func newTestCert(t *testing.T, template *x509.Certificate, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (c *testCert) write(t *testing.T, certFile, keyFile string, modTime time.Time) {
+	if err := ioutil.WriteFile(certFile, c.certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, c.keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(certFile, modTime, modTime)
+	os.Chtimes(keyFile, modTime, modTime)
+}
+
+func TestServerCertReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	first := newTestCert(t, &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "aggregator"}}, nil)
+	second := newTestCert(t, &x509.Certificate{SerialNumber: big.NewInt(2), Subject: pkix.Name{CommonName: "aggregator"}}, nil)
+	first.write(t, certFile, keyFile, time.Now().Add(-time.Minute))
+
+	var env config.Environment
+	env.TLSCertFile = certFile
+	env.TLSKeyFile = keyFile
+	env.TLSReloadPeriod = 1
+
+	cfg, err := config.NewServerTLSConfig(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	serial := func() int64 {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+
+	if got := serial(); got != 1 {
+		t.Fatalf("serial = %d, want 1", got)
+	}
+
+	//Rotated certificate is used by new handshakes after reload period
+	second.write(t, certFile, keyFile, time.Now())
+	time.Sleep(1100 * time.Millisecond)
+	if got := serial(); got != 2 {
+		t.Fatalf("serial after rotation = %d, want 2", got)
+	}
+
+	//Broken files keep the last loaded certificate
+	if err := ioutil.WriteFile(certFile, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	time.Sleep(1100 * time.Millisecond)
+	if got := serial(); got != 2 {
+		t.Fatalf("serial after broken rotation = %d, want 2", got)
+	}
+}
+
+func TestClientCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mtls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const identity = "spiffe://cluster/dashboard"
+	ca := newTestCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "clients-ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	spiffe, _ := url.Parse(identity)
+	client := newTestCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "dashboard"},
+		URIs:         []*url.URL{spiffe},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+	server := newTestCert(t, &x509.Certificate{SerialNumber: big.NewInt(3), Subject: pkix.Name{CommonName: "aggregator"}}, nil)
+
+	var env config.Environment
+	env.TLSCertFile, env.TLSKeyFile = filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	server.write(t, env.TLSCertFile, env.TLSKeyFile, time.Now())
+	env.TLSClientCAFile = filepath.Join(dir, "ca.crt")
+	if err := ioutil.WriteFile(env.TLSClientCAFile, ca.certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	//Right verifier grants access only to identity from certificate
+	rf := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Client-Identity") != identity || r.Header.Get("Authorization") != "" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer rf.Close()
+
+	dsn := startDSN()
+	defer dsn.Close()
+
+	env.WebSocketPort = 8093
+	env.DSNHostPort = dsn.HostPort()
+	env.AuthFieldName = "auth_result"
+	env.RightVerifURL = rf.URL + "/check/"
+	env.RightVerifIdentityHeader = "X-Client-Identity"
+
+	logger := zerolog.Nop()
+	r, err := router.NewRouterHandler(&logger, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	srv, err := wsAPI.NewServer(r, nil, nil, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go wsAPI.ListenAndServe(srv)
+	defer srv.Shutdown(context.Background())
+
+	id := uuid.Must(uuid.NewV4())
+
+	//Return first message after subscription to device
+	subscribe := func(certs []tls.Certificate) map[string]interface{} {
+		dialer := ws.Dialer{Timeout: 2 * time.Second, TLSConfig: &tls.Config{InsecureSkipVerify: true, Certificates: certs}}
+		var conn net.Conn
+		for k := 0; ; k++ {
+			if conn, _, _, err = dialer.Dial(context.Background(), "wss://127.0.0.1:8093/ws/devices/status"); err == nil {
+				break
+			}
+			if k == 20 {
+				t.Fatal(err)
+			}
+			time.Sleep(250 * time.Millisecond)
+		}
+		defer conn.Close()
+
+		req, _ := json.Marshal(model.RequestMessage{TypeReq: "subscribe", Ids: []uuid.UUID{id}})
+		wsutil.WriteClientMessage(conn, ws.OpText, req)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		data, _, err := wsutil.ReadServerData(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg map[string]interface{}
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+
+	keyPair, err := tls.X509KeyPair(client.certPEM, client.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := subscribe([]tls.Certificate{keyPair}); msg["type"] != "status" || msg["online"] != true {
+		t.Fatalf("client with certificate is not subscribed: %v", msg)
+	}
+
+	//Client certificate is accepted instead of token, so close reason does not name only token
+	if msg := subscribe(nil); msg["type"] != "close" || msg["reason"] != "no credentials" {
+		t.Fatalf("unexpected message without credentials: %v", msg)
+	}
+}
+
+func TestMQTTPublishTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqtt-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "broker-ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	client := newTestCert(t, &x509.Certificate{SerialNumber: big.NewInt(2), Subject: pkix.Name{CommonName: "publisher"}}, ca)
+
+	//Source broker is shared with its TLS settings
+	var env config.Environment
+	env.MQTTBrokerURL = "tcp://127.0.0.1:1883"
+	if cfg, err := config.NewMQTTPublishTLSConfig(env); err != nil || cfg != nil {
+		t.Fatalf("shared broker without TLS: %v, %v", cfg, err)
+	}
+
+	env.MQTTPublishBrokerURL = "ssl://broker:8883"
+	env.MQTTPublishCAFile = filepath.Join(dir, "ca.crt")
+	if err := ioutil.WriteFile(env.MQTTPublishCAFile, ca.certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	env.MQTTPublishCertFile, env.MQTTPublishKeyFile = filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	client.write(t, env.MQTTPublishCertFile, env.MQTTPublishKeyFile, time.Now())
+
+	cfg, err := config.NewMQTTPublishTLSConfig(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RootCAs == nil || cfg.InsecureSkipVerify {
+		t.Errorf("broker is not verified by CA")
+	}
+	cert, err := cfg.GetClientCertificate(&tls.CertificateRequestInfo{})
+	if err != nil || len(cert.Certificate) == 0 {
+		t.Fatalf("no client certificate: %v", err)
+	}
+	if leaf, _ := x509.ParseCertificate(cert.Certificate[0]); leaf.SerialNumber.Int64() != 2 {
+		t.Errorf("client certificate serial = %d", leaf.SerialNumber.Int64())
+	}
+}
@@ -0,0 +1,72 @@
+package main_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	uuid "github.com/gofrs/uuid"
+	"github.com/stretchr/testify/assert"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/config"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/model"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/transform"
+)
+
+func TestTransformPipeline(t *testing.T) {
+	transforms := `{
+		"typeField": "fw",
+		"types": {
+			"v1": {"steps": [
+				{"rename": "temp", "to": "climate.temperature"},
+				{"convert": "climate.temperature", "from": "fahrenheit", "to": "celsius"},
+				{"convert": "battery.mv", "scale": 0.001},
+				{"rename": "battery.mv", "to": "battery.volts"},
+				{"compute": "battery.level", "expr": "(battery.volts - 3) / 1.2 * 100"},
+				{"drop": ["fw", "debug"]}
+			]}
+		}
+	}`
+	file, err := ioutil.TempFile("", "transforms*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(transforms)
+	file.Close()
+
+	var env config.Environment
+	env.TransformsFile = file.Name()
+	p, err := transform.NewPipeline(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	apply := func(extended string) map[string]interface{} {
+		raw := json.RawMessage(extended)
+		msg := &model.ResponseMessage{TypeRes: "status", ExtendedStatus: &raw}
+		if err := p.Apply(uuid.Must(uuid.NewV4()), msg); err != nil {
+			t.Fatal(err)
+		}
+		var r map[string]interface{}
+		if err := json.Unmarshal(*msg.ExtendedStatus, &r); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	got := apply(`{"fw": "v1", "temp": 212, "battery": {"mv": 3600}, "debug": {"x": 1}}`)
+	assert.InDelta(t, 100, got["climate"].(map[string]interface{})["temperature"], 1e-9)
+	battery := got["battery"].(map[string]interface{})
+	assert.InDelta(t, 3.6, battery["volts"], 1e-9)
+	assert.InDelta(t, 50, battery["level"], 1e-9)
+	assert.NotContains(t, battery, "mv")
+	assert.NotContains(t, got, "fw")
+	assert.NotContains(t, got, "debug")
+
+	//Field is not lost if it can not be moved through not object
+	assert.Equal(t, map[string]interface{}{"temp": 20.0, "climate": "n/a"}, apply(`{"fw": "v1", "temp": 20, "climate": "n/a"}`))
+
+	//Other firmware is not changed
+	assert.Equal(t, map[string]interface{}{"fw": "v2", "temp": 20.0}, apply(`{"fw": "v2", "temp": 20}`))
+}
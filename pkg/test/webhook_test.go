@@ -0,0 +1,213 @@
+package main_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	uuid "github.com/gofrs/uuid"
+	"github.com/rs/zerolog"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/config"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/model"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/router"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/webhook"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/worker"
+)
+
+func TestWebhookDispatcher(t *testing.T) {
+	received := make(chan webhook.Event, 5)
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.URL.Path == "/rejected" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if got := r.Header.Get(webhook.HeaderSignature); got != webhook.SignWebhook([]byte("secret"), r.Header.Get(webhook.HeaderTimestamp), body) {
+			t.Errorf("wrong signature: %s", got)
+		}
+		//First attempt fails, so delivery is retried
+		if calls++; calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var event webhook.Event
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Error(err)
+		}
+		received <- event
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var env config.Environment
+	env.WebhookRulesFile = filepath.Join(dir, "rules.json")
+	env.WebhookDeadLetterFile = filepath.Join(dir, "dead.jsonl")
+	env.WebhookRetries = 2
+	env.WebhookBackoff = 1
+	rules := fmt.Sprintf(`{"webhooks": [
+		{"name": "pager", "url": "%s/pager", "secret": "secret", "ids": ["%s"], "transitions": ["online->offline"]},
+		{"name": "rejected", "url": "%s/rejected", "transitions": ["*->online"]}
+	]}`, srv.URL, ok_device, srv.URL)
+	if err := ioutil.WriteFile(env.WebhookRulesFile, []byte(rules), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	rf := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer rf.Close()
+	env.RightVerifURL = rf.URL + "/check/"
+	env.DSNHostPort = "127.0.0.1:1"
+
+	logger := zerolog.Nop()
+	r, err := router.NewRouterHandler(&logger, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	d, err := webhook.NewDispatcher(env, &logger, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Run(context.Background())
+
+	id := uuid.FromStringOrNil(ok_device)
+	d.OnTransition(router.Transition{Id: id, From: model.PresenceUnknown, To: model.PresenceOnline, At: time.Now()})
+	d.OnTransition(router.Transition{Id: id, From: model.PresenceOnline, To: model.PresenceOffline, At: time.Now()})
+
+	select {
+	case event := <-received:
+		if event.Webhook != "pager" || event.Id != ok_device || event.From != model.PresenceOnline || event.To != model.PresenceOffline {
+			t.Errorf("unexpected event: %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook is not delivered")
+	}
+	d.Stop()
+
+	f, err := os.Open(env.WebhookDeadLetterFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var lines []string
+	for s := bufio.NewScanner(f); s.Scan(); {
+		lines = append(lines, s.Text())
+	}
+	if len(lines) != 1 {
+		t.Fatalf("expected one dead letter of rejected webhook, got: %v", lines)
+	}
+}
+
+func TestWebhookWatch(t *testing.T) {
+	received := make(chan webhook.Event, 5)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event webhook.Event
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Error(err)
+		}
+		received <- event
+	}))
+	defer srv.Close()
+
+	//Service identity of aggregator has access to devices
+	rf := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Client-Identity") != "aggregator" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer rf.Close()
+
+	broker, err := startMQTTBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	dir, err := ioutil.TempDir("", "webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	single, member := uuid.Must(uuid.NewV4()), uuid.Must(uuid.NewV4())
+
+	var env config.Environment
+	env.RightVerifURL = rf.URL + "/check/"
+	env.RightVerifIdentityHeader = "X-Client-Identity"
+	env.ServiceIdentity = "aggregator"
+	env.RouteLinger = 1
+	env.SourceType = worker.SourceMQTT
+	env.MQTTBrokerURL = broker.URL()
+	env.MQTTClientID = "aggregator"
+	env.MQTTStatusTopics = []string{"devices/{id}/status"}
+	env.GroupsFile = filepath.Join(dir, "groups.json")
+	env.GroupsRefreshPeriod = 1
+	env.WebhookRulesFile = filepath.Join(dir, "rules.json")
+	if err := ioutil.WriteFile(env.GroupsFile, []byte(fmt.Sprintf(`{"groups": {"fleet": ["%s"]}}`, member)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rules := fmt.Sprintf(`{"webhooks": [
+		{"name": "pager", "url": "%s", "ids": ["%s"], "groups": ["fleet"], "transitions": ["*->offline"]}
+	]}`, srv.URL, single)
+	if err := ioutil.WriteFile(env.WebhookRulesFile, []byte(rules), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	device := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(broker.URL()).SetClientID("device"))
+	if token := device.Connect(); !token.WaitTimeout(3*time.Second) || token.Error() != nil {
+		t.Fatalf("device connect: %v", token.Error())
+	}
+	defer device.Disconnect(0)
+	publish := func(id uuid.UUID, status int) {
+		device.Publish("devices/"+id.String()+"/status", 0, true, fmt.Sprintf(`{"status": %d}`, status)).WaitTimeout(3 * time.Second)
+	}
+	publish(single, 0)
+	publish(member, 1)
+
+	logger := zerolog.Nop()
+	r, err := router.NewRouterHandler(&logger, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	d, err := webhook.NewDispatcher(env, &logger, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.AddTransitionObserver(d)
+	d.Run(context.Background())
+	defer d.Stop()
+
+	//Device which is offline when it is observed first does not page
+	select {
+	case event := <-received:
+		t.Fatalf("unexpected event: %+v", event)
+	case <-time.After(time.Second):
+	}
+
+	//Member of group is watched without subscribed clients
+	publish(member, 0)
+	select {
+	case event := <-received:
+		if event.Id != member.String() || event.From != model.PresenceOnline || event.To != model.PresenceOffline {
+			t.Fatalf("unexpected event: %+v", event)
+		}
+	case <-time.After(4 * time.Second):
+		t.Fatal("webhook of group member is not delivered")
+	}
+
+}
@@ -0,0 +1,621 @@
+package main_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	uuid "github.com/gofrs/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/config"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/model"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/worker"
+)
+
+func TestSignDSNRequest(t *testing.T) {
+	got := worker.SignDSNRequest([]byte("secret"), "/ws/status/"+ok_device, "1700000000")
+	want := "8cf8de7ced463bbf207e433197dc9cc7f47164fd266977a27714b6deaede0833"
+	if got != want {
+		t.Errorf("SignDSNRequest() = %s, want %s", got, want)
+	}
+}
+
+func noCredentials() model.Credentials {
+	return model.Credentials{}
+}
+
+func TestDSNAuthModes(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+		conn, _, _, err := ws.UpgradeHTTP(r, w)
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer srv.Close()
+
+	path := "/ws/status/" + ok_device
+	user := model.Credentials{Token: "user-token", Identity: "spiffe://cluster/dashboard"}
+
+	tests := []struct {
+		name  string
+		mode  string
+		creds model.Credentials
+		check func(r *http.Request) bool
+	}{
+		{"legacy", worker.DSNAuthLegacy, user, func(r *http.Request) bool {
+			return r.URL.RawQuery == "auth_result=200" && r.Header.Get("Authorization") == ""
+		}},
+		{"token", worker.DSNAuthToken, user, func(r *http.Request) bool {
+			return r.Header.Get("Authorization") == "Bearer service-token"
+		}},
+		{"forward", worker.DSNAuthForward, user, func(r *http.Request) bool {
+			return r.Header.Get("Authorization") == "Bearer user-token" && r.URL.RawQuery == ""
+		}},
+		{"hmac", worker.DSNAuthHMAC, model.Credentials{}, func(r *http.Request) bool {
+			ts := r.Header.Get("X-DSN-Timestamp")
+			return r.Header.Get("X-DSN-Key-Id") == "aggregator" && ts != "" &&
+				r.Header.Get("X-DSN-Signature") == worker.SignDSNRequest([]byte("secret"), path, ts)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var env config.Environment
+			env.DSNHostPort = strings.TrimPrefix(srv.URL, "http://")
+			env.AuthFieldName = "auth_result"
+			env.DSNAuthMode = tt.mode
+			env.DSNAuthToken = "service-token"
+			env.DSNAuthKeyID = "aggregator"
+			env.DSNAuthSecret = "secret"
+
+			dialer, err := worker.NewDSNDialer(env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, _, err := dialer.Dial(context.Background(), url.URL{Host: env.DSNHostPort, Path: path}, tt.creds)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+
+			if r := <-requests; !tt.check(r) {
+				t.Errorf("unexpected request: %s %v", r.URL, r.Header)
+			}
+		})
+	}
+
+	//Identity from client certificate could not be forwarded, nothing is sent to DSN
+	var env config.Environment
+	env.DSNHostPort = strings.TrimPrefix(srv.URL, "http://")
+	env.DSNAuthMode = worker.DSNAuthForward
+	dialer, err := worker.NewDSNDialer(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = dialer.Dial(context.Background(), url.URL{Host: env.DSNHostPort, Path: path}, model.Credentials{Identity: user.Identity})
+	if e := model.AsError(err); err == nil || e.Code != model.ErrorCodeForbidden {
+		t.Errorf("Dial() without token = %v, want FORBIDDEN", err)
+	}
+	select {
+	case r := <-requests:
+		t.Errorf("request without token is sent: %v", r.Header)
+	default:
+	}
+}
+
+//Return sum of samples of metric with label value, counters are summed as is
+func metricValue(t *testing.T, name, label, value string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sum float64
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			matched := label == ""
+			for _, l := range m.GetLabel() {
+				matched = matched || (l.GetName() == label && l.GetValue() == value)
+			}
+			if !matched {
+				continue
+			}
+			sum += m.GetCounter().GetValue() + float64(m.GetHistogram().GetSampleCount())
+		}
+	}
+	return sum
+}
+
+func TestDSNPinger(t *testing.T) {
+	silent := uuid.Must(uuid.NewV4())
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _, err := ws.UpgradeHTTP(r, w)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		wsutil.WriteServerMessage(conn, ws.OpText, []byte(`{"status": 1}`))
+		if strings.HasSuffix(r.URL.Path, silent.String()) {
+			//Pings are read, but never answered
+			io.Copy(ioutil.Discard, conn)
+			return
+		}
+		for {
+			//Pings are answered with pongs by control frame handler
+			if _, _, err := wsutil.ReadClientData(conn); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	var env config.Environment
+	env.DSNHostPort = strings.TrimPrefix(srv.URL, "http://")
+	env.DSNPingPeriod = 1
+
+	dialer, err := worker.NewDSNDialer(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := zerolog.Nop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rttName := "device_status_aggregator_dsn_ping_rtt_seconds"
+	timeoutsName := "device_status_aggregator_dsn_ping_timeouts_total"
+	rttBefore := metricValue(t, rttName, "endpoint", env.DSNHostPort)
+	timeoutsBefore := metricValue(t, timeoutsName, "", "")
+
+	answeredChan := make(chan *model.ResponseMessage, 5)
+	silentChan := make(chan *model.ResponseMessage, 5)
+	worker.NewRequesterStatusHandler(uuid.FromStringOrNil(ok_device), env, dialer, nil, noCredentials, &logger).Run(ctx, answeredChan)
+	worker.NewRequesterStatusHandler(silent, env, dialer, nil, noCredentials, &logger).Run(ctx, silentChan)
+
+	for _, ch := range []chan *model.ResponseMessage{answeredChan, silentChan} {
+		select {
+		case msg := <-ch:
+			if msg.Online == nil || !*msg.Online {
+				t.Fatalf("unexpected status: %+v", msg)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("timeout waiting for status")
+		}
+	}
+
+	//Connection without pong is closed on next ping and status becomes stale
+	select {
+	case msg := <-silentChan:
+		if !msg.IsStale() {
+			t.Fatalf("unexpected message: %+v", msg)
+		}
+	case <-time.After(4 * time.Second):
+		t.Fatal("connection without pong is not closed")
+	}
+	if got := metricValue(t, timeoutsName, "", ""); got != timeoutsBefore+1 {
+		t.Errorf("ping timeouts = %v, want %v", got, timeoutsBefore+1)
+	}
+
+	//Answered connection is kept and its rtt is observed per endpoint
+	select {
+	case msg := <-answeredChan:
+		t.Fatalf("unexpected message: %+v", msg)
+	default:
+	}
+	if got := metricValue(t, rttName, "endpoint", env.DSNHostPort); got <= rttBefore {
+		t.Errorf("ping rtt of %s is not observed", env.DSNHostPort)
+	}
+}
+
+func TestBackendSelector(t *testing.T) {
+	routes := `{
+		"rules": [
+			{"id": "74a7b5f6-369d-4d10-88e2-dbdff3f4a0b9", "backend": "us"},
+			{"prefix": "74", "backend": "eu"},
+			{"from": "80000000-0000-0000-0000-000000000000", "to": "8fffffff-ffff-ffff-ffff-ffffffffffff", "backend": "us"}
+		]
+	}`
+	file, err := ioutil.TempFile("", "routes*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.WriteString(routes); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	var env config.Environment
+	env.DSNBackends = []string{"eu=dsn-eu:8999", "us=dsn-us:8999"}
+	env.DSNRoutesFile = file.Name()
+
+	selector, err := worker.NewBackendSelector(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{id: ok_device, want: "us"},
+		{id: "74000000-0000-0000-0000-000000000000", want: "eu"},
+		{id: "8a000000-0000-0000-0000-000000000000", want: "us"},
+	}
+	for _, tt := range tests {
+		if got := selector.Select(uuid.FromStringOrNil(tt.id)); got.Name != tt.want {
+			t.Errorf("Select(%s) = %s, want %s", tt.id, got.Name, tt.want)
+		}
+	}
+
+	//Unmatched id is spread by consistent hash and must be stable
+	id := uuid.FromStringOrNil("10000000-0000-0000-0000-000000000000")
+	if first, second := selector.Select(id), selector.Select(id); first.Name != second.Name {
+		t.Errorf("Select(%s) is not stable: %s, %s", id, first.Name, second.Name)
+	}
+}
+
+func TestBackendFailover(t *testing.T) {
+	var env config.Environment
+	env.DSNHostPort = "dsn-1:8999,dsn-2:8999"
+	env.DSNFailureThreshold = 1
+	env.DSNCircuitOpenPeriod = 60
+
+	selector, err := worker.NewBackendSelector(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := selector.Select(uuid.FromStringOrNil(ok_device))
+
+	first := backend.Pick(nil, false)
+	if first.HostPort != "dsn-1:8999" {
+		t.Fatalf("Pick() = %s, want dsn-1:8999", first.HostPort)
+	}
+
+	first.ReportFailure()
+	second := backend.Pick(first, true)
+	if second.HostPort != "dsn-2:8999" {
+		t.Fatalf("Pick() after failure = %s, want dsn-2:8999", second.HostPort)
+	}
+
+	//First endpoint circuit is open, so second is kept even on failover
+	if got := backend.Pick(second, true); got != second {
+		t.Errorf("Pick() with open circuit = %s, want dsn-2:8999", got.HostPort)
+	}
+
+	first.ReportSuccess()
+	if got := backend.Pick(second, true); got != first {
+		t.Errorf("Pick() after recovery = %s, want dsn-1:8999", got.HostPort)
+	}
+}
+
+func TestEndpointHalfOpen(t *testing.T) {
+	var env config.Environment
+	env.DSNHostPort = "dsn-1:8999"
+	env.DSNFailureThreshold = 1
+	env.DSNCircuitOpenPeriod = 1
+
+	selector, err := worker.NewBackendSelector(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := selector.Select(uuid.FromStringOrNil(ok_device))
+	endpoint := backend.Pick(nil, false)
+
+	endpoint.ReportFailure()
+	if got := backend.Pick(nil, false); got != nil {
+		t.Fatalf("Pick() with open circuit = %s, want nil", got.HostPort)
+	}
+
+	//Only one worker probes endpoint after open period
+	time.Sleep(1100 * time.Millisecond)
+	if got := backend.Pick(nil, false); got != endpoint {
+		t.Fatal("Pick() in half-open state does not allow probe")
+	}
+	if got := backend.Pick(nil, false); got != nil {
+		t.Fatal("Pick() allows second probe while first is in flight")
+	}
+
+	//Failed probe opens circuit again
+	endpoint.ReportFailure()
+	if got := backend.Pick(nil, false); got != nil {
+		t.Fatal("Pick() after failed probe allows connection")
+	}
+
+	//Successful probe closes circuit for everyone
+	time.Sleep(1100 * time.Millisecond)
+	if got := backend.Pick(nil, false); got != endpoint {
+		t.Fatal("Pick() in half-open state does not allow probe")
+	}
+	endpoint.ReportSuccess()
+	for k := 0; k < 2; k++ {
+		if got := backend.Pick(nil, false); got != endpoint {
+			t.Fatal("Pick() after successful probe does not allow connection")
+		}
+	}
+}
+
+func TestHTTPPollSource(t *testing.T) {
+	status := 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/status/"+ok_device {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `{"status": %d}`, status)
+	}))
+	defer srv.Close()
+
+	var env config.Environment
+	env.SourceType = worker.SourceHTTP
+	env.HTTPSourceURL = srv.URL + "/status/"
+	env.HTTPSourcePollPeriod = 1
+
+	logger := zerolog.Nop()
+	factory, err := worker.NewSourceFactory(env, &logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer factory.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	respChan := make(chan *model.ResponseMessage, 5)
+	factory.NewSource(uuid.FromStringOrNil(ok_device), noCredentials, &logger).Run(ctx, respChan)
+	factory.NewSource(uuid.FromStringOrNil("00000000-0000-0000-0000-000000000001"), noCredentials, &logger).Run(ctx, respChan)
+
+	var online, notFound bool
+	for !online || !notFound {
+		select {
+		case msg := <-respChan:
+			switch {
+			case msg.TypeRes == "status" && msg.Online != nil && *msg.Online:
+				online = true
+			case msg.ErrorResp != nil && msg.ErrorResp.TypeRes == string(model.ErrorCodeNotFound):
+				notFound = true
+			default:
+				t.Errorf("unexpected message: %+v", msg)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timeout, online: %v, not found: %v", online, notFound)
+		}
+	}
+
+	//Same body must not be sent again
+	select {
+	case msg := <-respChan:
+		t.Errorf("unexpected message: %+v", msg)
+	case <-time.After(1500 * time.Millisecond):
+	}
+}
+
+func TestMQTTSource(t *testing.T) {
+	broker, err := startMQTTBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	var env config.Environment
+	env.SourceType = worker.SourceMQTT
+	env.MQTTBrokerURL = broker.URL()
+	env.MQTTClientID = "aggregator"
+	env.MQTTQoS = 1
+	env.MQTTStatusTopics = []string{"devices/{id}/status"}
+	env.MQTTPresenceTopics = []string{"devices/{id}/lwt"}
+	env.MQTTOnlinePayload = "online"
+	env.MQTTOfflinePayload = "offline"
+
+	//Device publishes retained status and has last will on presence topic
+	device := mqtt.NewClient(mqtt.NewClientOptions().
+		AddBroker(broker.URL()).
+		SetClientID("device").
+		SetAutoReconnect(false).
+		SetWill("devices/"+ok_device+"/lwt", "offline", 1, true))
+	if token := device.Connect(); !token.WaitTimeout(3*time.Second) || token.Error() != nil {
+		t.Fatalf("device connect: %v", token.Error())
+	}
+	token := device.Publish("devices/"+ok_device+"/status", 1, true, `{"status": 1, "extendedStatus": {"battery": 80}}`)
+	if !token.WaitTimeout(3*time.Second) || token.Error() != nil {
+		t.Fatalf("device publish: %v", token.Error())
+	}
+
+	logger := zerolog.Nop()
+	factory, err := worker.NewSourceFactory(env, &logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer factory.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	respChan := make(chan *model.ResponseMessage, 5)
+	factory.NewSource(uuid.FromStringOrNil(ok_device), noCredentials, &logger).Run(ctx, respChan)
+
+	wait := func(online bool) *model.ResponseMessage {
+		for {
+			select {
+			case msg := <-respChan:
+				if msg.TypeRes == "status" && msg.Online != nil && *msg.Online == online {
+					return msg
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timeout waiting for online: %v", online)
+			}
+		}
+	}
+
+	msg := wait(true)
+	if msg.ExtendedStatus == nil || string(*msg.ExtendedStatus) != `{"battery": 80}` {
+		t.Errorf("unexpected extendedStatus of retained status: %+v", msg.ExtendedStatus)
+	}
+	//Endpoint is host of broker without scheme and credentials
+	if brokerURL, _ := url.Parse(broker.URL()); msg.Endpoint != brokerURL.Host {
+		t.Errorf("unexpected endpoint: %s", msg.Endpoint)
+	}
+
+	//Last will of device is published by broker
+	broker.Kick("device")
+	msg = wait(false)
+	if msg.ExtendedStatus == nil || string(*msg.ExtendedStatus) != `{"battery": 80}` {
+		t.Errorf("extendedStatus of last status is lost: %+v", msg.ExtendedStatus)
+	}
+}
+
+func TestMQTTSourceSlowReceiver(t *testing.T) {
+	broker, err := startMQTTBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	var env config.Environment
+	env.SourceType = worker.SourceMQTT
+	env.MQTTBrokerURL = broker.URL()
+	env.MQTTClientID = "aggregator"
+	env.MQTTStatusTopics = []string{"devices/{id}/status"}
+
+	device := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(broker.URL()).SetClientID("device").SetAutoReconnect(false))
+	if token := device.Connect(); !token.WaitTimeout(3*time.Second) || token.Error() != nil {
+		t.Fatalf("device connect: %v", token.Error())
+	}
+	defer device.Disconnect(0)
+	publish := func(id uuid.UUID, battery int) {
+		token := device.Publish("devices/"+id.String()+"/status", 1, false, fmt.Sprintf(`{"status": 1, "extendedStatus": {"battery": %d}}`, battery))
+		if !token.WaitTimeout(3*time.Second) || token.Error() != nil {
+			t.Fatalf("device publish: %v", token.Error())
+		}
+	}
+	receive := func(ch chan *model.ResponseMessage, battery int) {
+		want := fmt.Sprintf(`{"battery": %d}`, battery)
+		for {
+			select {
+			case msg := <-ch:
+				if msg.ExtendedStatus != nil && string(*msg.ExtendedStatus) == want {
+					return
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timeout waiting for %s", want)
+			}
+		}
+	}
+
+	logger := zerolog.Nop()
+	factory, err := worker.NewSourceFactory(env, &logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer factory.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	//Nobody reads statuses of slow device
+	slow := uuid.Must(uuid.NewV4())
+	slowChan := make(chan *model.ResponseMessage)
+	factory.NewSource(slow, noCredentials, &logger).Run(ctx, slowChan)
+	for battery := 1; battery <= 5; battery++ {
+		publish(slow, battery)
+	}
+
+	//Other devices are still served by the shared connection
+	fast := uuid.Must(uuid.NewV4())
+	fastChan := make(chan *model.ResponseMessage, 5)
+	factory.NewSource(fast, noCredentials, &logger).Run(ctx, fastChan)
+	publish(fast, 1)
+	receive(fastChan, 1)
+
+	//Statuses which were not received are replaced by the latest one
+	receive(slowChan, 5)
+
+	//Stopped source does not remove subscription of new source of the same device
+	stopped := factory.NewSource(fast, noCredentials, &logger)
+	stopped.Run(ctx, make(chan *model.ResponseMessage))
+	stopped.Stop()
+	restarted := make(chan *model.ResponseMessage, 5)
+	factory.NewSource(fast, noCredentials, &logger).Run(ctx, restarted)
+	time.Sleep(200 * time.Millisecond)
+	publish(fast, 2)
+	receive(restarted, 2)
+}
+
+func TestTelemetryValidator(t *testing.T) {
+	schemas := `{
+		"typeField": "model",
+		"types": {
+			"thermostat": {"schema": {
+				"type": "object",
+				"required": ["temperature"],
+				"properties": {"temperature": {"type": "number"}}
+			}},
+			"lock": {"ids": ["74a7b5f6-369d-4d10-88e2-dbdff3f4a0b9"], "schema": {"type": "object", "required": ["locked"]}}
+		}
+	}`
+	file, err := ioutil.TempFile("", "schemas*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(schemas)
+	file.Close()
+
+	var env config.Environment
+	env.TelemetrySchemasFile = file.Name()
+	env.TelemetryInvalidAction = worker.InvalidTelemetryFlag
+	logger := zerolog.Nop()
+
+	status := func(telemetry string) *model.DeviceStatusFromDSN {
+		raw := json.RawMessage(telemetry)
+		return &model.DeviceStatusFromDSN{Status: 1, DeviceTelemetry: &raw}
+	}
+	other := uuid.Must(uuid.NewV4())
+
+	v, err := worker.NewTelemetryValidator(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		id        uuid.UUID
+		telemetry string
+		invalid   bool
+	}{
+		{other, `{"model": "thermostat", "temperature": 21.5}`, false},
+		{other, `{"model": "thermostat", "temperature": "hot"}`, true},
+		//Device without schema is not validated
+		{other, `{"model": "camera"}`, false},
+		//Listed device has type regardless of telemetry
+		{uuid.FromStringOrNil(ok_device), `{"model": "thermostat", "temperature": 21.5}`, true},
+		{uuid.FromStringOrNil(ok_device), `{"locked": true}`, false},
+	}
+	for _, c := range cases {
+		msg := v.ResponseMessage(c.id, status(c.telemetry), &logger)
+		if got := msg.InvalidTelemetry != nil && *msg.InvalidTelemetry; got != c.invalid {
+			t.Errorf("%s: invalid = %v, want %v", c.telemetry, got, c.invalid)
+		}
+	}
+
+	env.TelemetryInvalidAction = worker.InvalidTelemetryDrop
+	if v, err = worker.NewTelemetryValidator(env); err != nil {
+		t.Fatal(err)
+	}
+	if msg := v.ResponseMessage(other, status(`{"model": "thermostat"}`), &logger); msg != nil {
+		t.Errorf("invalid telemetry is not dropped: %+v", msg)
+	}
+}
@@ -0,0 +1,174 @@
+package transform
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+//Arithmetic expression of computed field, e.g. `battery.mv / 42`.
+//Operands are numbers and dot separated paths of numeric fields
+type calc interface {
+	//ok is false if field is missing or not a number
+	eval(obj map[string]interface{}) (v float64, ok bool)
+}
+
+func parseCalc(s string) (calc, error) {
+	p := &calcParser{s: []rune(s)}
+	c, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.s) {
+		return nil, fmt.Errorf("unexpected %q at %d", p.s[p.pos], p.pos)
+	}
+	return c, nil
+}
+
+type calcParser struct {
+	s   []rune
+	pos int
+}
+
+func (p *calcParser) skipSpace() {
+	for p.pos < len(p.s) && unicode.IsSpace(p.s[p.pos]) {
+		p.pos++
+	}
+}
+
+//Return next operator from ops and consume it
+func (p *calcParser) op(ops string) (rune, bool) {
+	p.skipSpace()
+	if p.pos < len(p.s) && strings.ContainsRune(ops, p.s[p.pos]) {
+		p.pos++
+		return p.s[p.pos-1], true
+	}
+	return 0, false
+}
+
+func (p *calcParser) sum() (calc, error) {
+	left, err := p.product()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.op("+-")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.product()
+		if err != nil {
+			return nil, err
+		}
+		left = &binary{op: op, left: left, right: right}
+	}
+}
+
+func (p *calcParser) product() (calc, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.op("*/")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = &binary{op: op, left: left, right: right}
+	}
+}
+
+func (p *calcParser) unary() (calc, error) {
+	if _, ok := p.op("-"); ok {
+		c, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &binary{op: '-', left: number(0), right: c}, nil
+	}
+	if _, ok := p.op("("); ok {
+		c, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := p.op(")"); !ok {
+			return nil, fmt.Errorf("expected ) at %d", p.pos)
+		}
+		return c, nil
+	}
+
+	p.skipSpace()
+	start := p.pos
+	switch {
+	case p.pos < len(p.s) && (unicode.IsDigit(p.s[p.pos]) || p.s[p.pos] == '.'):
+		for p.pos < len(p.s) && (unicode.IsDigit(p.s[p.pos]) || p.s[p.pos] == '.' || p.s[p.pos] == 'e') {
+			p.pos++
+		}
+		f, err := strconv.ParseFloat(string(p.s[start:p.pos]), 64)
+		if err != nil {
+			return nil, err
+		}
+		return number(f), nil
+	case p.pos < len(p.s) && (unicode.IsLetter(p.s[p.pos]) || p.s[p.pos] == '_'):
+		for p.pos < len(p.s) && (unicode.IsLetter(p.s[p.pos]) || unicode.IsDigit(p.s[p.pos]) || p.s[p.pos] == '_' || p.s[p.pos] == '.') {
+			p.pos++
+		}
+		return field(strings.Split(string(p.s[start:p.pos]), ".")), nil
+	case p.pos < len(p.s):
+		return nil, fmt.Errorf("unexpected %q at %d", p.s[p.pos], p.pos)
+	default:
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+}
+
+type number float64
+
+func (n number) eval(obj map[string]interface{}) (float64, bool) {
+	return float64(n), true
+}
+
+type field []string
+
+func (f field) eval(obj map[string]interface{}) (float64, bool) {
+	v, ok := get(obj, f)
+	if !ok {
+		return 0, false
+	}
+	n, ok := v.(float64)
+	return n, ok
+}
+
+type binary struct {
+	op          rune
+	left, right calc
+}
+
+func (b *binary) eval(obj map[string]interface{}) (float64, bool) {
+	l, ok := b.left.eval(obj)
+	if !ok {
+		return 0, false
+	}
+	r, ok := b.right.eval(obj)
+	if !ok {
+		return 0, false
+	}
+	switch b.op {
+	case '+':
+		return l + r, true
+	case '-':
+		return l - r, true
+	case '*':
+		return l * r, true
+	default:
+		if r == 0 {
+			return 0, false
+		}
+		return l / r, true
+	}
+}
@@ -0,0 +1,252 @@
+package transform
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strings"
+
+	uuid "github.com/gofrs/uuid"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/config"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/devicetype"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/model"
+)
+
+//Transforms is content of transforms file
+type Transforms struct {
+	//Dot separated path of field in extendedStatus with type of device, used if device is not listed in types
+	TypeField string `json:"typeField"`
+	//Type of device which is not listed and has no type field
+	Default string          `json:"default"`
+	Types   map[string]Type `json:"types"`
+}
+
+type Type struct {
+	Ids   []uuid.UUID `json:"ids"`
+	Steps []Step      `json:"steps"`
+}
+
+//Step of pipeline, exactly one of rename, drop, convert and compute is set. Fields are dot separated paths
+type Step struct {
+	//Move field to path To
+	Rename string `json:"rename,omitempty"`
+	//Remove fields
+	Drop []string `json:"drop,omitempty"`
+	//Convert numeric field with units From and To, or as value*Scale + Offset
+	Convert string   `json:"convert,omitempty"`
+	From    string   `json:"from,omitempty"`
+	To      string   `json:"to,omitempty"`
+	Scale   *float64 `json:"scale,omitempty"`
+	Offset  float64  `json:"offset,omitempty"`
+	//Set field to result of arithmetic Expr on other fields
+	Compute string `json:"compute,omitempty"`
+	Expr    string `json:"expr,omitempty"`
+}
+
+type step func(obj map[string]interface{})
+
+//Pipeline normalizes extendedStatus by steps of device type. Steps are applied in order,
+//step is skipped if its fields are missing. Nil pipeline does nothing
+type Pipeline struct {
+	types *devicetype.Resolver
+	steps map[string][]step
+}
+
+//Return nil if transforms file is not configured
+func NewPipeline(env config.Environment) (*Pipeline, error) {
+
+	if env.TransformsFile == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(env.TransformsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transforms: %w", err)
+	}
+	var transforms Transforms
+	if err := json.Unmarshal(data, &transforms); err != nil {
+		return nil, fmt.Errorf("failed to parse transforms: %w", err)
+	}
+
+	p := &Pipeline{
+		types: devicetype.NewResolver(transforms.TypeField, transforms.Default),
+		steps: make(map[string][]step, len(transforms.Types)),
+	}
+	for name, t := range transforms.Types {
+		for i, s := range t.Steps {
+			st, err := newStep(s)
+			if err != nil {
+				return nil, fmt.Errorf("device type %s, step %d: %w", name, i, err)
+			}
+			p.steps[name] = append(p.steps[name], st)
+		}
+		p.types.AddIds(name, t.Ids)
+	}
+	return p, nil
+}
+
+//Transform extendedStatus of status message, msg must not be routed yet. Message is not changed on error
+func (p *Pipeline) Apply(id uuid.UUID, msg *model.ResponseMessage) error {
+
+	if p == nil || msg.ExtendedStatus == nil {
+		return nil
+	}
+	steps := p.steps[p.types.Type(id, *msg.ExtendedStatus)]
+	if len(steps) == 0 {
+		return nil
+	}
+
+	var obj map[string]interface{}
+	if err := json.Unmarshal(*msg.ExtendedStatus, &obj); err != nil || obj == nil {
+		return fmt.Errorf("extendedStatus is not object")
+	}
+	for _, st := range steps {
+		st(obj)
+	}
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	raw := json.RawMessage(data)
+	msg.ExtendedStatus = &raw
+	return nil
+}
+
+func newStep(s Step) (step, error) {
+
+	set := 0
+	for _, ok := range []bool{s.Rename != "", len(s.Drop) > 0, s.Convert != "", s.Compute != ""} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, fmt.Errorf("step must have one of rename, drop, convert, compute")
+	}
+
+	switch {
+	case s.Rename != "":
+		if s.To == "" {
+			return nil, fmt.Errorf("rename %s has no to", s.Rename)
+		}
+		from, to := path(s.Rename), path(s.To)
+		return func(obj map[string]interface{}) {
+			v, ok := remove(obj, from)
+			if !ok {
+				return
+			}
+			//Field is kept if path To goes through not object
+			if !settable(obj, to) {
+				put(obj, from, v)
+				return
+			}
+			put(obj, to, v)
+		}, nil
+
+	case len(s.Drop) > 0:
+		paths := make([][]string, 0, len(s.Drop))
+		for _, d := range s.Drop {
+			paths = append(paths, path(d))
+		}
+		return func(obj map[string]interface{}) {
+			for _, p := range paths {
+				remove(obj, p)
+			}
+		}, nil
+
+	case s.Convert != "":
+		scale, offset := 1.0, s.Offset
+		switch {
+		case s.Scale != nil:
+			scale = *s.Scale
+		case s.From != "" || s.To != "":
+			var err error
+			if scale, offset, err = conversion(s.From, s.To); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("convert %s has no units or scale", s.Convert)
+		}
+		p := path(s.Convert)
+		return func(obj map[string]interface{}) {
+			if v, ok := get(obj, p); ok {
+				if n, ok := v.(float64); ok {
+					put(obj, p, n*scale+offset)
+				}
+			}
+		}, nil
+
+	default:
+		c, err := parseCalc(s.Expr)
+		if err != nil {
+			return nil, fmt.Errorf("compute %s: wrong expression %q: %w", s.Compute, s.Expr, err)
+		}
+		p := path(s.Compute)
+		return func(obj map[string]interface{}) {
+			if v, ok := c.eval(obj); ok && !math.IsInf(v, 0) && !math.IsNaN(v) {
+				put(obj, p, v)
+			}
+		}, nil
+	}
+}
+
+func path(s string) []string {
+	return strings.Split(s, ".")
+}
+
+func get(obj map[string]interface{}, p []string) (interface{}, bool) {
+	for _, key := range p[:len(p)-1] {
+		next, ok := obj[key].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		obj = next
+	}
+	v, ok := obj[p[len(p)-1]]
+	return v, ok
+}
+
+//Return false if path goes through not object, so value can not be set
+func settable(obj map[string]interface{}, p []string) bool {
+	for _, key := range p[:len(p)-1] {
+		next, ok := obj[key]
+		if !ok {
+			return true
+		}
+		if obj, ok = next.(map[string]interface{}); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+//Set value, missing objects on path are created. Value is not set if path goes through not object
+func put(obj map[string]interface{}, p []string, v interface{}) {
+	for _, key := range p[:len(p)-1] {
+		next, ok := obj[key]
+		if !ok {
+			created := make(map[string]interface{})
+			obj[key] = created
+			obj = created
+			continue
+		}
+		if obj, ok = next.(map[string]interface{}); !ok {
+			return
+		}
+	}
+	obj[p[len(p)-1]] = v
+}
+
+func remove(obj map[string]interface{}, p []string) (interface{}, bool) {
+	for _, key := range p[:len(p)-1] {
+		next, ok := obj[key].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		obj = next
+	}
+	v, ok := obj[p[len(p)-1]]
+	delete(obj, p[len(p)-1])
+	return v, ok
+}
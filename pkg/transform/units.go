@@ -0,0 +1,60 @@
+package transform
+
+import "fmt"
+
+//Unit is converted to base unit of its dimension as value*factor + offset
+type unit struct {
+	dimension string
+	factor    float64
+	offset    float64
+}
+
+var units = map[string]unit{
+	"celsius":    {"temperature", 1, 0},
+	"fahrenheit": {"temperature", 5.0 / 9.0, -160.0 / 9.0},
+	"kelvin":     {"temperature", 1, -273.15},
+	"V":          {"voltage", 1, 0},
+	"mV":         {"voltage", 0.001, 0},
+	"A":          {"current", 1, 0},
+	"mA":         {"current", 0.001, 0},
+	"W":          {"power", 1, 0},
+	"mW":         {"power", 0.001, 0},
+	"kW":         {"power", 1000, 0},
+	"Wh":         {"energy", 1, 0},
+	"kWh":        {"energy", 1000, 0},
+	"J":          {"energy", 1.0 / 3600, 0},
+	"m":          {"length", 1, 0},
+	"mm":         {"length", 0.001, 0},
+	"cm":         {"length", 0.01, 0},
+	"km":         {"length", 1000, 0},
+	"in":         {"length", 0.0254, 0},
+	"ft":         {"length", 0.3048, 0},
+	"mi":         {"length", 1609.344, 0},
+	"Pa":         {"pressure", 1, 0},
+	"hPa":        {"pressure", 100, 0},
+	"kPa":        {"pressure", 1000, 0},
+	"bar":        {"pressure", 100000, 0},
+	"psi":        {"pressure", 6894.757, 0},
+	"s":          {"time", 1, 0},
+	"ms":         {"time", 0.001, 0},
+	"min":        {"time", 60, 0},
+	"h":          {"time", 3600, 0},
+	"fraction":   {"ratio", 1, 0},
+	"percent":    {"ratio", 0.01, 0},
+}
+
+//Return scale and offset to convert value from one unit to another as value*scale + offset
+func conversion(from, to string) (scale float64, offset float64, err error) {
+	f, ok := units[from]
+	if !ok {
+		return 0, 0, fmt.Errorf("unknown unit %q", from)
+	}
+	t, ok := units[to]
+	if !ok {
+		return 0, 0, fmt.Errorf("unknown unit %q", to)
+	}
+	if f.dimension != t.dimension {
+		return 0, 0, fmt.Errorf("can not convert %s to %s", from, to)
+	}
+	return f.factor / t.factor, (f.offset - t.offset) / t.factor, nil
+}
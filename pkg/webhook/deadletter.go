@@ -0,0 +1,65 @@
+package webhook
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+type deadLetter struct {
+	Webhook  string    `json:"webhook"`
+	URL      string    `json:"url"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failedAt"`
+	Event    Event     `json:"event"`
+}
+
+//Failed deliveries as JSON lines in file. They are only logged if file is not configured
+type deadLetterLog struct {
+	sync.Mutex
+	file   string
+	logger zerolog.Logger
+}
+
+func newDeadLetterLog(file string, logger zerolog.Logger) *deadLetterLog {
+	return &deadLetterLog{file: file, logger: logger}
+}
+
+func (l *deadLetterLog) write(dl *delivery, attempts int, err error) {
+
+	entry := deadLetter{
+		Webhook:  dl.rule.Name,
+		URL:      dl.rule.URL,
+		Attempts: attempts,
+		Error:    err.Error(),
+		FailedAt: time.Now().UTC(),
+		Event:    dl.event,
+	}
+	line, jerr := json.Marshal(entry)
+	if jerr != nil {
+		l.logger.Err(jerr).Msg("failed to encode dead letter")
+		return
+	}
+	l.logger.Error().Err(err).Msgf("Webhook %s for id: %s is not delivered after %d attempts", entry.Webhook, entry.Event.Id, attempts)
+
+	if l.file == "" {
+		l.logger.Error().RawJSON("DEAD_LETTER", line).Msg("Dead letter")
+		return
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	f, ferr := os.OpenFile(l.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if ferr != nil {
+		l.logger.Err(ferr).RawJSON("DEAD_LETTER", line).Msg("failed to open dead-letter log")
+		return
+	}
+	defer f.Close()
+	if _, ferr := f.Write(append(line, '\n')); ferr != nil {
+		l.logger.Err(ferr).RawJSON("DEAD_LETTER", line).Msg("failed to write dead-letter log")
+	}
+}
@@ -0,0 +1,328 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	uuid "github.com/gofrs/uuid"
+	"github.com/rs/zerolog"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/config"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/model"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/router"
+)
+
+const (
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+
+	queueSize   = 1000
+	workers     = 4
+	maxBackoff  = 5 * time.Minute
+	httpTimeout = 10 * time.Second
+)
+
+//Event is payload of webhook
+type Event struct {
+	Webhook string                 `json:"webhook"`
+	Id      string                 `json:"id"`
+	From    model.Presence         `json:"from,omitempty"`
+	To      model.Presence         `json:"to,omitempty"`
+	At      time.Time              `json:"at"`
+	Status  *model.ResponseMessage `json:"status,omitempty"`
+	Alert   *model.Alert           `json:"alert,omitempty"`
+}
+
+type delivery struct {
+	rule  *rule
+	event Event
+}
+
+//Dispatcher posts events of matching rules on transitions observed by router and on alerts.
+//Failed deliveries are retried with exponential backoff and written to dead-letter log at the end.
+//First presence of device observed after start is not a transition for webhooks
+type Dispatcher struct {
+	//Guards members of groups of rules
+	membersMu     sync.RWMutex
+	rules         []*rule
+	router        *router.RouterHandler
+	watcher       *router.Watcher
+	creds         model.Credentials
+	refreshPeriod time.Duration
+	client        *http.Client
+	queue         chan *delivery
+	retries       int
+	backoff       time.Duration
+	deadLetter    *deadLetterLog
+	logger        zerolog.Logger
+	cancelF       context.CancelFunc
+	wg            sync.WaitGroup
+}
+
+//Devices and groups of rules are watched via r with service identity
+func NewDispatcher(env config.Environment, logger *zerolog.Logger, r *router.RouterHandler) (*Dispatcher, error) {
+
+	rules, err := loadRules(env.WebhookRulesFile)
+	if err != nil {
+		return nil, err
+	}
+
+	backoff := time.Duration(env.WebhookBackoff) * time.Second
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+
+	refreshPeriod := time.Duration(env.GroupsRefreshPeriod) * time.Second
+	if refreshPeriod <= 0 {
+		refreshPeriod = time.Minute
+	}
+
+	l := logger.With().Str("COMPONENT", "webhook").Logger()
+	creds := model.Credentials{Identity: env.ServiceIdentity}
+	return &Dispatcher{
+		rules:         rules,
+		router:        r,
+		watcher:       router.NewWatcher(r, creds, &l),
+		creds:         creds,
+		refreshPeriod: refreshPeriod,
+		client:        &http.Client{Timeout: httpTimeout},
+		queue:         make(chan *delivery, queueSize),
+		retries:       env.WebhookRetries,
+		backoff:       backoff,
+		deadLetter:    newDeadLetterLog(env.WebhookDeadLetterFile, l),
+		logger:        l,
+	}, nil
+}
+
+func (d *Dispatcher) Run(ctx context.Context) {
+	ctx, d.cancelF = context.WithCancel(ctx)
+
+	d.refresh()
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		ticker := time.NewTicker(d.refreshPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				d.refresh()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < workers; i++ {
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			for {
+				select {
+				case dl := <-d.queue:
+					d.deliver(ctx, dl)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+}
+
+//Stop and wait for deliveries in progress, they are written to dead-letter log
+func (d *Dispatcher) Stop() {
+	if d.cancelF != nil {
+		d.cancelF()
+	}
+	d.watcher.Stop()
+	d.wg.Wait()
+}
+
+//Resolve groups of rules and watch devices of rules. Members of group are kept if it could not be resolved
+func (d *Dispatcher) refresh() {
+	members := make(map[*rule]map[uuid.UUID]bool)
+	for _, r := range d.rules {
+		if len(r.Groups) == 0 {
+			continue
+		}
+		m := make(map[uuid.UUID]bool)
+		for _, name := range r.Groups {
+			ids, err := d.router.ResolveGroup(name, d.creds)
+			if err != nil {
+				d.logger.Err(err).Msgf("Failed to resolve group %s of webhook %s", name, r.Name)
+				m = nil
+				break
+			}
+			for _, id := range ids {
+				m[id] = true
+			}
+		}
+		if m != nil {
+			members[r] = m
+		}
+	}
+
+	d.membersMu.Lock()
+	var watched []uuid.UUID
+	for _, r := range d.rules {
+		if m, ok := members[r]; ok {
+			r.members = m
+		}
+		for id := range r.ids {
+			watched = append(watched, id)
+		}
+		for id := range r.members {
+			watched = append(watched, id)
+		}
+	}
+	d.membersMu.Unlock()
+
+	d.watcher.Set(watched)
+}
+
+func (d *Dispatcher) OnTransition(t router.Transition) {
+	if t.Initial {
+		return
+	}
+	d.membersMu.RLock()
+	defer d.membersMu.RUnlock()
+	for _, r := range d.rules {
+		if !r.match(t.Id, t.From, t.To) {
+			continue
+		}
+		d.enqueue(&delivery{
+			rule: r,
+			event: Event{
+				Webhook: r.Name,
+				Id:      t.Id.String(),
+				From:    t.From,
+				To:      t.To,
+				At:      t.At.UTC(),
+				Status:  t.Message,
+			},
+		})
+	}
+}
+
+func (d *Dispatcher) OnAlert(id uuid.UUID, alert model.Alert) {
+	d.membersMu.RLock()
+	defer d.membersMu.RUnlock()
+	for _, r := range d.rules {
+		if !r.matchAlert(id, alert.Rule) {
+			continue
+		}
+		a := alert
+		d.enqueue(&delivery{
+			rule: r,
+			event: Event{
+				Webhook: r.Name,
+				Id:      id.String(),
+				At:      alert.At,
+				Alert:   &a,
+			},
+		})
+	}
+}
+
+func (d *Dispatcher) enqueue(dl *delivery) {
+	select {
+	case d.queue <- dl:
+	default:
+		webhookDeliveries.WithLabelValues(dl.rule.Name, "dropped").Inc()
+		d.deadLetter.write(dl, 0, fmt.Errorf("queue is full"))
+	}
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, dl *delivery) {
+
+	body, err := json.Marshal(dl.event)
+	if err != nil {
+		d.logger.Err(err).Msg("failed to encode json")
+		return
+	}
+
+	var attempt int
+	for {
+		attempt++
+		//Request in progress is not canceled on stop, it is bounded by client timeout
+		retryable, err := d.post(dl.rule, body)
+		if err == nil {
+			webhookDeliveries.WithLabelValues(dl.rule.Name, "ok").Inc()
+			return
+		}
+		d.logger.Debug().Msgf("Webhook %s for id: %s failed, attempt %d: %s", dl.rule.Name, dl.event.Id, attempt, err)
+
+		if !retryable || attempt > d.retries {
+			webhookDeliveries.WithLabelValues(dl.rule.Name, "failed").Inc()
+			d.deadLetter.write(dl, attempt, err)
+			return
+		}
+
+		select {
+		case <-time.After(d.backoffFor(attempt)):
+		case <-ctx.Done():
+			webhookDeliveries.WithLabelValues(dl.rule.Name, "failed").Inc()
+			d.deadLetter.write(dl, attempt, fmt.Errorf("stopped before retry: %w", err))
+			return
+		}
+	}
+}
+
+//Exponential backoff with jitter up to half of delay
+func (d *Dispatcher) backoffFor(attempt int) time.Duration {
+	delay := d.backoff
+	for i := 1; i < attempt && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+//Return whether failed request may be retried
+func (d *Dispatcher) post(r *rule, body []byte) (bool, error) {
+
+	req, err := http.NewRequest(http.MethodPost, r.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r.Secret != "" {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(HeaderTimestamp, ts)
+		req.Header.Set(HeaderSignature, SignWebhook([]byte(r.Secret), ts, body))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	default:
+		return false, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+}
+
+//Return hex of HMAC-SHA256 of "<timestamp>.<body>"
+func SignWebhook(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
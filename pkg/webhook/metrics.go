@@ -0,0 +1,18 @@
+package webhook
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	metricsNamespace = "device_status_aggregator"
+	metricsSubsystem = "webhook"
+)
+
+var webhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Subsystem: metricsSubsystem,
+	Name:      "deliveries_total",
+	Help:      "Webhook deliveries by result: ok, failed after retries or dropped on full queue",
+}, []string{"webhook", "result"})
@@ -0,0 +1,135 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	uuid "github.com/gofrs/uuid"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/model"
+)
+
+const anyPresence = "*"
+
+//Rules is content of webhook rules file
+type Rules struct {
+	Webhooks []Rule `json:"webhooks"`
+}
+
+//Rule to POST event to URL when device changes presence
+type Rule struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	//Shared secret to sign payload, payload is not signed if empty
+	Secret string `json:"secret"`
+	//Devices of rule, all routed devices if both ids and groups are empty.
+	//Devices of rule are watched, so they are observed even without subscribed clients
+	Ids []uuid.UUID `json:"ids"`
+	//Groups of devices resolved by groups provider, members are updated with groups refresh period
+	Groups []string `json:"groups"`
+	//Transitions like "online->offline", "*" matches any presence. All transitions if empty and no alerts are set
+	Transitions []string `json:"transitions"`
+	//Alert rules posted to webhook, "*" matches any rule
+	Alerts []string `json:"alerts"`
+}
+
+type transition struct {
+	from, to string
+}
+
+type rule struct {
+	Rule
+	ids         map[uuid.UUID]bool
+	transitions []transition
+	//Members of groups of rule, guarded by Dispatcher
+	members map[uuid.UUID]bool
+}
+
+func loadRules(file string) ([]*rule, error) {
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read webhook rules: %w", err)
+	}
+	var rules Rules
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse webhook rules: %w", err)
+	}
+
+	r := make([]*rule, 0, len(rules.Webhooks))
+	for i, w := range rules.Webhooks {
+		if w.Name == "" {
+			w.Name = fmt.Sprintf("webhook-%d", i)
+		}
+		if w.URL == "" {
+			return nil, fmt.Errorf("webhook %s has no url", w.Name)
+		}
+		parsed := &rule{Rule: w, ids: make(map[uuid.UUID]bool, len(w.Ids))}
+		for _, id := range w.Ids {
+			parsed.ids[id] = true
+		}
+		for _, s := range w.Transitions {
+			t, err := parseTransition(s)
+			if err != nil {
+				return nil, fmt.Errorf("webhook %s: %w", w.Name, err)
+			}
+			parsed.transitions = append(parsed.transitions, t)
+		}
+		r = append(r, parsed)
+	}
+	return r, nil
+}
+
+func parseTransition(s string) (transition, error) {
+	parts := strings.Split(s, "->")
+	if len(parts) != 2 {
+		return transition{}, fmt.Errorf("wrong transition %q, expected from->to", s)
+	}
+	t := transition{from: strings.TrimSpace(parts[0]), to: strings.TrimSpace(parts[1])}
+	for _, p := range []string{t.from, t.to} {
+		switch model.Presence(p) {
+		case anyPresence, model.PresenceOnline, model.PresenceOffline, model.PresenceUnknown:
+		default:
+			return transition{}, fmt.Errorf("wrong presence %q in transition %q", p, s)
+		}
+	}
+	return t, nil
+}
+
+//Needed to lock members before
+func (r *rule) matchDevice(id uuid.UUID) bool {
+	if len(r.ids) == 0 && len(r.Groups) == 0 {
+		return true
+	}
+	return r.ids[id] || r.members[id]
+}
+
+//Needed to lock members before
+func (r *rule) match(id uuid.UUID, from, to model.Presence) bool {
+	if !r.matchDevice(id) {
+		return false
+	}
+	if len(r.transitions) == 0 {
+		return len(r.Alerts) == 0
+	}
+	for _, t := range r.transitions {
+		if (t.from == anyPresence || t.from == string(from)) && (t.to == anyPresence || t.to == string(to)) {
+			return true
+		}
+	}
+	return false
+}
+
+//Needed to lock members before
+func (r *rule) matchAlert(id uuid.UUID, name string) bool {
+	if !r.matchDevice(id) {
+		return false
+	}
+	for _, a := range r.Alerts {
+		if a == anyPresence || a == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package worker
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/config"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/model"
+)
+
+//Modes of authentication on DSN
+const (
+	//Query <AuthFieldName>=200, DSN does not check anything
+	DSNAuthLegacy = "legacy"
+	//Static service token as bearer
+	DSNAuthToken = "token"
+	//Token of a current subscriber of the route as bearer
+	DSNAuthForward = "forward"
+	//Request signed with shared secret
+	DSNAuthHMAC = "hmac"
+)
+
+const (
+	hmacKeyIDHeader     = "X-DSN-Key-Id"
+	hmacTimestampHeader = "X-DSN-Timestamp"
+	hmacSignatureHeader = "X-DSN-Signature"
+)
+
+type dsnAuth struct {
+	mode      string
+	fieldName string
+	token     string
+	keyID     string
+	secret    []byte
+}
+
+func newDSNAuth(env config.Environment) (*dsnAuth, error) {
+
+	auth := &dsnAuth{
+		mode:      env.DSNAuthMode,
+		fieldName: env.AuthFieldName,
+		token:     env.DSNAuthToken,
+		keyID:     env.DSNAuthKeyID,
+		secret:    []byte(env.DSNAuthSecret),
+	}
+
+	switch auth.mode {
+	case "", DSNAuthLegacy:
+		auth.mode = DSNAuthLegacy
+	case DSNAuthForward:
+	case DSNAuthToken:
+		if auth.token == "" {
+			return nil, fmt.Errorf("DSN auth mode %s requires token", auth.mode)
+		}
+	case DSNAuthHMAC:
+		if len(auth.secret) == 0 {
+			return nil, fmt.Errorf("DSN auth mode %s requires secret", auth.mode)
+		}
+	default:
+		return nil, fmt.Errorf("unknown DSN auth mode: %s", auth.mode)
+	}
+
+	return auth, nil
+}
+
+//CredentialsFunc returns credentials of a current subscriber of route, empty if there is no one.
+//It is called on every connection to upstream, so forwarded credentials follow subscribers
+type CredentialsFunc func() model.Credentials
+
+//Add credentials to request to DSN. Return *model.Error if there is no credential to send
+func (a *dsnAuth) authorize(u *url.URL, header http.Header, creds model.Credentials, now time.Time) error {
+
+	switch a.mode {
+	case DSNAuthLegacy:
+		u.RawQuery = fmt.Sprintf("%s=200", a.fieldName)
+
+	case DSNAuthToken:
+		header.Set("Authorization", "Bearer "+a.token)
+
+	case DSNAuthForward:
+		//Identity from client certificate could not be verified by DSN
+		if creds.Token == "" {
+			return model.NewError(model.ErrorCodeForbidden, fmt.Errorf("no subscriber token to forward to DSN"))
+		}
+		header.Set("Authorization", "Bearer "+creds.Token)
+
+	case DSNAuthHMAC:
+		timestamp := strconv.FormatInt(now.Unix(), 10)
+		if a.keyID != "" {
+			header.Set(hmacKeyIDHeader, a.keyID)
+		}
+		header.Set(hmacTimestampHeader, timestamp)
+		header.Set(hmacSignatureHeader, SignDSNRequest(a.secret, u.Path, timestamp))
+	}
+	return nil
+}
+
+//Hex HMAC-SHA256 of "GET\n<path>\n<timestamp>". DSN must reject requests with old timestamp
+func SignDSNRequest(secret []byte, path, timestamp string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(http.MethodGet + "\n" + path + "\n" + timestamp))
+	return hex.EncodeToString(mac.Sum(nil))
+}
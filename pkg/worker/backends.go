@@ -0,0 +1,198 @@
+package worker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	uuid "github.com/gofrs/uuid"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/config"
+)
+
+const (
+	defaultBackendName = "default"
+	//Virtual nodes of each backend on consistent hash ring
+	hashRingReplicas = 100
+)
+
+//Rule of routes file. Only one of Id, Prefix or From/To should be set
+type BackendRule struct {
+	Id      string `json:"id,omitempty"`
+	Prefix  string `json:"prefix,omitempty"`
+	From    string `json:"from,omitempty"`
+	To      string `json:"to,omitempty"`
+	Backend string `json:"backend"`
+}
+
+//Routes file. Rules are checked in order, first matched wins.
+//Unmatched ids go to Default backend, or are spread by consistent hash if Default is empty
+type BackendRoutes struct {
+	Default string        `json:"default,omitempty"`
+	Rules   []BackendRule `json:"rules"`
+}
+
+type backendRule struct {
+	backend  string
+	id       uuid.UUID
+	prefix   string
+	from, to uuid.UUID
+}
+
+func (r *backendRule) match(id uuid.UUID) bool {
+	switch {
+	case r.id != uuid.Nil:
+		return r.id == id
+	case r.prefix != "":
+		return strings.HasPrefix(id.String(), r.prefix)
+	default:
+		return bytes.Compare(id.Bytes(), r.from.Bytes()) >= 0 && bytes.Compare(id.Bytes(), r.to.Bytes()) <= 0
+	}
+}
+
+type hashRingPoint struct {
+	hash    uint32
+	backend string
+}
+
+//BackendSelector choose DSN backend for device id
+type BackendSelector struct {
+	backends map[string]*Backend
+	rules    []backendRule
+	fallback string
+	ring     []hashRingPoint
+}
+
+func NewBackendSelector(env config.Environment) (*BackendSelector, error) {
+
+	s := &BackendSelector{
+		backends: make(map[string]*Backend),
+	}
+
+	for _, v := range env.DSNBackends {
+		parts := strings.SplitN(strings.TrimSpace(v), "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("DSN backend must be name=host:port[|host:port], got %q", v)
+		}
+		if _, exist := s.backends[parts[0]]; exist {
+			return nil, fmt.Errorf("duplicate DSN backend %s", parts[0])
+		}
+		s.backends[parts[0]] = newBackend(parts[0], strings.Split(parts[1], "|"), env)
+	}
+	if len(s.backends) == 0 {
+		s.backends[defaultBackendName] = newBackend(defaultBackendName, strings.Split(env.DSNHostPort, ","), env)
+	}
+	for name, backend := range s.backends {
+		if len(backend.Endpoints) == 0 {
+			return nil, fmt.Errorf("DSN backend %s has no endpoints", name)
+		}
+	}
+
+	if env.DSNRoutesFile != "" {
+		data, err := ioutil.ReadFile(env.DSNRoutesFile)
+		if err != nil {
+			return nil, fmt.Errorf("read DSN routes file: %w", err)
+		}
+		var routes BackendRoutes
+		if err := json.Unmarshal(data, &routes); err != nil {
+			return nil, fmt.Errorf("parse DSN routes file: %w", err)
+		}
+		if err := s.setRoutes(routes); err != nil {
+			return nil, err
+		}
+	}
+
+	s.buildRing()
+
+	return s, nil
+}
+
+func newBackend(name string, hostPorts []string, env config.Environment) *Backend {
+	b := &Backend{Name: name}
+	for _, v := range hostPorts {
+		if v = strings.TrimSpace(v); v != "" {
+			b.Endpoints = append(b.Endpoints, newEndpoint(v, env.DSNFailureThreshold, time.Duration(env.DSNCircuitOpenPeriod)*time.Second))
+		}
+	}
+	return b
+}
+
+func (s *BackendSelector) setRoutes(routes BackendRoutes) error {
+
+	if routes.Default != "" {
+		if _, ok := s.backends[routes.Default]; !ok {
+			return fmt.Errorf("unknown default DSN backend %s", routes.Default)
+		}
+		s.fallback = routes.Default
+	}
+
+	for k, v := range routes.Rules {
+		if _, ok := s.backends[v.Backend]; !ok {
+			return fmt.Errorf("rule %d: unknown DSN backend %s", k, v.Backend)
+		}
+		rule := backendRule{backend: v.Backend}
+
+		var err error
+		switch {
+		case v.Id != "":
+			rule.id, err = uuid.FromString(v.Id)
+		case v.Prefix != "":
+			rule.prefix = strings.ToLower(v.Prefix)
+		case v.From != "" && v.To != "":
+			if rule.from, err = uuid.FromString(v.From); err == nil {
+				rule.to, err = uuid.FromString(v.To)
+			}
+		default:
+			err = fmt.Errorf("one of id, prefix or from/to is required")
+		}
+		if err != nil {
+			return fmt.Errorf("rule %d: %w", k, err)
+		}
+
+		s.rules = append(s.rules, rule)
+	}
+
+	return nil
+}
+
+func (s *BackendSelector) buildRing() {
+	for name := range s.backends {
+		for i := 0; i < hashRingReplicas; i++ {
+			s.ring = append(s.ring, hashRingPoint{
+				hash:    crc32.ChecksumIEEE([]byte(name + "#" + strconv.Itoa(i))),
+				backend: name,
+			})
+		}
+	}
+	sort.Slice(s.ring, func(i, j int) bool {
+		if s.ring[i].hash == s.ring[j].hash {
+			return s.ring[i].backend < s.ring[j].backend
+		}
+		return s.ring[i].hash < s.ring[j].hash
+	})
+}
+
+func (s *BackendSelector) Select(id uuid.UUID) *Backend {
+
+	for _, rule := range s.rules {
+		if rule.match(id) {
+			return s.backends[rule.backend]
+		}
+	}
+
+	if s.fallback != "" {
+		return s.backends[s.fallback]
+	}
+
+	h := crc32.ChecksumIEEE(id.Bytes())
+	i := sort.Search(len(s.ring), func(i int) bool { return s.ring[i].hash >= h })
+	if i == len(s.ring) {
+		i = 0
+	}
+	return s.backends[s.ring[i].backend]
+}
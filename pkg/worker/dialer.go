@@ -0,0 +1,80 @@
+package worker
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	gws "github.com/gobwas/ws"
+	uuid "github.com/gofrs/uuid"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/config"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/model"
+)
+
+const dialTimeout = 5 * time.Second
+
+//DSNDialer holds connection settings shared by all workers
+type DSNDialer struct {
+	scheme   string
+	dialer   gws.Dialer
+	auth     *dsnAuth
+	backends *BackendSelector
+}
+
+func NewDSNDialer(env config.Environment) (*DSNDialer, error) {
+
+	tlsConfig, err := config.NewDSNTLSConfig(env)
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := newDSNAuth(env)
+	if err != nil {
+		return nil, err
+	}
+
+	selector, err := NewBackendSelector(env)
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := "ws"
+	if tlsConfig != nil {
+		scheme = "wss"
+	}
+
+	return &DSNDialer{
+		scheme: scheme,
+		dialer: gws.Dialer{
+			Timeout:   dialTimeout,
+			TLSConfig: tlsConfig,
+		},
+		auth:     auth,
+		backends: selector,
+	}, nil
+}
+
+//Return backend which serves device id
+func (d *DSNDialer) Backend(id uuid.UUID) *Backend {
+	return d.backends.Select(id)
+}
+
+//Scheme and credentials of u will be set by dialer. If br is not nil, it must be used to read from conn.
+//Return *model.Error if there are no credentials for configured auth mode
+func (d *DSNDialer) Dial(ctx context.Context, u url.URL, creds model.Credentials) (conn net.Conn, br *bufio.Reader, err error) {
+	u.Scheme = d.scheme
+
+	header := make(http.Header)
+	if err := d.auth.authorize(&u, header, creds, time.Now()); err != nil {
+		return nil, nil, err
+	}
+
+	dialer := d.dialer
+	dialer.Header = gws.HandshakeHeaderHTTP(header)
+
+	conn, br, _, err = dialer.Dial(ctx, u.String())
+	return conn, br, err
+}
@@ -0,0 +1,103 @@
+package worker
+
+import (
+	"sync"
+	"time"
+)
+
+//Longest time from pick of endpoint until worker reports result of connection to it
+const probeTimeout = dialTimeout + readDeadline
+
+//Endpoint is one of equivalent DSN replicas of backend.
+//Health is tracked passively by results of connections of all workers
+type Endpoint struct {
+	sync.Mutex
+	HostPort   string
+	threshold  int
+	openPeriod time.Duration
+	failures   int
+	openUntil  time.Time
+	//Half-open probe is in flight until this time, circuit stays open for other workers
+	probeUntil time.Time
+}
+
+func newEndpoint(hostPort string, threshold int, openPeriod time.Duration) *Endpoint {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &Endpoint{
+		HostPort:   hostPort,
+		threshold:  threshold,
+		openPeriod: openPeriod,
+	}
+}
+
+//Return false while circuit is open. After open period only one caller gets true (half-open probe),
+//others get false until result of the probe is reported or it times out
+func (e *Endpoint) acquire(now time.Time) bool {
+	e.Lock()
+	defer e.Unlock()
+
+	if e.failures < e.threshold {
+		return true
+	}
+	if now.Before(e.openUntil) || now.Before(e.probeUntil) {
+		return false
+	}
+	e.probeUntil = now.Add(probeTimeout)
+	return true
+}
+
+func (e *Endpoint) ReportSuccess() {
+	e.Lock()
+	defer e.Unlock()
+	e.failures = 0
+	e.openUntil = time.Time{}
+	e.probeUntil = time.Time{}
+	endpointCircuitOpen.WithLabelValues(e.HostPort).Set(0)
+}
+
+//Open circuit after threshold of consecutive failures. Failure in half-open state opens it again
+func (e *Endpoint) ReportFailure() {
+	e.Lock()
+	defer e.Unlock()
+	e.failures++
+	if e.failures >= e.threshold {
+		e.openUntil = time.Now().Add(e.openPeriod)
+		e.probeUntil = time.Time{}
+		endpointCircuitOpen.WithLabelValues(e.HostPort).Set(1)
+	}
+}
+
+type Backend struct {
+	Name      string
+	Endpoints []*Endpoint
+}
+
+//Return endpoint to connect. current is kept while it is available, unless failover is requested.
+//Otherwise next available replica is chosen. Return nil if circuits of all replicas are open
+//or their half-open probes are made by other workers
+func (b *Backend) Pick(current *Endpoint, failover bool) *Endpoint {
+
+	now := time.Now()
+	start := 0
+	for k, v := range b.Endpoints {
+		if v == current {
+			if !failover && v.acquire(now) {
+				return v
+			}
+			start = k + 1
+			break
+		}
+	}
+
+	for i := 0; i < len(b.Endpoints); i++ {
+		if v := b.Endpoints[(start+i)%len(b.Endpoints)]; v != current && v.acquire(now) {
+			return v
+		}
+	}
+	if current != nil && failover && current.acquire(now) {
+		return current
+	}
+	return nil
+}
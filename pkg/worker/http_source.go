@@ -0,0 +1,217 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	uuid "github.com/gofrs/uuid"
+	"github.com/rs/zerolog"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/config"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/model"
+)
+
+const defaultPollPeriod = 10 * time.Second
+
+//HTTPSourceFactory makes sources which poll REST endpoint <HTTPSourceURL><id>.
+//Response body is the same as DSN message. TLS and auth settings of DSN are used
+type HTTPSourceFactory struct {
+	baseURL string
+	//Host of status endpoint, reported as endpoint of messages
+	endpoint  string
+	client    *http.Client
+	auth      *dsnAuth
+	period    time.Duration
+	validator *TelemetryValidator
+}
+
+func NewHTTPSourceFactory(env config.Environment) (*HTTPSourceFactory, error) {
+
+	if env.HTTPSourceURL == "" {
+		return nil, fmt.Errorf("http source requires status URL")
+	}
+
+	tlsConfig, err := config.NewDSNTLSConfig(env)
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := newDSNAuth(env)
+	if err != nil {
+		return nil, err
+	}
+
+	validator, err := NewTelemetryValidator(env)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := env.HTTPSourceURL
+	if u, err := url.Parse(env.HTTPSourceURL); err == nil && u.Host != "" {
+		endpoint = u.Host
+	}
+
+	period := time.Duration(env.HTTPSourcePollPeriod) * time.Second
+	if period <= 0 {
+		period = defaultPollPeriod
+	}
+
+	return &HTTPSourceFactory{
+		baseURL:  env.HTTPSourceURL,
+		endpoint: endpoint,
+		client: &http.Client{
+			Timeout:   dialTimeout,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+		auth:      auth,
+		period:    period,
+		validator: validator,
+	}, nil
+}
+
+func (f *HTTPSourceFactory) NewSource(id uuid.UUID, creds CredentialsFunc, logger *zerolog.Logger) Source {
+	return &HTTPPollSource{
+		id:       id,
+		creds:    creds,
+		factory:  f,
+		logger:   logger.With().Str("DEVICE_ID", id.String()).Logger(),
+		stopChan: make(chan bool, 2),
+	}
+}
+
+func (f *HTTPSourceFactory) Close() {
+	f.client.CloseIdleConnections()
+}
+
+//HTTPPollSource sends status only when it is changed
+type HTTPPollSource struct {
+	id       uuid.UUID
+	creds    CredentialsFunc
+	factory  *HTTPSourceFactory
+	logger   zerolog.Logger
+	stopChan chan bool
+}
+
+func (hnd *HTTPPollSource) Run(ctx context.Context, respMessagechan chan *model.ResponseMessage) {
+
+	go func() {
+		ticker := time.NewTicker(hnd.factory.period)
+		defer ticker.Stop()
+
+		var (
+			lastBody    []byte
+			lastErrCode model.ErrorCode
+			stale       bool
+		)
+
+		for {
+			var msg *model.ResponseMessage
+
+			body, err := hnd.poll(ctx)
+			switch {
+			case ctx.Err() != nil:
+				return
+
+			case err != nil:
+				hnd.logger.Debug().Msgf("Poll status failed: %s", err)
+				e := model.AsError(err)
+				if e.Code == model.ErrorCodeUnavailable {
+					if !stale {
+						stale = true
+						msg = model.NewStaleResponseMessage(hnd.id)
+						msg.Endpoint = hnd.factory.endpoint
+					}
+				} else if e.Code != lastErrCode {
+					msg = model.NewErrorResponseMessageFromError(e, hnd.id)
+				}
+				lastErrCode, lastBody = e.Code, nil
+
+			case !bytes.Equal(body, lastBody):
+				var status model.DeviceStatusFromDSN
+				if err := json.Unmarshal(body, &status); err != nil {
+					telemetryInvalid.WithLabelValues("", "decode").Inc()
+					hnd.logger.Err(err).Msgf("failed to decode json from status endpoint")
+					break
+				}
+				lastBody = body
+				//Dropped status does not change state of device
+				if msg = hnd.factory.validator.ResponseMessage(hnd.id, &status, &hnd.logger); msg != nil {
+					msg.Endpoint = hnd.factory.endpoint
+					lastErrCode, stale = "", false
+				}
+			}
+
+			if msg != nil {
+				select {
+				case respMessagechan <- msg:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case <-ticker.C:
+			case <-hnd.stopChan:
+				hnd.logger.Debug().Msgf("Receive stopChan")
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (hnd *HTTPPollSource) Stop() {
+	hnd.logger.Debug().Msgf("Make stop to poll status, id: %s", hnd.id)
+	hnd.stopChan <- true
+}
+
+//Return body of response or *model.Error
+func (hnd *HTTPPollSource) poll(ctx context.Context) ([]byte, error) {
+
+	u, err := url.Parse(hnd.factory.baseURL + hnd.id.String())
+	if err != nil {
+		return nil, model.NewError(model.ErrorCodeGeneric, fmt.Errorf("status URL parse error: %w", err))
+	}
+
+	header := make(http.Header)
+	if err := hnd.factory.auth.authorize(u, header, hnd.creds(), time.Now()); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, model.NewError(model.ErrorCodeGeneric, err)
+	}
+	req.Header = header
+
+	resp, err := hnd.factory.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, model.NewError(model.ErrorCodeUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, model.NewError(model.ErrorCodeUnavailable, err)
+		}
+		return body, nil
+	case http.StatusNotFound:
+		return nil, model.NewError(model.ErrorCodeNotFound, nil)
+	case http.StatusGone:
+		return nil, model.NewError(model.ErrorCodeDeviceDeleted, fmt.Errorf("device deleted"))
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, model.NewError(model.ErrorCodeForbidden, nil)
+	case http.StatusTooManyRequests:
+		return nil, model.NewError(model.ErrorCodeUpstreamOverloaded, fmt.Errorf("too many requests"))
+	default:
+		return nil, model.NewError(model.ErrorCodeUnavailable, fmt.Errorf("unexpected status code: %d", resp.StatusCode))
+	}
+}
@@ -0,0 +1,43 @@
+package worker
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	metricsNamespace = "device_status_aggregator"
+	metricsSubsystem = "dsn"
+)
+
+var (
+	//Keyed by endpoint, not by device, so count of series does not grow with devices
+	upstreamPingRTT = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "ping_rtt_seconds",
+		Help:      "Ping round-trip time of DSN connections per endpoint",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"endpoint"})
+
+	endpointCircuitOpen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "endpoint_circuit_open",
+		Help:      "1 if DSN endpoint is skipped after repeated failures",
+	}, []string{"endpoint"})
+
+	upstreamPingTimeouts = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "ping_timeouts_total",
+		Help:      "DSN connections closed because pong was not received in time",
+	})
+
+	telemetryInvalid = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "telemetry_invalid_total",
+		Help:      "Status messages with telemetry which is not JSON or does not match schema of device type",
+	}, []string{"device_type", "reason"})
+)
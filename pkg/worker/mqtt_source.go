@@ -0,0 +1,350 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	uuid "github.com/gofrs/uuid"
+	"github.com/rs/zerolog"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/config"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/model"
+)
+
+const (
+	mqttWaitTimeout    = 5 * time.Second
+	mqttDisconnectWait = 250
+	mqttIDPlaceholder  = "{id}"
+)
+
+//Kind of MQTT topic of device
+type mqttTopicKind int
+
+const (
+	//Status json as from DSN or presence payload
+	mqttTopicStatus mqttTopicKind = iota
+	//Only presence payload, e.g. last will of device
+	mqttTopicPresence
+)
+
+//MQTTSourceFactory holds one broker connection shared by all sources.
+//Subscriptions are restored after reconnect, sources send stale status while broker is disconnected
+type MQTTSourceFactory struct {
+	sync.Mutex
+	//Serializes changes of broker subscriptions, so stopped source cannot unsubscribe topics of new source of the same device
+	subMu          sync.Mutex
+	client         mqtt.Client
+	connectToken   mqtt.Token
+	topics         map[string]mqttTopicKind
+	qos            byte
+	onlinePayload  []byte
+	offlinePayload []byte
+	sources        map[string]*MQTTSource
+	validator      *TelemetryValidator
+	//Host of broker, reported as endpoint of messages
+	endpoint string
+	logger   zerolog.Logger
+}
+
+func NewMQTTSourceFactory(env config.Environment, logger *zerolog.Logger) (*MQTTSourceFactory, error) {
+
+	if env.MQTTBrokerURL == "" {
+		return nil, fmt.Errorf("mqtt source requires broker URL")
+	}
+
+	topics := make(map[string]mqttTopicKind)
+	for kind, patterns := range map[mqttTopicKind][]string{mqttTopicStatus: env.MQTTStatusTopics, mqttTopicPresence: env.MQTTPresenceTopics} {
+		for _, pattern := range patterns {
+			pattern = strings.TrimSpace(pattern)
+			if pattern == "" {
+				continue
+			}
+			if !strings.Contains(pattern, mqttIDPlaceholder) {
+				return nil, fmt.Errorf("mqtt topic %s must contain %s", pattern, mqttIDPlaceholder)
+			}
+			if _, ok := topics[pattern]; ok {
+				return nil, fmt.Errorf("mqtt topic %s is configured twice", pattern)
+			}
+			topics[pattern] = kind
+		}
+	}
+	if len(topics) == 0 {
+		return nil, fmt.Errorf("mqtt source requires at least one topic")
+	}
+
+	//Credentials in broker URL must not reach clients and logs
+	endpoint := env.MQTTBrokerURL
+	if u, err := url.Parse(env.MQTTBrokerURL); err == nil && u.Host != "" {
+		endpoint = u.Host
+	}
+
+	f := &MQTTSourceFactory{
+		topics:         topics,
+		qos:            byte(env.MQTTQoS),
+		onlinePayload:  []byte(env.MQTTOnlinePayload),
+		offlinePayload: []byte(env.MQTTOfflinePayload),
+		sources:        make(map[string]*MQTTSource),
+		endpoint:       endpoint,
+		logger:         logger.With().Str("MQTT_BROKER", endpoint).Logger(),
+	}
+
+	tlsConfig, err := config.NewDSNTLSConfig(env)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.validator, err = NewTelemetryValidator(env); err != nil {
+		return nil, err
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(env.MQTTBrokerURL).
+		SetClientID(env.MQTTClientID).
+		SetUsername(env.MQTTUsername).
+		SetPassword(env.MQTTPassword).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetOnConnectHandler(f.onConnect).
+		SetConnectionLostHandler(f.onConnectionLost)
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	f.client = mqtt.NewClient(opts)
+	//With connect retry token is completed only when connected, so we do not wait for it
+	f.connectToken = f.client.Connect()
+
+	return f, nil
+}
+
+//MQTT source does not authenticate per device, so creds are not used
+func (f *MQTTSourceFactory) NewSource(id uuid.UUID, creds CredentialsFunc, logger *zerolog.Logger) Source {
+	topics := make(map[string]mqttTopicKind, len(f.topics))
+	for pattern, kind := range f.topics {
+		topics[strings.Replace(pattern, mqttIDPlaceholder, id.String(), -1)] = kind
+	}
+	return &MQTTSource{
+		id:       id,
+		topics:   topics,
+		factory:  f,
+		logger:   logger.With().Str("DEVICE_ID", id.String()).Logger(),
+		stopChan: make(chan bool, 2),
+		pending:  make(chan *model.ResponseMessage, 1),
+	}
+}
+
+func (f *MQTTSourceFactory) Close() {
+	//Client must not be disconnected while it is connecting
+	f.connectToken.WaitTimeout(mqttWaitTimeout)
+	f.client.Disconnect(mqttDisconnectWait)
+}
+
+func (f *MQTTSourceFactory) subscribe(src *MQTTSource) {
+	f.subMu.Lock()
+	defer f.subMu.Unlock()
+
+	f.Lock()
+	f.sources[src.id.String()] = src
+	f.Unlock()
+
+	if !f.client.IsConnectionOpen() {
+		//Will be subscribed in onConnect
+		return
+	}
+	token := f.client.SubscribeMultiple(src.filters(f.qos), src.handleMessage)
+	if token.WaitTimeout(mqttWaitTimeout) && token.Error() != nil {
+		src.logger.Err(token.Error()).Msgf("failed to subscribe to MQTT topics")
+	}
+}
+
+func (f *MQTTSourceFactory) unsubscribe(src *MQTTSource) {
+	f.subMu.Lock()
+	defer f.subMu.Unlock()
+
+	f.Lock()
+	//Device could be already taken by new source
+	if f.sources[src.id.String()] != src {
+		f.Unlock()
+		return
+	}
+	delete(f.sources, src.id.String())
+	f.Unlock()
+
+	if f.client.IsConnectionOpen() {
+		topics := make([]string, 0, len(src.topics))
+		for topic := range src.topics {
+			topics = append(topics, topic)
+		}
+		f.client.Unsubscribe(topics...).WaitTimeout(mqttWaitTimeout)
+	}
+}
+
+func (f *MQTTSourceFactory) activeSources() []*MQTTSource {
+	f.Lock()
+	defer f.Unlock()
+	r := make([]*MQTTSource, 0, len(f.sources))
+	for _, v := range f.sources {
+		r = append(r, v)
+	}
+	return r
+}
+
+//Paho calls connect handler in its own goroutine, so it can wait for subscriptions
+func (f *MQTTSourceFactory) onConnect(client mqtt.Client) {
+	f.subMu.Lock()
+	defer f.subMu.Unlock()
+
+	sources := f.activeSources()
+	f.logger.Debug().Msgf("Connected to MQTT broker, restore subscriptions of %d devices", len(sources))
+	tokens := make([]mqtt.Token, len(sources))
+	for k, src := range sources {
+		tokens[k] = client.SubscribeMultiple(src.filters(f.qos), src.handleMessage)
+	}
+	for k, token := range tokens {
+		if token.WaitTimeout(mqttWaitTimeout) && token.Error() != nil {
+			sources[k].logger.Err(token.Error()).Msgf("failed to subscribe to MQTT topics")
+		}
+	}
+}
+
+func (f *MQTTSourceFactory) onConnectionLost(client mqtt.Client, err error) {
+	f.logger.Err(err).Msg("Connection to MQTT broker lost")
+	for _, src := range f.activeSources() {
+		msg := model.NewStaleResponseMessage(src.id)
+		msg.Endpoint = f.endpoint
+		src.send(msg)
+	}
+}
+
+//Map presence payload to status, ok is false if payload is unknown
+func (f *MQTTSourceFactory) presenceStatus(payload []byte) (status int, ok bool) {
+	payload = bytes.TrimSpace(payload)
+	switch {
+	case bytes.Equal(payload, f.onlinePayload):
+		return 1, true
+	case bytes.Equal(payload, f.offlinePayload):
+		return 0, true
+	}
+	return 0, false
+}
+
+//MQTTSource receives status of device from its topics
+type MQTTSource struct {
+	id       uuid.UUID
+	topics   map[string]mqttTopicKind
+	factory  *MQTTSourceFactory
+	logger   zerolog.Logger
+	stopChan chan bool
+	//Latest status which is not forwarded yet
+	pending chan *model.ResponseMessage
+	//Telemetry from last status, presence messages carry it so clients do not lose it
+	mu            sync.Mutex
+	lastTelemetry *json.RawMessage
+}
+
+func (hnd *MQTTSource) Run(ctx context.Context, respMessagechan chan *model.ResponseMessage) {
+
+	hnd.logger.Debug().Msgf("Subscribe to MQTT topics of device")
+	hnd.factory.subscribe(hnd)
+
+	go func() {
+		defer hnd.factory.unsubscribe(hnd)
+		for {
+			var msg *model.ResponseMessage
+			select {
+			case msg = <-hnd.pending:
+			case <-hnd.stopChan:
+				hnd.logger.Debug().Msgf("Receive stopChan")
+				return
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case respMessagechan <- msg:
+			case <-hnd.stopChan:
+				hnd.logger.Debug().Msgf("Receive stopChan")
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (hnd *MQTTSource) Stop() {
+	hnd.logger.Debug().Msgf("Make stop to receive info from MQTT, id: %s", hnd.id)
+	hnd.stopChan <- true
+}
+
+func (hnd *MQTTSource) filters(qos byte) map[string]byte {
+	r := make(map[string]byte, len(hnd.topics))
+	for topic := range hnd.topics {
+		r[topic] = qos
+	}
+	return r
+}
+
+func (hnd *MQTTSource) handleMessage(client mqtt.Client, msg mqtt.Message) {
+	kind, ok := hnd.topics[msg.Topic()]
+	if !ok {
+		return
+	}
+	//Retained message was cleared
+	if len(msg.Payload()) == 0 {
+		return
+	}
+
+	status, err := hnd.decode(kind, msg.Payload())
+	if err != nil {
+		hnd.logger.Err(err).Msgf("failed to decode payload from MQTT topic %s", msg.Topic())
+		return
+	}
+	if msg := hnd.factory.validator.ResponseMessage(hnd.id, status, &hnd.logger); msg != nil {
+		msg.Endpoint = hnd.factory.endpoint
+		hnd.send(msg)
+	}
+}
+
+//Payload of status topic is json object as from DSN, otherwise it is presence payload
+func (hnd *MQTTSource) decode(kind mqttTopicKind, payload []byte) (*model.DeviceStatusFromDSN, error) {
+
+	hnd.mu.Lock()
+	defer hnd.mu.Unlock()
+
+	if kind == mqttTopicStatus && bytes.HasPrefix(bytes.TrimSpace(payload), []byte("{")) {
+		var status model.DeviceStatusFromDSN
+		if err := json.Unmarshal(payload, &status); err != nil {
+			telemetryInvalid.WithLabelValues("", "decode").Inc()
+			return nil, err
+		}
+		hnd.lastTelemetry = status.DeviceTelemetry
+		return &status, nil
+	}
+
+	status, ok := hnd.factory.presenceStatus(payload)
+	if !ok {
+		return nil, fmt.Errorf("unknown presence payload: %q", payload)
+	}
+	return &model.DeviceStatusFromDSN{Status: status, DeviceTelemetry: hnd.lastTelemetry}, nil
+}
+
+//Paho callbacks must not block, so status which is not forwarded yet is replaced, only the latest one matters
+func (hnd *MQTTSource) send(msg *model.ResponseMessage) {
+	for {
+		select {
+		case hnd.pending <- msg:
+			return
+		default:
+		}
+		select {
+		case <-hnd.pending:
+		default:
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+
+	uuid "github.com/gofrs/uuid"
+	"github.com/rs/zerolog"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/config"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/model"
+)
+
+//Types of upstream, one per deployment
+const (
+	SourceDSN  = "dsn"
+	SourceHTTP = "http"
+	SourceMQTT = "mqtt"
+)
+
+//Source is upstream of status of one device
+type Source interface {
+	//Start to send status of device to respMessagechan in background, until ctx is done or Stop() is called
+	Run(ctx context.Context, respMessagechan chan *model.ResponseMessage)
+	Stop()
+}
+
+//Reconnector is implemented by sources which authenticate on upstream only when connecting,
+//so they can connect again with current credentials of subscribers
+type Reconnector interface {
+	Reconnect()
+}
+
+//SourceFactory makes sources of configured type and holds resources shared by them
+type SourceFactory interface {
+	NewSource(id uuid.UUID, creds CredentialsFunc, logger *zerolog.Logger) Source
+	Close()
+}
+
+func NewSourceFactory(env config.Environment, logger *zerolog.Logger) (SourceFactory, error) {
+
+	switch env.SourceType {
+	case "", SourceDSN:
+		dialer, err := NewDSNDialer(env)
+		if err != nil {
+			return nil, err
+		}
+		validator, err := NewTelemetryValidator(env)
+		if err != nil {
+			return nil, err
+		}
+		return &dsnSourceFactory{env: env, dialer: dialer, validator: validator}, nil
+
+	case SourceHTTP:
+		return NewHTTPSourceFactory(env)
+
+	case SourceMQTT:
+		return NewMQTTSourceFactory(env, logger)
+
+	default:
+		return nil, fmt.Errorf("unknown source type: %s", env.SourceType)
+	}
+}
+
+type dsnSourceFactory struct {
+	env       config.Environment
+	dialer    *DSNDialer
+	validator *TelemetryValidator
+}
+
+func (f *dsnSourceFactory) NewSource(id uuid.UUID, creds CredentialsFunc, logger *zerolog.Logger) Source {
+	return NewRequesterStatusHandler(id, f.env, f.dialer, f.validator, creds, logger)
+}
+
+func (f *dsnSourceFactory) Close() {}
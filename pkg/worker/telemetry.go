@@ -0,0 +1,133 @@
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	uuid "github.com/gofrs/uuid"
+	"github.com/rs/zerolog"
+	"github.com/xeipuuv/gojsonschema"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/config"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/devicetype"
+	"gl.dev.boquar.com/backend/device-status-aggregator/pkg/model"
+)
+
+//Actions on telemetry which does not match schema
+const (
+	InvalidTelemetryFlag = "flag"
+	InvalidTelemetryDrop = "drop"
+)
+
+//TelemetrySchemas is content of telemetry schemas file
+type TelemetrySchemas struct {
+	//Dot separated path of field in telemetry with type of device, used if device is not listed in types
+	TypeField string `json:"typeField"`
+	//Type of device which is not listed and has no type field
+	Default string                   `json:"default"`
+	Types   map[string]TelemetryType `json:"types"`
+}
+
+type TelemetryType struct {
+	//JSON Schema object, or path of schema file relative to schemas file
+	Schema json.RawMessage `json:"schema"`
+	Ids    []uuid.UUID     `json:"ids"`
+}
+
+//TelemetryValidator checks telemetry of device against JSON Schema of its type.
+//Nil validator accepts any telemetry
+type TelemetryValidator struct {
+	types   *devicetype.Resolver
+	schemas map[string]*gojsonschema.Schema
+	drop    bool
+}
+
+//Return nil if schemas file is not configured
+func NewTelemetryValidator(env config.Environment) (*TelemetryValidator, error) {
+
+	if env.TelemetrySchemasFile == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(env.TelemetrySchemasFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read telemetry schemas: %w", err)
+	}
+	var schemas TelemetrySchemas
+	if err := json.Unmarshal(data, &schemas); err != nil {
+		return nil, fmt.Errorf("failed to parse telemetry schemas: %w", err)
+	}
+
+	v := &TelemetryValidator{
+		types:   devicetype.NewResolver(schemas.TypeField, schemas.Default),
+		schemas: make(map[string]*gojsonschema.Schema, len(schemas.Types)),
+		drop:    env.TelemetryInvalidAction == InvalidTelemetryDrop,
+	}
+
+	dir := filepath.Dir(env.TelemetrySchemasFile)
+	for name, t := range schemas.Types {
+		raw := []byte(t.Schema)
+		var file string
+		if err := json.Unmarshal(raw, &file); err == nil {
+			if !filepath.IsAbs(file) {
+				file = filepath.Join(dir, file)
+			}
+			if raw, err = ioutil.ReadFile(file); err != nil {
+				return nil, fmt.Errorf("failed to read schema of device type %s: %w", name, err)
+			}
+		}
+		schema, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(raw))
+		if err != nil {
+			return nil, fmt.Errorf("wrong schema of device type %s: %w", name, err)
+		}
+		v.schemas[name] = schema
+		v.types.AddIds(name, t.Ids)
+	}
+	return v, nil
+}
+
+//Return status message of device, or nil if telemetry is invalid and must be dropped.
+//Invalid telemetry is counted and logged
+func (v *TelemetryValidator) ResponseMessage(id uuid.UUID, status *model.DeviceStatusFromDSN, logger *zerolog.Logger) *model.ResponseMessage {
+
+	msg := status.ResponseMessage(id)
+	if v == nil {
+		return msg
+	}
+
+	telemetry := []byte("null")
+	if status.DeviceTelemetry != nil {
+		telemetry = *status.DeviceTelemetry
+	}
+	deviceType := v.types.Type(id, telemetry)
+	schema, ok := v.schemas[deviceType]
+	if !ok {
+		return msg
+	}
+
+	result, err := schema.Validate(gojsonschema.NewBytesLoader(telemetry))
+	if err != nil {
+		telemetryInvalid.WithLabelValues(deviceType, "decode").Inc()
+		logger.Err(err).Msgf("failed to validate telemetry of id: %s", id.String())
+		return msg
+	}
+	if result.Valid() {
+		return msg
+	}
+
+	telemetryInvalid.WithLabelValues(deviceType, "schema").Inc()
+	errs := make([]string, 0, len(result.Errors()))
+	for _, e := range result.Errors() {
+		errs = append(errs, e.String())
+	}
+	logger.Warn().Msgf("Telemetry of id: %s does not match schema of %s: %s", id.String(), deviceType, strings.Join(errs, "; "))
+
+	if v.drop {
+		return nil
+	}
+	invalid := true
+	msg.InvalidTelemetry = &invalid
+	return msg
+}
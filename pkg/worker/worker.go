@@ -4,10 +4,14 @@ import (
 	"context"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/url"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	gws "github.com/gobwas/ws"
@@ -27,18 +31,38 @@ const (
 )
 
 type RequesterStatusHandler struct {
-	id       uuid.UUID
-	env      config.Environment
+	//Unix nano time of ping waiting for pong, 0 if there is no such ping. First for 64-bit alignment
+	pingSentAt int64
+	//1 if current connection is closed by Reconnect(), so it is not a failure of DSN
+	reconnecting  int32
+	reconnectChan chan struct{}
+	id            uuid.UUID
+	env           config.Environment
+	dialer        *DSNDialer
+	validator     *TelemetryValidator
+	creds         CredentialsFunc
+	//Endpoint of last connection and whether next connection should go to another replica.
+	//Used only by goroutine of Run, respawns are sequential
+	endpoint *Endpoint
+	failover bool
 	stopChan chan bool
 	logger   zerolog.Logger
+	//Guards writes to DSN connection and conn, pinger and read loop write concurrently
+	writeMu sync.Mutex
+	conn    net.Conn
 }
 
-func NewRequesterStatusHandler(id uuid.UUID, env config.Environment, logger *zerolog.Logger) *RequesterStatusHandler {
+//creds are asked on every connection to DSN and forwarded if it is configured
+func NewRequesterStatusHandler(id uuid.UUID, env config.Environment, dialer *DSNDialer, validator *TelemetryValidator, creds CredentialsFunc, logger *zerolog.Logger) *RequesterStatusHandler {
 	return &RequesterStatusHandler{
-		id:       id,
-		env:      env,
-		logger:   logger.With().Str("DEVICE_ID", id.String()).Logger(),
-		stopChan: make(chan bool, 2),
+		id:            id,
+		env:           env,
+		dialer:        dialer,
+		validator:     validator,
+		creds:         creds,
+		logger:        logger.With().Str("DEVICE_ID", id.String()).Logger(),
+		stopChan:      make(chan bool, 2),
+		reconnectChan: make(chan struct{}, 1),
 	}
 }
 
@@ -46,41 +70,81 @@ func (hnd *RequesterStatusHandler) Run(ctx context.Context, respMessagechan chan
 
 	go func() {
 
-		var isStop bool
+		var isStop, waitReconnect bool
 		defer func() {
 			if !isStop && ctx.Err() == nil {
-				hnd.respawn(ctx, respMessagechan)
+				hnd.respawn(ctx, respMessagechan, waitReconnect)
 			}
 		}()
 
+		backend := hnd.dialer.Backend(hnd.id)
+		endpoint := backend.Pick(hnd.endpoint, hnd.failover)
+		if endpoint == nil {
+			err := fmt.Errorf("circuits of all endpoints of DSN %s are open", backend.Name)
+			hnd.logger.Debug().Msgf("Skip connect to DSN: %s", err)
+			hnd.sendStale(respMessagechan)
+			respMessagechan <- model.NewErrorResponseMessageFromError(model.NewError(model.ErrorCodeUnavailable, err), hnd.id)
+			return
+		}
+		hnd.endpoint = endpoint
+		hnd.failover = false
 		u := url.URL{
-			Scheme:   "ws",
-			Host:     hnd.env.DSNHostPort,
-			Path:     fmt.Sprintf("/ws/status/%s", hnd.id.String()),
-			RawQuery: fmt.Sprintf("%s=200", hnd.env.AuthFieldName),
+			Host: hnd.endpoint.HostPort,
+			Path: fmt.Sprintf("/ws/status/%s", hnd.id.String()),
 		}
 
-		hnd.logger.Debug().Msgf("Trying to connect to DSN: URL %s", u.String())
+		hnd.logger.Debug().Msgf("Trying to connect to DSN %s: URL %s", backend.Name, u.String())
 
-		dialer := gws.Dialer{
-			Timeout: 5 * time.Second,
+		//Reconnect() requested before dial is satisfied by this connection
+		atomic.StoreInt32(&hnd.reconnecting, 0)
+		select {
+		case <-hnd.reconnectChan:
+		default:
 		}
-		conn, _, _, err := dialer.Dial(ctx, u.String())
+
+		conn, br, err := hnd.dialer.Dial(ctx, u, hnd.creds())
 
 		defer func() {
 			if conn != nil {
+				hnd.setConn(nil)
 				conn.Close()
 			}
 		}()
 
-		if err != nil {
+		var authErr *model.Error
+		switch {
+		case errors.As(err, &authErr):
+			//The same credentials will be refused again, so wait until subscribers are changed
+			hnd.logger.Debug().Msgf("No credentials to connect to DSN: %s", err)
+			respMessagechan <- model.NewErrorResponseMessageFromError(authErr, hnd.id)
+			waitReconnect = true
+			return
+
+		case err != nil:
 			hnd.logger.Debug().Msgf("Error connect to DSN: %s", err)
-			respMessagechan <- model.NewErrorResponseMessageInternalError(err, hnd.id)
+			hnd.reportEndpointFailure()
+			hnd.sendStale(respMessagechan)
+			respMessagechan <- model.NewErrorResponseMessageFromError(model.NewError(model.ErrorCodeUnavailable, err), hnd.id)
 			return
 		}
 		hnd.logger.Debug().Msgf("Connected to DSN")
+		hnd.setConn(conn)
+
+		//Frames sent by DSN right after handshake could be already buffered in br
+		var src io.Reader = conn
+		if br != nil {
+			src = br
+			defer gws.PutReader(br)
+		}
+		r := wsutil.NewReader(src, state)
+
+		//Endpoint is healthy after first frame from DSN
+		var received bool
+
+		pingerDone := make(chan struct{})
+		defer close(pingerDone)
+		hnd.startPinger(conn, pingerDone)
 
-		r := wsutil.NewReader(conn, state)
 	loop:
 		for {
 
@@ -105,35 +169,59 @@ func (hnd *RequesterStatusHandler) Run(ctx context.Context, respMessagechan chan
 
 				hnd.logger.Debug().Msgf("Receive NextFrame DSN")
 
+				if err == nil && !received {
+					received = true
+					hnd.endpoint.ReportSuccess()
+				}
+
 				switch {
 
+				case err != nil && atomic.SwapInt32(&hnd.reconnecting, 0) == 1:
+					hnd.logger.Debug().Msgf("Connection to DSN is closed to reconnect")
+					break loop
+
 				case err != nil:
 					hnd.logger.Err(err).Msgf("read error from websocket DSN")
+					hnd.reportEndpointFailure()
+					hnd.sendStale(respMessagechan)
 					break loop
 
 				case hdr.OpCode == gws.OpClose:
-					code, msg, err := hnd.readClosePacketBody(&conn, hdr)
+					code, msg, err := hnd.readClosePacketBody(r)
 					if err != nil {
 						hnd.logger.Err(err).Msgf("error read close packet")
 					}
-					hnd.logger.Debug().Msgf("Receive close packet from DSN: code %d", code)
-					respMessagechan <- model.NewErrorResponseMessage(code, msg, hnd.id)
+					hnd.logger.Debug().Msgf("Receive close packet from DSN: code %d, reason: %s", code, msg)
+					closeErr := model.NewErrorFromDSNCloseCode(code, msg)
+					if closeErr.Code == model.ErrorCodeUpstreamOverloaded {
+						hnd.reportEndpointFailure()
+					}
+					//Status is not known until reconnect, unless DSN refused the device
+					if closeErr.Retryable() {
+						hnd.sendStale(respMessagechan)
+					}
+					respMessagechan <- model.NewErrorResponseMessageFromError(closeErr, hnd.id)
 					break loop
 
 				case hdr.OpCode == gws.OpPong:
 					hnd.logger.Debug().Msgf("Receive pong packet from DSN")
+					payload, err := ioutil.ReadAll(r)
+					if err != nil {
+						hnd.logger.Err(err).Msgf("failed to read pong packet from DSN")
+						break loop
+					}
+					hnd.handlePong(payload)
 					continue loop
 
 				case hdr.OpCode == gws.OpPing:
 					hnd.logger.Debug().Msgf("Receive ping packet from DSN")
-					if err := conn.SetWriteDeadline(time.Now().Add(writeDeadline)); err != nil {
-						hnd.logger.Err(err).Msgf("failed to set write deadline")
+					payload, err := ioutil.ReadAll(r)
+					if err != nil {
+						hnd.logger.Err(err).Msgf("failed to read ping packet from DSN")
 						break loop
 					}
-					writer := wsutil.NewWriter(conn, state, gws.OpPong)
-					var buf []byte
-					if err := hnd.writeBuffer(writer, buf); err != nil {
-						hnd.logger.Err(err).Msgf("failed to send ping DSN, will close connection")
+					if err := hnd.writeControl(conn, gws.OpPong, payload); err != nil {
+						hnd.logger.Err(err).Msgf("failed to send pong DSN, will close connection")
 						break loop
 					}
 					continue loop
@@ -142,10 +230,14 @@ func (hnd *RequesterStatusHandler) Run(ctx context.Context, respMessagechan chan
 					var req model.DeviceStatusFromDSN
 					decoder := json.NewDecoder(r)
 					if err := decoder.Decode(&req); err != nil {
+						telemetryInvalid.WithLabelValues("", "decode").Inc()
 						hnd.logger.Err(err).Msgf("failed to decode json from DSN")
 						continue loop
 					}
-					respMessagechan <- req.ResponseMessage(hnd.id)
+					if msg := hnd.validator.ResponseMessage(hnd.id, &req, &hnd.logger); msg != nil {
+						msg.Endpoint = hnd.endpoint.HostPort
+						respMessagechan <- msg
+					}
 
 				default:
 					hnd.logger.Err(err).Msgf("Strange ws.opCode:%d", hdr.OpCode)
@@ -157,52 +249,169 @@ func (hnd *RequesterStatusHandler) Run(ctx context.Context, respMessagechan chan
 
 }
 
+//Report that status of device is not known, router passes it only once until status is received again
+func (hnd *RequesterStatusHandler) sendStale(respMessagechan chan *model.ResponseMessage) {
+	msg := model.NewStaleResponseMessage(hnd.id)
+	//Endpoint is not known before first connection
+	if hnd.endpoint != nil {
+		msg.Endpoint = hnd.endpoint.HostPort
+	}
+	respMessagechan <- msg
+}
+
 //Will close conn after send packet
 func (hnd *RequesterStatusHandler) sendCloseWSocket(conn *net.Conn) {
+	hnd.writeMu.Lock()
+	defer hnd.writeMu.Unlock()
 	w := wsutil.NewWriter(*conn, state, gws.OpClose)
 	buf := make([]byte, 0)
 	w.Write(buf)
 	w.Flush()
 }
 
+//Send ping to DSN every ping period. If pong for previous ping was not received, conn will be closed,
+//so read loop fails and connection is respawned
+func (hnd *RequesterStatusHandler) startPinger(conn net.Conn, done <-chan struct{}) {
+
+	period := time.Duration(hnd.env.DSNPingPeriod) * time.Second
+	if period <= 0 {
+		period = pingPeriod
+	}
+	atomic.StoreInt64(&hnd.pingSentAt, 0)
+
+	go func() {
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+
+			case <-ticker.C:
+				if atomic.LoadInt64(&hnd.pingSentAt) != 0 {
+					hnd.logger.Warn().Msgf("No pong from DSN during %s, will close connection", period)
+					upstreamPingTimeouts.Inc()
+					conn.Close()
+					return
+				}
+
+				sentAt := time.Now().UnixNano()
+				payload := make([]byte, 8)
+				binary.BigEndian.PutUint64(payload, uint64(sentAt))
+
+				atomic.StoreInt64(&hnd.pingSentAt, sentAt)
+				if err := hnd.writeControl(conn, gws.OpPing, payload); err != nil {
+					hnd.logger.Err(err).Msgf("failed to send ping DSN, will close connection")
+					conn.Close()
+					return
+				}
+				hnd.logger.Debug().Msgf("Ping sent to DSN")
+			}
+		}
+	}()
+}
+
+//Pong payload is echo of our ping payload with send time
+func (hnd *RequesterStatusHandler) handlePong(payload []byte) {
+
+	sentAt := atomic.LoadInt64(&hnd.pingSentAt)
+	if len(payload) != 8 || sentAt == 0 || int64(binary.BigEndian.Uint64(payload)) != sentAt {
+		hnd.logger.Debug().Msgf("Unsolicited pong from DSN")
+		return
+	}
+	atomic.StoreInt64(&hnd.pingSentAt, 0)
+
+	rtt := time.Since(time.Unix(0, sentAt))
+	upstreamPingRTT.WithLabelValues(hnd.endpoint.HostPort).Observe(rtt.Seconds())
+	hnd.logger.Debug().Msgf("Pong from DSN, rtt %s", rtt)
+}
+
+func (hnd *RequesterStatusHandler) writeControl(conn net.Conn, op gws.OpCode, payload []byte) error {
+	hnd.writeMu.Lock()
+	defer hnd.writeMu.Unlock()
+
+	if err := conn.SetWriteDeadline(time.Now().Add(writeDeadline)); err != nil {
+		return fmt.Errorf("failed to set write deadline: %w", err)
+	}
+	return wsutil.WriteClientMessage(conn, op, payload)
+}
+
+//Next connection will go to another replica if there is one
+func (hnd *RequesterStatusHandler) reportEndpointFailure() {
+	hnd.endpoint.ReportFailure()
+	hnd.failover = true
+}
+
 func (hnd *RequesterStatusHandler) Stop() {
 	hnd.logger.Debug().Msgf("Make stop to receive info from DSN, id: %s", hnd.id)
 	hnd.stopChan <- true
 }
 
-func (hnd *RequesterStatusHandler) respawn(ctx context.Context, respMessagechan chan *model.ResponseMessage) {
-	hnd.logger.Debug().Msgf("Respawn RequesterStatusHandler with timeout: %d", respawnTimeout)
-	time.Sleep(respawnTimeout)
-	hnd.Run(ctx, respMessagechan)
-}
-
-func (hnd *RequesterStatusHandler) writeBuffer(writer *wsutil.Writer, buffer []byte) error {
-	var err error
+//Close current connection, so DSN is connected again with current credentials of subscribers
+func (hnd *RequesterStatusHandler) Reconnect() {
+	hnd.logger.Debug().Msgf("Reconnect to DSN, id: %s", hnd.id)
+	hnd.writeMu.Lock()
+	atomic.StoreInt32(&hnd.reconnecting, 1)
+	if hnd.conn != nil {
+		hnd.conn.Close()
+	}
+	hnd.writeMu.Unlock()
 
-	if _, err = writer.Write(buffer); err != nil {
-		return err
+	//Wake up respawn waiting after failure
+	select {
+	case hnd.reconnectChan <- struct{}{}:
+	default:
 	}
+}
 
-	if err = writer.Flush(); err != nil {
-		return err
+//Remember current connection to close it on Reconnect(). If reconnect was requested while dialing, conn is closed
+func (hnd *RequesterStatusHandler) setConn(conn net.Conn) {
+	hnd.writeMu.Lock()
+	defer hnd.writeMu.Unlock()
+	hnd.conn = conn
+	if conn != nil && atomic.LoadInt32(&hnd.reconnecting) == 1 {
+		conn.Close()
 	}
+}
 
-	return nil
+//If waitReconnect is true, there is no timeout and DSN is connected again only after Reconnect()
+func (hnd *RequesterStatusHandler) respawn(ctx context.Context, respMessagechan chan *model.ResponseMessage, waitReconnect bool) {
+	var timeout <-chan time.Time
+	if waitReconnect {
+		hnd.logger.Debug().Msgf("Respawn RequesterStatusHandler after reconnect")
+	} else {
+		hnd.logger.Debug().Msgf("Respawn RequesterStatusHandler with timeout: %d", respawnTimeout)
+		timeout = time.After(respawnTimeout)
+	}
+	select {
+	case <-timeout:
+	case <-hnd.reconnectChan:
+	case <-ctx.Done():
+		return
+	}
+	hnd.Run(ctx, respMessagechan)
 }
 
-func (hnd *RequesterStatusHandler) readClosePacketBody(conn *net.Conn, hdr gws.Header) (code uint16, msg error, err error) {
+//Read body of close frame. If DSN does not send the code, 5000 will be returned.
+//msg contains reason text from DSN or "internal error" if it is empty
+func (hnd *RequesterStatusHandler) readClosePacketBody(r io.Reader) (code uint16, msg error, err error) {
 
-	payload := make([]byte, hdr.Length)
-	_, err = io.ReadFull(*conn, payload)
+	payload, err := ioutil.ReadAll(r)
 	if err != nil {
-		err = fmt.Errorf("read error from websocket DSN")
+		err = fmt.Errorf("read error from websocket DSN: %w", err)
 	}
 
 	code = uint16(5000)
+	reason := ""
 	if len(payload) > 1 {
-		code = binary.BigEndian.Uint16(payload[:2])
+		statusCode, text := gws.ParseCloseFrameData(payload)
+		code, reason = uint16(statusCode), text
 	}
 
-	msg = fmt.Errorf("internal error") //TODO read error from socket
+	if reason == "" {
+		reason = "internal error"
+	}
+	msg = fmt.Errorf("%s", reason)
 	return code, msg, err
 }